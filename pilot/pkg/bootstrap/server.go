@@ -305,6 +305,8 @@ func NewServer(args *PilotArgs) (*Server, error) {
 	caOpts.Authenticators = authenticators
 	if features.XDSAuth {
 		s.XDSServer.Authenticators = authenticators
+		s.XDSServer.UnionIdentities = features.XDSUnionIdentities
+		s.XDSServer.RequireAllAuthenticators = features.XDSRequireAllAuthenticators
 	}
 
 	s.initDNSServer(args)
@@ -330,6 +332,7 @@ func NewServer(args *PilotArgs) (*Server, error) {
 	s.addReadinessProbe("discovery", func() (bool, error) {
 		return s.XDSServer.IsServerReady(), nil
 	})
+	s.addReadinessProbe("push-queue", s.XDSServer.IsPushQueueReady)
 
 	return s, nil
 }
@@ -526,6 +529,7 @@ func (s *Server) initDiscoveryService(args *PilotArgs) {
 		return nil
 	})
 
+	xds.RegisterSendCompressors()
 	s.initGrpcServer(args.KeepaliveOptions)
 
 	if args.ServerOptions.GRPCAddr != "" {
@@ -558,6 +562,12 @@ func (s *Server) waitForShutdown(stop <-chan struct{}) {
 		s.fileWatcher.Close()
 		model.GetJwtKeyResolver().Close()
 
+		// Disconnect the XDS clients first, so they reconnect to another replica. Otherwise their
+		// streams would keep the graceful stop below from completing.
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), s.shutdownDuration)
+		s.XDSServer.Drain(drainCtx)
+		drainCancel()
+
 		// Stop gRPC services.  If gRPC services fail to stop in the shutdown duration,
 		// force stop them. This does not happen normally.
 		stopped := make(chan struct{})
@@ -308,6 +308,22 @@ var (
 	XDSAuth = env.RegisterBoolVar("XDS_AUTH", true,
 		"If true, will authenticate XDS clients.").Get()
 
+	XDSUnionIdentities = env.RegisterBoolVar(
+		"PILOT_XDS_UNION_IDENTITIES",
+		false,
+		"If enabled, all the XDS authenticators are consulted, and the identities of a connection are those "+
+			"returned by each one that succeeds, for example by both mTLS and JWT. By default, the identities of "+
+			"the first authenticator that succeeds are used.",
+	).Get()
+
+	XDSRequireAllAuthenticators = env.RegisterBoolVar(
+		"PILOT_XDS_REQUIRE_ALL_AUTHENTICATORS",
+		false,
+		"If enabled, each XDS authenticator that applies to a request, such as the client certificate one for a "+
+			"request with a client certificate, or the JWT one for a request with a token, must succeed, and the "+
+			"identities of the connection are those of all of them. By default, the first one that succeeds is used.",
+	).Get()
+
 	EnableXDSIdentityCheck = env.RegisterBoolVar(
 		"PILOT_ENABLE_XDS_IDENTITY_CHECK",
 		true,
@@ -334,4 +350,429 @@ var (
 
 	EnableEDSCaching = env.RegisterBoolVar("PILOT_ENABLE_EDS_CACHE", true,
 		"If true, Pilot will cache EDS responses.").Get()
+
+	PushQueueReadinessThreshold = env.RegisterIntVar(
+		"PILOT_PUSH_QUEUE_READINESS_THRESHOLD",
+		0,
+		"If greater than 0, Istiod will report not ready while more than this number of proxies are "+
+			"waiting in the push queue, so new connections are sent to less loaded replicas. "+
+			"By default the push queue backlog is ignored for readiness.",
+	).Get()
+
+	EnableFastInitialLds = env.RegisterBoolVar(
+		"PILOT_ENABLE_FAST_INITIAL_LDS",
+		false,
+		"If enabled, Pilot will respond to the first LDS request of a new proxy immediately with an empty "+
+			"set of listeners, and follow up with a full push once the config has been generated.",
+	).Get()
+
+	IgnoreUnsupportedXdsTypes = env.RegisterBoolVar(
+		"PILOT_IGNORE_UNSUPPORTED_XDS_TYPES",
+		false,
+		"If enabled, requests for a type URL that no generator supports are logged and ignored. "+
+			"By default the connection is closed.",
+	).Get()
+
+	EnableShortConnectionID = env.RegisterBoolVar(
+		"PILOT_ENABLE_SHORT_CONNECTION_ID",
+		false,
+		"If enabled, XDS connection IDs will be based on the proxy ID (pod name and namespace) instead "+
+			"of the full node ID. A counter is always appended, so IDs remain unique across reconnects.",
+	).Get()
+
+	XDSSentResourceNamesLimit = env.RegisterIntVar(
+		"PILOT_XDS_SENT_RESOURCE_NAMES_LIMIT",
+		0,
+		"If greater than 0, Pilot will retain the names of up to this many resources included in the last "+
+			"response of each type, for debugging. By default the names are not retained.",
+	).Get()
+
+	MaxConcurrentPushesPerConnection = env.RegisterIntVar(
+		"PILOT_MAX_CONCURRENT_PUSHES_PER_CONNECTION",
+		1,
+		"Limits the number of pushes that may be in flight for a single XDS connection. Overlapping pushes "+
+			"beyond the limit are queued again instead of running concurrently. 0 disables the limit.",
+	).Get()
+
+	PushBatchFleetSize = env.RegisterIntVar(
+		"PILOT_PUSH_BATCH_FLEET_SIZE",
+		0,
+		"If greater than 0, pushes to more than this number of connected proxies are enqueued in batches of "+
+			"PILOT_PUSH_BATCH_SIZE, with PILOT_PUSH_BATCH_INTERVAL between batches, to smooth the load. "+
+			"By default all proxies are enqueued at once.",
+	).Get()
+
+	PushBatchSize = env.RegisterIntVar(
+		"PILOT_PUSH_BATCH_SIZE",
+		500,
+		"The number of proxies enqueued in each batch, when push batching is enabled by PILOT_PUSH_BATCH_FLEET_SIZE.",
+	).Get()
+
+	PushBatchInterval = env.RegisterDurationVar(
+		"PILOT_PUSH_BATCH_INTERVAL",
+		100*time.Millisecond,
+		"The delay between batches, when push batching is enabled by PILOT_PUSH_BATCH_FLEET_SIZE.",
+	).Get()
+
+	XDSConfigGrowthThreshold = env.RegisterFloatVar(
+		"PILOT_XDS_CONFIG_GROWTH_THRESHOLD",
+		0,
+		"If greater than 0, Pilot will log a warning when the size of a response sent to a proxy grows by more "+
+			"than this ratio compared to the previous response of the same type. By default this is disabled.",
+	).Get()
+
+	ReconnectGenerationQPS = env.RegisterFloatVar(
+		"PILOT_RECONNECT_GENERATION_QPS",
+		0,
+		"If greater than 0, limits the rate at which reconnecting proxies trigger a full config generation. "+
+			"Reconnecting proxies wait for their turn once per connection, before their first request is processed, "+
+			"so a mass reconnect does not overwhelm the CPU. "+
+			"By default this is not limited.",
+	).Get()
+
+	ReconnectGenerationBurst = env.RegisterIntVar(
+		"PILOT_RECONNECT_GENERATION_BURST",
+		10,
+		"The number of reconnecting proxies that may trigger a full config generation at once, "+
+			"when limited by PILOT_RECONNECT_GENERATION_QPS.",
+	).Get()
+
+	EnableXDSAccessLog = env.RegisterBoolVar(
+		"PILOT_ENABLE_XDS_ACCESS_LOG",
+		false,
+		"If enabled, Pilot will write a JSON line for each XDS response sent and each request received, "+
+			"to the destination configured by PILOT_XDS_ACCESS_LOG_PATH.",
+	).Get()
+
+	XDSAccessLogPath = env.RegisterStringVar(
+		"PILOT_XDS_ACCESS_LOG_PATH",
+		"/dev/stdout",
+		"The file the XDS access log is written to, when enabled by PILOT_ENABLE_XDS_ACCESS_LOG.",
+	).Get()
+
+	PreserveEdsSubscriptionOnReconnect = env.RegisterBoolVar(
+		"PILOT_PRESERVE_EDS_SUBSCRIPTION_ON_RECONNECT",
+		false,
+		"If enabled, Pilot remembers the EDS clusters of a disconnected proxy for a short time. If the proxy "+
+			"reconnects and requests EDS before CDS is re-established, the remembered clusters are served "+
+			"immediately instead of an empty response.",
+	).Get()
+
+	UnknownProxyVersion = env.RegisterStringVar(
+		"PILOT_UNKNOWN_PROXY_VERSION",
+		"",
+		"The Istio version assumed for proxies that do not report one in their node metadata, such as "+
+			"minimal xDS clients. If unset, the latest version is assumed. Setting it to an older version, "+
+			"for example 1.7, generates conservative config for these proxies in meshes with mixed clients.",
+	).Get()
+
+	EnableDeterministicXDS = env.RegisterBoolVar(
+		"PILOT_ENABLE_DETERMINISTIC_XDS",
+		false,
+		"If enabled, XDS responses are made reproducible: resources are sorted by name, and versions and "+
+			"nonces are sequence numbers rather than timestamps and random IDs. Intended for debugging and "+
+			"golden file testing.",
+	).Get()
+
+	EnableHealthPushPriority = env.RegisterBoolVar(
+		"PILOT_ENABLE_HEALTH_PUSH_PRIORITY",
+		false,
+		"If enabled, pushes to proxies with recent NACKs, send timeouts or reconnects are enqueued after "+
+			"pushes to healthy proxies, so flapping proxies do not starve healthy ones during a push storm.",
+	).Get()
+
+	LogProxyLocality = env.RegisterBoolVar(
+		"PILOT_LOG_PROXY_LOCALITY",
+		false,
+		"If enabled, Pilot logs the locality resolved for each proxy when it connects, and whether it "+
+			"was taken from the service registry or reported by the proxy.",
+	).Get()
+
+	EDSCoalesceWindow = env.RegisterDurationVar(
+		"PILOT_EDS_COALESCE_WINDOW",
+		0,
+		"If greater than 0, incremental EDS pushes to a proxy are accumulated until no new change arrived "+
+			"for this long, and sent as a single push. By default, each change is pushed as it comes.",
+	).Get()
+
+	EDSCoalesceMaxDelay = env.RegisterDurationVar(
+		"PILOT_EDS_COALESCE_MAX_DELAY",
+		time.Second,
+		"The maximum time an incremental EDS push may be held back when PILOT_EDS_COALESCE_WINDOW is set.",
+	).Get()
+
+	IsolateGenerationErrors = env.RegisterBoolVar(
+		"PILOT_ISOLATE_GENERATION_ERRORS",
+		false,
+		"If enabled, a failure to generate config of one type for a proxy is logged and reported, and the "+
+			"other types are still pushed. By default, the failure closes the connection to the proxy.",
+	).Get()
+
+	PushCircuitBreakerThreshold = env.RegisterIntVar(
+		"PILOT_PUSH_CIRCUIT_BREAKER_THRESHOLD",
+		0,
+		"If greater than 0, a failed push no longer closes the connection. Instead, after this many consecutive "+
+			"push failures, pushes to the connection are skipped until PILOT_PUSH_CIRCUIT_BREAKER_COOLDOWN has "+
+			"passed or a response is sent successfully, and the skipped pushes are sent once it has passed. A send "+
+			"timeout still closes the connection. By default this is disabled, and a failed push closes the connection.",
+	).Get()
+
+	PushCircuitBreakerCooldown = env.RegisterDurationVar(
+		"PILOT_PUSH_CIRCUIT_BREAKER_COOLDOWN",
+		30*time.Second,
+		"How long pushes are skipped for a connection once its circuit breaker opens, before a push is tried again.",
+	).Get()
+
+	EDSTriggerServicesLimit = env.RegisterIntVar(
+		"PILOT_EDS_TRIGGER_SERVICES_LIMIT",
+		0,
+		"If greater than 0, Pilot records up to this many of the services that triggered the last "+
+			"incremental EDS push to each proxy, for debugging. By default they are not recorded.",
+	).Get()
+
+	MaxConnectionLifetime = env.RegisterDurationVar(
+		"PILOT_MAX_CONNECTION_LIFETIME",
+		0,
+		"If greater than 0, XDS connections are closed once they are older than this, plus up to 10% jitter, "+
+			"and the proxy has completed its initial sync. The proxy reconnects, possibly to another Istiod "+
+			"replica, which rebalances connections after a scale up. By default connections are not closed.",
+	).Get()
+
+	ServeStalePushContext = env.RegisterBoolVar(
+		"PILOT_SERVE_STALE_PUSH_CONTEXT",
+		false,
+		"If enabled, connections are served the last fully built push context while the push context of the "+
+			"environment is not initialized, instead of initializing it in the connection.",
+	).Get()
+
+	XDSSendCompression = env.RegisterStringVar(
+		"PILOT_XDS_SEND_COMPRESSION",
+		"none",
+		"Compression accepted for the XDS responses, one of none, gzip or zstd. A proxy that compresses "+
+			"its requests with it receives compressed responses, other proxies receive uncompressed responses. "+
+			"With none, compression is disabled for all proxies.",
+	).Get()
+
+	EmptyResourceNames = env.RegisterStringVar(
+		"PILOT_EMPTY_RESOURCE_NAMES",
+		"unsubscribe",
+		"How an ACK that shrinks the EDS or RDS resource names of a proxy to empty is handled. With unsubscribe, "+
+			"following the XDS protocol, the proxy is unsubscribed from all resources of the type and nothing is "+
+			"pushed. With retain, the empty list is ignored and the proxy keeps its previous subscription.",
+	).Get()
+
+	WarmupDuration = env.RegisterDurationVar(
+		"PILOT_WARMUP_DURATION",
+		0,
+		"If greater than 0, for this long after Istiod becomes ready, new XDS connections are accepted at a "+
+			"rate increasing from PILOT_WARMUP_INITIAL_QPS to PILOT_WARMUP_FINAL_QPS, to smooth the CPU spike "+
+			"of the first connections while the process is cold. By default connections are not limited.",
+	).Get()
+
+	WarmupInitialQPS = env.RegisterFloatVar(
+		"PILOT_WARMUP_INITIAL_QPS",
+		10,
+		"The rate new XDS connections are accepted at when Istiod becomes ready, if PILOT_WARMUP_DURATION is set.",
+	).Get()
+
+	WarmupFinalQPS = env.RegisterFloatVar(
+		"PILOT_WARMUP_FINAL_QPS",
+		100,
+		"The rate new XDS connections are accepted at by the end of PILOT_WARMUP_DURATION.",
+	).Get()
+
+	UnauthenticatedXDSPolicy = env.RegisterStringVar(
+		"PILOT_UNAUTHENTICATED_XDS_POLICY",
+		"allow",
+		"How XDS connections without an authenticated identity, including connections on the plaintext port, "+
+			"are handled. With allow, they are served like any other connection. With untrusted, they only "+
+			"receive the Envoy cluster, endpoint, listener and route types, and cannot select a generator. "+
+			"With deny, they are rejected.",
+	).Get()
+
+	NackRateWindow = env.RegisterDurationVar(
+		"PILOT_NACK_RATE_WINDOW",
+		0,
+		"If set, the rolling window the pilot_xds_nack_rate gauge, the rate of NACKs by type and proxy "+
+			"version, is computed over. By default the rate is not computed.",
+	).Get()
+
+	XDSAckHistorySize = env.RegisterIntVar(
+		"PILOT_XDS_ACK_HISTORY_SIZE",
+		0,
+		"If greater than 0, the number of most recent ACK and NACK events retained for each XDS connection, "+
+			"and shown in /debug/ack_history. By default no history is retained.",
+	).Get()
+
+	WarmStartStatePath = env.RegisterStringVar(
+		"PILOT_WARM_START_STATE_PATH",
+		"",
+		"If set, the state of the XDS connections is saved to this file on shutdown. On start, before becoming "+
+			"ready, the config of the saved connections is generated into the caches, so reconnecting proxies "+
+			"are served from the caches: their endpoints with PILOT_ENABLE_EDS_CACHE, and their clusters with "+
+			"PILOT_ENABLE_PROXY_SHAPE_CACHE. This trades startup time and memory for faster reconnects.",
+	).Get()
+
+	XDSSendTimeout = env.RegisterDurationVar(
+		"PILOT_XDS_SEND_TIMEOUT",
+		5*time.Second,
+		"The minimum time to wait for an XDS response to be sent, before the client is considered stuck "+
+			"and disconnected. Large responses are given more time, see PILOT_XDS_SEND_MIN_BYTES_PER_SECOND.",
+	).Get()
+
+	XDSSendMinBytesPerSecond = env.RegisterIntVar(
+		"PILOT_XDS_SEND_MIN_BYTES_PER_SECOND",
+		1024*1024,
+		"The slowest rate an XDS response is expected to be sent at. The send timeout is extended for "+
+			"responses that would take longer than PILOT_XDS_SEND_TIMEOUT to send at this rate. "+
+			"If 0, the timeout does not depend on the response size.",
+	).Get()
+
+	XDSWaitForAck = env.RegisterBoolVar(
+		"PILOT_XDS_WAIT_FOR_ACK",
+		false,
+		"If enabled, a full push of a type to a proxy waits for the proxy to ACK or NACK the previous "+
+			"response of that type, up to PILOT_XDS_ACK_WAIT_TIMEOUT. This avoids interleaving versions of "+
+			"the types under churn, at the cost of slower pushes to slow proxies.",
+	).Get()
+
+	XDSAckWaitTimeout = env.RegisterDurationVar(
+		"PILOT_XDS_ACK_WAIT_TIMEOUT",
+		5*time.Second,
+		"The maximum time a push of each type waits for the previous response of that type to be "+
+			"acknowledged, if PILOT_XDS_WAIT_FOR_ACK is enabled.",
+	).Get()
+
+	MaxXDSConnections = env.RegisterIntVar(
+		"PILOT_MAX_XDS_CONNECTIONS",
+		0,
+		"The maximum number of concurrent XDS streams. Additional streams are rejected with "+
+			"ResourceExhausted, so proxies retry, possibly against another replica. If 0, streams are not limited.",
+	).Get()
+
+	CoalesceFullPushes = env.RegisterBoolVar(
+		"PILOT_COALESCE_FULL_PUSHES",
+		false,
+		"If enabled, full pushes to a proxy are also accumulated over PILOT_EDS_COALESCE_WINDOW, up to "+
+			"PILOT_EDS_COALESCE_MAX_DELAY, and merged with the incremental pushes. Requires PILOT_EDS_COALESCE_WINDOW.",
+	).Get()
+
+	LoadReportingInterval = env.RegisterDurationVar(
+		"PILOT_LOAD_REPORTING_INTERVAL",
+		0,
+		"If greater than 0, Istiod serves the Load Reporting Service, and proxies report the load of each "+
+			"cluster at this interval. By default, load reporting is disabled.",
+	).Get()
+
+	PushQueuePriority = env.RegisterBoolVar(
+		"PILOT_PUSH_QUEUE_PRIORITY",
+		false,
+		"If enabled, full pushes are dequeued from the push queue ahead of incremental EDS pushes, so "+
+			"structural changes reach proxies first during large rollouts. See PILOT_PUSH_QUEUE_FAIRNESS.",
+	).Get()
+
+	PushQueueFairness = env.RegisterIntVar(
+		"PILOT_PUSH_QUEUE_FAIRNESS",
+		10,
+		"With PILOT_PUSH_QUEUE_PRIORITY, the maximum number of full pushes dequeued while an incremental "+
+			"push is waiting, before the incremental push is dequeued. This keeps incremental pushes "+
+			"from being starved. Values below 1 are treated as 1.",
+	).Get()
+
+	XDSMaxResponseBytes = env.RegisterIntVar(
+		"PILOT_XDS_MAX_RESPONSE_BYTES",
+		0,
+		"If greater than 0, responses whose resources exceed this size in bytes are not sent, and the push "+
+			"fails with an error naming the type and number of resources. This should be at most the maximum "+
+			"gRPC message size of the proxies. By default, the size is not checked.",
+	).Get()
+
+	ExpiredNonceResyncThreshold = env.RegisterIntVar(
+		"PILOT_EXPIRED_NONCE_RESYNC_THRESHOLD",
+		0,
+		"If greater than 0, after this many consecutive requests of a type with an expired nonce, the state "+
+			"of the type is reset and a response is sent, as if the proxy had reconnected. This recovers "+
+			"proxies whose nonce is out of sync, which would otherwise never get a response again. By "+
+			"default, requests with an expired nonce are always ignored.",
+	).Get()
+
+	XDSKeepaliveInterval = env.RegisterDurationVar(
+		"PILOT_XDS_KEEPALIVE_INTERVAL",
+		0,
+		"If greater than 0, connections are checked at this interval, and the current config is pushed "+
+			"again to the ones idle for longer than PILOT_XDS_KEEPALIVE_IDLE. This keeps intermediaries "+
+			"that drop idle streams from closing them. By default, idle connections are not pushed.",
+	).Get()
+
+	XDSKeepaliveIdle = env.RegisterDurationVar(
+		"PILOT_XDS_KEEPALIVE_IDLE",
+		0,
+		"With PILOT_XDS_KEEPALIVE_INTERVAL, the time since the last response after which a connection is "+
+			"idle. If 0, PILOT_XDS_KEEPALIVE_INTERVAL is used.",
+	).Get()
+
+	XDSRequestQPS = env.RegisterFloatVar(
+		"PILOT_XDS_REQUEST_QPS",
+		0,
+		"If greater than 0, limits the rate of requests each proxy may send on a connection. A connection "+
+			"exceeding it, for example in a NACK loop, is closed with ResourceExhausted. This should be set "+
+			"well above the rate of ACKs of a healthy proxy. By default this is not limited.",
+	).Get()
+
+	XDSRequestBurst = env.RegisterIntVar(
+		"PILOT_XDS_REQUEST_BURST",
+		100,
+		"The number of requests a proxy may send at once on a connection, when limited by PILOT_XDS_REQUEST_QPS.",
+	).Get()
+
+	EnableProxyShapeCache = env.RegisterBoolVar(
+		"PILOT_ENABLE_PROXY_SHAPE_CACHE",
+		false,
+		"If enabled, the CDS resources generated for a proxy are reused for the proxies of the same shape, such "+
+			"as the replicas of a deployment, until the push context changes. LDS is not cached, since the inbound "+
+			"listeners are bound to the addresses of each proxy.",
+	).Get()
+
+	XDSTenantLabels = env.RegisterStringVar(
+		"PILOT_XDS_TENANT_LABELS",
+		"",
+		"Comma separated list of proxy label keys identifying the tenant of a proxy. If set, the XDS connections, "+
+			"responses and bytes sent are reported by tenant. Only these labels are used, to bound the cardinality.",
+	).Get()
+
+	UnknownGeneratorPolicy = env.RegisterStringVar(
+		"PILOT_UNKNOWN_GENERATOR_POLICY",
+		"fallback",
+		"How XDS connections requesting a generator that is not registered are handled. With fallback, they are "+
+			"served by the built-in handlers. With reject, they are closed with an InvalidArgument status.",
+	).Get()
+
+	DeduplicateProxyPushes = env.RegisterBoolVar(
+		"PILOT_DEDUPLICATE_PROXY_PUSHES",
+		false,
+		"If enabled, when a proxy holds several XDS connections while it reconnects, config pushes are only "+
+			"sent to its most recent connection.",
+	).Get()
+
+	PushQueueHighWatermark = env.RegisterIntVar(
+		"PILOT_PUSH_QUEUE_HIGH_WATERMARK",
+		0,
+		"If positive, while more connections than this are queued for a push, full pushes enqueued for a "+
+			"connection being pushed are deferred until the queue drops below it, rather than pushed again with "+
+			"each intermediate version. 0 disables it.",
+	).Get()
+
+	EDSLocalityTruncation = env.RegisterBoolVar(
+		"PILOT_EDS_LOCALITY_TRUNCATION",
+		false,
+		"If enabled, the endpoints sent to a proxy with a locality are truncated to all the endpoints in its zone, "+
+			"and PILOT_EDS_LOCALITY_FALLBACK_ENDPOINTS endpoints of each other zone of its region and of each other "+
+			"region, for locality failover. Endpoints are not truncated if the zone of the proxy has none.",
+	).Get()
+
+	EDSLocalityFallbackEndpoints = env.RegisterIntVar(
+		"PILOT_EDS_LOCALITY_FALLBACK_ENDPOINTS",
+		10,
+		"The number of endpoints kept for each other zone and region with PILOT_EDS_LOCALITY_TRUNCATION. At least 1.",
+	).Get()
 )
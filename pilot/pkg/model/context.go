@@ -17,6 +17,7 @@ package model
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
@@ -34,6 +35,7 @@ import (
 	structpb "github.com/golang/protobuf/ptypes/struct"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
@@ -247,18 +249,58 @@ type WatchedResource struct {
 	// LastSent tracks the time of the generated push, to determine the time it takes the client to ack.
 	LastSent time.Time
 
-	// Updates count the number of generated updates for the resource
+	// Updates count the number of generated updates for the resource. It is used as the per-type
+	// version stream, so versions sent for this type are independent of other types.
 	Updates int
 
 	// LastSize tracks the size of the last update
 	LastSize int
 
+	// LastSentResourceNames has the names of the resources included in the last sent response. Unlike
+	// ResourceNames, which are the resources requested, this is what was actually delivered. It is only
+	// populated if PILOT_XDS_SENT_RESOURCE_NAMES_LIMIT is set, and is bounded by it.
+	LastSentResourceNames []string
+
+	// GenerationError is the error from the last attempt to generate config of this type, if it failed.
+	// It is only populated if PILOT_ISOLATE_GENERATION_ERRORS is enabled, and cleared on the next send.
+	GenerationError string
+
 	// Last request contains the last DiscoveryRequest received for
 	// this type. Generators are called immediately after each request,
 	// and may use the information in DiscoveryRequest.
 	// Note that Envoy may send multiple requests for the same type, for
 	// example to update the set of watched resources or to ACK/NACK.
 	LastRequest *discovery.DiscoveryRequest
+
+	// LastNack is the last NACK received for this type. It is cleared when the proxy ACKs a response.
+	LastNack *NackDetail
+
+	// ExpiredNonces counts the consecutive requests received with a nonce other than NonceSent. It is
+	// reset when the proxy responds to the last nonce sent.
+	ExpiredNonces int
+
+	// PendingVersions has the nonces and versions of the responses sent since the last one the proxy
+	// responded to, oldest first, so a NACK for a response older than NonceSent reports the version it
+	// rejected. It is bounded, dropping the oldest responses.
+	PendingVersions []NonceVersion
+}
+
+// NonceVersion is the nonce and version of a response.
+type NonceVersion struct {
+	Nonce   string
+	Version string
+}
+
+// NackDetail describes a response rejected by a proxy.
+type NackDetail struct {
+	// Code is the gRPC status code of the rejection.
+	Code int32 `json:"code"`
+	// Message is the error reported by the proxy.
+	Message string `json:"message,omitempty"`
+	// Version is the version of the rejected response, or empty if the nonce of the response is unknown.
+	Version string `json:"version,omitempty"`
+	// Time is when the NACK was received.
+	Time time.Time `json:"time"`
 }
 
 var (
@@ -486,6 +528,14 @@ type NodeMetadata struct {
 	// DNSCapture indicates whether the workload has enabled dns capture
 	DNSCapture string `json:"DNS_CAPTURE,omitempty"`
 
+	// XdsDebug requests debug logs for the connections of this proxy, regardless of the level of the ads
+	// scope. It can only raise the verbosity, and is ignored for untrusted connections.
+	XdsDebug StringBool `json:"XDS_DEBUG,omitempty"`
+
+	// XdsCapabilities lists the xDS types implemented by the client, as type URLs or short types (CDS, EDS,
+	// LDS, RDS). Types not in the list are never pushed. If empty, all types are supported.
+	XdsCapabilities StringList `json:"XDS_CAPABILITIES,omitempty"`
+
 	// Contains a copy of the raw metadata. This is needed to lookup arbitrary values.
 	// If a value is known ahead of time it should be added to the struct rather than reading from here,
 	Raw map[string]interface{} `json:"-"`
@@ -784,6 +834,13 @@ func ParseMetadata(metadata *structpb.Struct) (*NodeMetadata, error) {
 	return &meta.NodeMetadata, nil
 }
 
+// Errors wrapped by ParseServiceNodeWithMetadata, identifying why a service node can't be parsed.
+var (
+	ErrServiceNodeMissingParts = errors.New("missing parts")
+	ErrServiceNodeInvalidType  = errors.New("invalid node type (valid types: sidecar, router")
+	ErrServiceNodeNoIPAddress  = errors.New("no valid IP address")
+)
+
 // ParseServiceNodeWithMetadata parse the Envoy Node from the string generated by ServiceNode
 // function and the metadata.
 func ParseServiceNodeWithMetadata(s string, metadata *NodeMetadata) (*Proxy, error) {
@@ -793,11 +850,11 @@ func ParseServiceNodeWithMetadata(s string, metadata *NodeMetadata) (*Proxy, err
 	}
 
 	if len(parts) != 4 {
-		return out, fmt.Errorf("missing parts in the service node %q", s)
+		return out, fmt.Errorf("%w in the service node %q", ErrServiceNodeMissingParts, s)
 	}
 
 	if !IsApplicationNodeType(NodeType(parts[0])) {
-		return out, fmt.Errorf("invalid node type (valid types: sidecar, router in the service node %q", s)
+		return out, fmt.Errorf("%w in the service node %q", ErrServiceNodeInvalidType, s)
 	}
 	out.Type = NodeType(parts[0])
 
@@ -811,15 +868,17 @@ func ParseServiceNodeWithMetadata(s string, metadata *NodeMetadata) (*Proxy, err
 
 	// Does query from ingress or router have to carry valid IP address?
 	if len(out.IPAddresses) == 0 {
-		return out, fmt.Errorf("no valid IP address in the service node id or metadata")
+		return out, fmt.Errorf("%w in the service node id or metadata", ErrServiceNodeNoIPAddress)
 	}
 
 	out.ID = parts[2]
 	out.DNSDomain = parts[3]
 	if len(metadata.IstioVersion) == 0 {
 		log.Warnf("Istio Version is not found in metadata for %v, which may have undesirable side effects", out.ID)
+		out.IstioVersion = ParseIstioVersion(features.UnknownProxyVersion)
+	} else {
+		out.IstioVersion = ParseIstioVersion(metadata.IstioVersion)
 	}
-	out.IstioVersion = ParseIstioVersion(metadata.IstioVersion)
 	return out, nil
 }
 
@@ -28,6 +28,7 @@ import (
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/memory"
 	"istio.io/istio/pilot/pkg/serviceregistry/mock"
@@ -364,6 +365,39 @@ func TestParseMetadata(t *testing.T) {
 	}
 }
 
+func TestParseServiceNodeUnknownVersion(t *testing.T) {
+	nodeID := "sidecar~1.1.1.1~id~domain"
+
+	node, err := model.ParseServiceNodeWithMetadata(nodeID, &model.NodeMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.IstioVersion != model.MaxIstioVersion {
+		t.Fatalf("expected latest version by default, got %v", node.IstioVersion)
+	}
+
+	old := features.UnknownProxyVersion
+	features.UnknownProxyVersion = "1.7"
+	defer func() { features.UnknownProxyVersion = old }()
+
+	node, err = model.ParseServiceNodeWithMetadata(nodeID, &model.NodeMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&model.IstioVersion{Major: 1, Minor: 7}); !reflect.DeepEqual(node.IstioVersion, want) {
+		t.Fatalf("expected %v for a proxy without a version, got %v", want, node.IstioVersion)
+	}
+
+	// A reported version always takes precedence.
+	node, err = model.ParseServiceNodeWithMetadata(nodeID, &model.NodeMetadata{IstioVersion: "1.8.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&model.IstioVersion{Major: 1, Minor: 8}); !reflect.DeepEqual(node.IstioVersion, want) {
+		t.Fatalf("expected %v, got %v", want, node.IstioVersion)
+	}
+}
+
 func mapToStruct(msg map[string]interface{}) (*structpb.Struct, error) {
 	b, err := json.Marshal(msg)
 	if err != nil {
@@ -22,6 +22,8 @@ import (
 	"sync"
 	"time"
 
+	"go.uber.org/atomic"
+
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/features"
@@ -136,10 +138,15 @@ type PushContext struct {
 	// AuthnBetaPolicies contains (beta) Authn policies by namespace.
 	AuthnBetaPolicies *AuthenticationPolicies `json:"-"`
 
-	initDone bool
+	initDone atomic.Bool
 
 	Version string
 
+	// PushVersion is the version of the push this context was created for. Config generated from
+	// this context is sent with this version, so the version reported by proxies reflects the
+	// context it was actually generated from.
+	PushVersion string
+
 	// cache gateways addresses for each network
 	// this is mainly used for kubernetes multi-cluster scenario
 	networkGateways map[string][]*Gateway
@@ -248,6 +255,8 @@ const (
 	UnknownTrigger TriggerReason = "unknown"
 	// Describes a push triggered for debugging
 	DebugTrigger TriggerReason = "debug"
+	// Describes a push triggered to keep an idle connection alive
+	KeepaliveTrigger TriggerReason = "keepalive"
 )
 
 // Merge two update requests together
@@ -796,7 +805,7 @@ func (ps *PushContext) SubsetToLabels(proxy *Proxy, subsetName string, hostname
 func (ps *PushContext) InitContext(env *Environment, oldPushContext *PushContext, pushReq *PushRequest) error {
 	ps.Mutex.Lock()
 	defer ps.Mutex.Unlock()
-	if ps.initDone {
+	if ps.initDone.Load() {
 		return nil
 	}
 
@@ -812,7 +821,7 @@ func (ps *PushContext) InitContext(env *Environment, oldPushContext *PushContext
 	ps.initDefaultExportMaps()
 
 	// create new or incremental update
-	if pushReq == nil || oldPushContext == nil || !oldPushContext.initDone || len(pushReq.ConfigsUpdated) == 0 {
+	if pushReq == nil || oldPushContext == nil || !oldPushContext.initDone.Load() || len(pushReq.ConfigsUpdated) == 0 {
 		if err := ps.createNewContext(env); err != nil {
 			return err
 		}
@@ -827,10 +836,15 @@ func (ps *PushContext) InitContext(env *Environment, oldPushContext *PushContext
 
 	ps.initClusterLocalHosts(env)
 
-	ps.initDone = true
+	ps.initDone.Store(true)
 	return nil
 }
 
+// IsInitialized returns true once InitContext completed. It does not block while InitContext is running.
+func (ps *PushContext) IsInitialized() bool {
+	return ps.initDone.Load()
+}
+
 func (ps *PushContext) createNewContext(env *Environment) error {
 	if err := ps.initServiceRegistry(env); err != nil {
 		return err
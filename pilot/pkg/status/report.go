@@ -29,6 +29,9 @@ type DistributionReport struct {
 	Reporter            string         `json:"reporter"`
 	DataPlaneCount      int            `json:"dataPlaneCount"`
 	InProgressResources map[string]int `json:"inProgressResources"`
+	// InitialSyncCount is the number of dataplane and config type pairs still receiving their
+	// initial config, as opposed to applying updates.
+	InitialSyncCount int `json:"initialSyncCount,omitempty"`
 }
 
 func ReportFromYaml(content []byte) (DistributionReport, error) {
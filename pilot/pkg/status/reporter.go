@@ -64,6 +64,8 @@ type Reporter struct {
 	clock                  clock.Clock
 	store                  model.ConfigStore
 	distributionEventQueue chan distributionEvent
+	// set of connection ids and types, keyed like status, still receiving their initial config
+	initialSync map[string]struct{}
 }
 
 var _ xds.DistributionStatusCache = &Reporter{}
@@ -86,6 +88,7 @@ func (r *Reporter) Start(clientSet kubernetes.Interface, namespace string, store
 	r.distributionEventQueue = make(chan distributionEvent, 100_000)
 	r.status = make(map[string]string)
 	r.reverseStatus = make(map[string]map[string]struct{})
+	r.initialSync = make(map[string]struct{})
 	r.inProgressResources = make(map[string]*inProgressEntry)
 	go r.readFromEventQueue()
 	if !writeMode {
@@ -129,6 +132,7 @@ func (r *Reporter) buildReport() (DistributionReport, []Resource) {
 	out := DistributionReport{
 		Reporter:            r.PodName,
 		DataPlaneCount:      len(r.status),
+		InitialSyncCount:    len(r.initialSync),
 		InProgressResources: map[string]int{},
 	}
 	// for every resource in flight
@@ -245,6 +249,7 @@ type distributionEvent struct {
 	conID            string
 	distributionType xds.EventType
 	nonce            string
+	initial          bool
 }
 
 func (r *Reporter) QueryLastNonce(conID string, distributionType xds.EventType) (noncePrefix string) {
@@ -257,8 +262,8 @@ func (r *Reporter) QueryLastNonce(conID string, distributionType xds.EventType)
 // Register that a dataplane has acknowledged a new version of the config.
 // Theoretically, we could use the ads connections themselves to harvest this data,
 // but the mutex there is pretty hot, and it seems best to trade memory for time.
-func (r *Reporter) RegisterEvent(conID string, distributionType xds.EventType, nonce string) {
-	d := distributionEvent{nonce: nonce, distributionType: distributionType, conID: conID}
+func (r *Reporter) RegisterEvent(conID string, distributionType xds.EventType, nonce string, initial bool) {
+	d := distributionEvent{nonce: nonce, distributionType: distributionType, conID: conID, initial: initial}
 	select {
 	case r.distributionEventQueue <- d:
 		return
@@ -271,6 +276,7 @@ func (r *Reporter) readFromEventQueue() {
 	for ev := range r.distributionEventQueue {
 		// TODO might need to batch this to prevent lock contention
 		r.processEvent(ev.conID, ev.distributionType, ev.nonce)
+		r.setInitialSync(ev.conID, ev.distributionType, ev.initial)
 	}
 
 }
@@ -294,6 +300,18 @@ func (r *Reporter) processEvent(conID string, distributionType xds.EventType, no
 	r.reverseStatus[version][key] = struct{}{}
 }
 
+// setInitialSync records whether the dataplane is still receiving its initial config of the type.
+func (r *Reporter) setInitialSync(conID string, distributionType xds.EventType, initial bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := conID + distributionType
+	if initial {
+		r.initialSync[key] = struct{}{}
+	} else {
+		delete(r.initialSync, key)
+	}
+}
+
 // This is a helper function for keeping our reverseStatus map in step with status.
 // must have write lock before calling.
 func (r *Reporter) deleteKeyFromReverseMap(key string) {
@@ -316,5 +334,6 @@ func (r *Reporter) RegisterDisconnect(conID string, types []xds.EventType) {
 		key := conID + xdsType // TODO: delimit?
 		r.deleteKeyFromReverseMap(key)
 		delete(r.status, key)
+		delete(r.initialSync, key)
 	}
 }
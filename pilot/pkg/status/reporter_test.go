@@ -47,6 +47,21 @@ func TestStatusMaps(t *testing.T) {
 	Expect(r.reverseStatus).To(Equal(map[string]map[string]struct{}{"a": {"conB": x}, "c": {"conC": x}, "d": {"conD": x}}))
 }
 
+func TestInitialSync(t *testing.T) {
+	r := initReporterWithoutStarting()
+	RegisterTestingT(t)
+	r.setInitialSync("conA", "cds", true)
+	r.setInitialSync("conB", "cds", true)
+	r.setInitialSync("conB", "lds", false)
+	Expect(r.initialSync).To(HaveLen(2))
+	// Once the dataplane ACKs its initial config, it is applying updates.
+	r.setInitialSync("conA", "cds", false)
+	Expect(r.initialSync).To(HaveKey("conBcds"))
+	Expect(r.initialSync).To(HaveLen(1))
+	r.RegisterDisconnect("conB", []xds.EventType{"cds"})
+	Expect(r.initialSync).To(BeEmpty())
+}
+
 func initReporterWithoutStarting() (out Reporter) {
 	out.PodName = "tespod"
 	out.inProgressResources = map[string]*inProgressEntry{}
@@ -57,6 +72,7 @@ func initReporterWithoutStarting() (out Reporter) {
 	out.cm = nil    // TODO
 	out.reverseStatus = make(map[string]map[string]struct{})
 	out.status = make(map[string]string)
+	out.initialSync = make(map[string]struct{})
 	return
 }
 
@@ -0,0 +1,128 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/features"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// Outcomes recorded in the XDS access log.
+const (
+	accessLogSent           = "sent"
+	accessLogSendError      = "send_error"
+	accessLogSendTimeout    = "send_timeout"
+	accessLogRequest        = "request"
+	accessLogReconnect      = "reconnect"
+	accessLogAck            = "ack"
+	accessLogNack           = "nack"
+	accessLogExpiredNonce   = "expired_nonce"
+	accessLogResourceChange = "resource_change"
+)
+
+// accessLogEntry is a single line of the XDS access log.
+type accessLogEntry struct {
+	Time    time.Time `json:"time"`
+	ConID   string    `json:"conID"`
+	NodeID  string    `json:"nodeID,omitempty"`
+	Type    string    `json:"type"`
+	Version string    `json:"version,omitempty"`
+	Nonce   string    `json:"nonce,omitempty"`
+	Size    int       `json:"size,omitempty"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// accessLogger writes XDS access log entries as JSON lines. Unlike debug logging, it is meant
+// to be left on and consumed by machines, for audit and analytics.
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var (
+	accessLogOnce sync.Once
+	xdsAccessLog  *accessLogger
+)
+
+// getAccessLogger returns the XDS access logger, or nil if access logging is disabled.
+func getAccessLogger() *accessLogger {
+	accessLogOnce.Do(func() {
+		if !features.EnableXDSAccessLog {
+			return
+		}
+		w, err := openAccessLog(features.XDSAccessLogPath)
+		if err != nil {
+			adsLog.Warnf("failed to open XDS access log %s: %v", features.XDSAccessLogPath, err)
+			return
+		}
+		xdsAccessLog = &accessLogger{w: w}
+	})
+	return xdsAccessLog
+}
+
+func openAccessLog(path string) (io.Writer, error) {
+	switch path {
+	case "", "/dev/stdout":
+		return os.Stdout, nil
+	case "/dev/stderr":
+		return os.Stderr, nil
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+func (l *accessLogger) log(e accessLogEntry) {
+	if l == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(b)
+}
+
+// logXdsAccess records an XDS exchange with the connection in the access log, if enabled.
+func logXdsAccess(con *Connection, typeURL, version, nonce string, size int, outcome string, err error) {
+	l := getAccessLogger()
+	if l == nil {
+		return
+	}
+	e := accessLogEntry{
+		Time:    time.Now(),
+		ConID:   con.ConID,
+		Type:    v3.GetShortType(typeURL),
+		Version: version,
+		Nonce:   nonce,
+		Size:    size,
+		Outcome: outcome,
+	}
+	if con.proxy != nil {
+		e.NodeID = con.proxy.ID
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.log(e)
+}
@@ -0,0 +1,46 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &accessLogger{w: buf}
+	l.log(accessLogEntry{Time: time.Now(), ConID: "con-1", Type: "cds", Version: "v1", Nonce: "n1", Size: 10, Outcome: accessLogSent})
+	l.log(accessLogEntry{Time: time.Now(), ConID: "con-1", Type: "cds", Nonce: "n1", Outcome: accessLogAck})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %q", len(lines), buf.String())
+	}
+	var e accessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ConID != "con-1" || e.Type != "cds" || e.Size != 10 || e.Outcome != accessLogSent {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+
+	// A nil logger is disabled and must not panic.
+	var disabled *accessLogger
+	disabled.log(e)
+}
@@ -0,0 +1,92 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// AckEvent is a single ACK or NACK received from a proxy.
+type AckEvent struct {
+	Time    time.Time `json:"time"`
+	TypeURL string    `json:"typeUrl"`
+	Version string    `json:"version,omitempty"`
+	Nonce   string    `json:"nonce,omitempty"`
+	// Outcome is how the request was handled, one of the outcomes of the XDS access log.
+	Outcome string `json:"outcome"`
+	// Message is the error reported by the proxy in a NACK.
+	Message string `json:"message,omitempty"`
+}
+
+// ackHistory retains the most recent ACK and NACK events of a connection in a ring buffer, so the
+// recent protocol interaction with a proxy can be reconstructed after an incident.
+type ackHistory struct {
+	mu     sync.Mutex
+	events []AckEvent
+	// next is the index the next event is written to, once the buffer is full.
+	next int
+}
+
+func newAckHistory(size int) *ackHistory {
+	return &ackHistory{events: make([]AckEvent, 0, size)}
+}
+
+// add records an event, replacing the oldest one if the buffer is full.
+func (h *ackHistory) add(ev AckEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.events) < cap(h.events) {
+		h.events = append(h.events, ev)
+		return
+	}
+	h.events[h.next] = ev
+	h.next = (h.next + 1) % len(h.events)
+}
+
+// list returns the retained events, oldest first.
+func (h *ackHistory) list() []AckEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]AckEvent, 0, len(h.events))
+	out = append(out, h.events[h.next:]...)
+	return append(out, h.events[:h.next]...)
+}
+
+// recordAckEvent adds the request to the ACK history of the connection, if it is enabled.
+func (conn *Connection) recordAckEvent(request *discovery.DiscoveryRequest, outcome string) {
+	if conn.ackHistory == nil {
+		return
+	}
+	conn.ackHistory.add(AckEvent{
+		Time:    time.Now(),
+		TypeURL: request.TypeUrl,
+		Version: request.VersionInfo,
+		Nonce:   request.ResponseNonce,
+		Outcome: outcome,
+		Message: request.ErrorDetail.GetMessage(),
+	})
+}
+
+// AckHistory returns the most recent ACK and NACK events of the connection, oldest first, or nil if
+// PILOT_XDS_ACK_HISTORY_SIZE is 0.
+func (conn *Connection) AckHistory() []AckEvent {
+	if conn.ackHistory == nil {
+		return nil
+	}
+	return conn.ackHistory.list()
+}
@@ -0,0 +1,50 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func TestAckHistory(t *testing.T) {
+	con := &Connection{ackHistory: newAckHistory(3)}
+	for _, nonce := range []string{"n1", "n2", "n3", "n4"} {
+		con.recordAckEvent(&discovery.DiscoveryRequest{ResponseNonce: nonce}, accessLogAck)
+	}
+	con.recordAckEvent(&discovery.DiscoveryRequest{
+		ResponseNonce: "n5",
+		ErrorDetail:   &status.Status{Message: "rejected"},
+	}, accessLogNack)
+
+	history := con.AckHistory()
+	var nonces []string
+	for _, ev := range history {
+		nonces = append(nonces, ev.Nonce)
+	}
+	if !reflect.DeepEqual(nonces, []string{"n3", "n4", "n5"}) {
+		t.Fatalf("expected the 3 most recent events, oldest first, got %v", nonces)
+	}
+	if last := history[2]; last.Outcome != accessLogNack || last.Message != "rejected" {
+		t.Fatalf("expected the NACK message to be recorded, got %+v", last)
+	}
+
+	if history := (&Connection{}).AckHistory(); history != nil {
+		t.Fatalf("expected no history when disabled, got %v", history)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"time"
+
+	"istio.io/istio/pilot/pkg/features"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// recordResponse records the nonce the proxy responded to, with an ACK or a NACK. It is called as requests
+// are received, before they are processed, since processing happens on the same goroutine as pushes,
+// which may be waiting for the response.
+func (conn *Connection) recordResponse(typeURL, nonce string) {
+	conn.respondedMutex.Lock()
+	defer conn.respondedMutex.Unlock()
+	if conn.responded == nil {
+		conn.responded = map[string]string{}
+	}
+	conn.responded[typeURL] = nonce
+	if conn.respondedCh != nil {
+		close(conn.respondedCh)
+		conn.respondedCh = nil
+	}
+}
+
+// waitForResponse waits until the proxy responded to the last response sent for the type, or the timeout
+// expires. It returns false if the timeout expired. A NACK ends the wait as well: the proxy will not ACK
+// the rejected response, and the next push may fix it.
+func (conn *Connection) waitForResponse(typeURL string, timeout time.Duration) bool {
+	sent := conn.NonceSent(typeURL)
+	if sent == "" {
+		return true
+	}
+	var streamDone <-chan struct{}
+	if conn.stream != nil {
+		streamDone = conn.stream.Context().Done()
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		conn.respondedMutex.Lock()
+		if conn.responded[typeURL] == sent {
+			conn.respondedMutex.Unlock()
+			return true
+		}
+		if conn.respondedCh == nil {
+			conn.respondedCh = make(chan struct{})
+		}
+		ch := conn.respondedCh
+		conn.respondedMutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-t.C:
+			return false
+		case <-conn.stop:
+			return true
+		case <-streamDone:
+			return true
+		}
+	}
+}
+
+// waitForAck waits, if PILOT_XDS_WAIT_FOR_ACK is enabled, for the proxy to respond to the previous
+// response of the type before a new one is pushed. This avoids interleaving versions of dependent types,
+// for example pushing new listeners before the routes they refer to were accepted.
+func (s *DiscoveryServer) waitForAck(con *Connection, typeURL string) {
+	if !features.XDSWaitForAck {
+		return
+	}
+	if !con.waitForResponse(typeURL, features.XDSAckWaitTimeout) {
+		adsLog.Debugf("ADS:%s: timeout waiting for ACK of %s from %s", v3.GetShortType(typeURL), con.NonceSent(typeURL), con.ConID)
+		xdsAckWaitTimeouts.With(typeTag.Value(v3.GetMetricType(typeURL))).Increment()
+	}
+}
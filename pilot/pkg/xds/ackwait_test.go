@@ -0,0 +1,43 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+	"time"
+
+	model "istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestWaitForResponse(t *testing.T) {
+	con := newConnection("", nil)
+	con.proxy = &model.Proxy{WatchedResources: map[string]*model.WatchedResource{}}
+	if !con.waitForResponse(v3.ClusterType, time.Millisecond) {
+		t.Fatalf("expected no wait before anything was sent")
+	}
+	con.proxy.WatchedResources[v3.ClusterType] = &model.WatchedResource{TypeUrl: v3.ClusterType, NonceSent: "n1"}
+	if con.waitForResponse(v3.ClusterType, time.Millisecond) {
+		t.Fatalf("expected a timeout without a response")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		con.recordResponse(v3.ClusterType, "n0")
+		con.recordResponse(v3.ClusterType, "n1")
+	}()
+	if !con.waitForResponse(v3.ClusterType, time.Minute) {
+		t.Fatalf("expected the response to end the wait")
+	}
+}
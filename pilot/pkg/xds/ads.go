@@ -15,15 +15,25 @@
 package xds
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
@@ -33,6 +43,7 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/schema/gvk"
 	"istio.io/istio/pkg/spiffe"
 	istiolog "istio.io/pkg/log"
@@ -42,10 +53,6 @@ import (
 var (
 	adsLog = istiolog.RegisterScope("ads", "ads debugging", 0)
 
-	// sendTimeout is the max time to wait for a ADS send to complete. This helps detect
-	// clients in a bad state (not reading). In future it may include checking for ACK
-	sendTimeout = 5 * time.Second
-
 	// Tracks connections, increment on each new connection.
 	connectionNumber = int64(0)
 )
@@ -65,6 +72,10 @@ type Connection struct {
 	// Defines associated identities for the connection
 	Identities []string
 
+	// Untrusted is set for connections without an identity, when PILOT_UNAUTHENTICATED_XDS_POLICY is
+	// untrusted. They are restricted to the Envoy types, generated by the built-in handlers.
+	Untrusted bool
+
 	// Time of connection, for debugging
 	Connect time.Time
 
@@ -81,9 +92,167 @@ type Connection struct {
 	// Both ADS and SDS streams implement this interface
 	stream DiscoveryStream
 
+	// stop is closed to disconnect the client, for example when draining connections.
+	stop     chan struct{}
+	stopOnce sync.Once
+
 	// Original node metadata, to avoid unmarshal/marshal.
 	// This is included in internal events.
 	node *core.Node
+
+	// removed is set once the connection has been removed from the connection table.
+	// Protected by DiscoveryServer.adsClientsMutex.
+	removed bool
+
+	// paused is set when pushes to this connection are suspended, for debugging.
+	// Protected by DiscoveryServer.adsClientsMutex.
+	paused bool
+
+	// queueWait is the time, in nanoseconds, the last push to this connection waited in the push
+	// queue before being picked up by a worker. Accessed atomically.
+	queueWait int64
+
+	// nacks and sendTimeouts count recent NACKs and send timeouts. Each ACK or successful send
+	// decrements the respective count, so they recover as the proxy becomes healthy again.
+	// reconnected is set if the proxy reconnected with state from a previous connection.
+	// All are accessed atomically, and used to compute the HealthScore.
+	nacks        int32
+	sendTimeouts int32
+	reconnected  int32
+
+	// capture, if set, receives the responses instead of the stream. It is used for dry runs, which
+	// record the responses in captured.
+	capture  func(*discovery.DiscoveryResponse)
+	captured []PushPlanResponse
+
+	// pushFailures counts consecutive failed pushes, and breakerOpenedAt is the time, in Unix
+	// nanoseconds, the push circuit breaker opened, or 0 if it is closed. Accessed atomically.
+	pushFailures    int32
+	breakerOpenedAt int64
+
+	// breakerSkipped merges the pushes skipped while the push circuit breaker is open. It is enqueued once
+	// the cooldown has passed, so the proxy catches up. Protected by breakerMutex.
+	breakerSkipped *model.PushRequest
+	breakerMutex   sync.Mutex
+
+	// firstResponseSent is set once the first response is sent on the connection. Accessed atomically.
+	firstResponseSent int32
+
+	// edsRemovals is the number of clusters sent with an empty assignment in the last EDS push.
+	// Accessed atomically.
+	edsRemovals int32
+
+	// resourceChurn counts the requests changing the resource names of a type, after the initial one.
+	// Accessed atomically.
+	resourceChurn int64
+
+	// ackHistory retains the most recent ACK and NACK events, or is nil if disabled.
+	ackHistory *ackHistory
+
+	// inflightPushes counts the pushes currently being generated or sent on this connection.
+	// Accessed atomically.
+	inflightPushes int32
+
+	// lastFullPush records the push that produced the config the proxy is currently running.
+	// Protected by the proxy lock.
+	lastFullPush *PushProvenance
+
+	// lastEdsTrigger records the services that triggered the last incremental EDS push.
+	// Protected by the proxy lock.
+	lastEdsTrigger *EdsTrigger
+
+	// sendTimeout is the minimum time to wait for a send to complete, and sendMinBytesPerSecond the
+	// slowest expected send rate, used to extend the timeout for large responses. See sendDeadline.
+	sendTimeout           time.Duration
+	sendMinBytesPerSecond int
+
+	// responded is the last nonce the proxy responded to for each type, and respondedCh is closed when
+	// it changes, to wake up pushes waiting for the response. Protected by respondedMutex.
+	respondedMutex sync.Mutex
+	responded      map[string]string
+	respondedCh    chan struct{}
+
+	// loadStats is the load last reported by the proxy over LRS. Protected by the proxy lock.
+	loadStats []ClusterLoad
+
+	// pushes counts the pushes that sent at least one response on this connection. Accessed atomically.
+	pushes int64
+
+	// capabilities is the set of type URLs implemented by the client, from the node metadata, or nil if all
+	// types are supported. Set when the connection is initialized, and not modified afterwards.
+	capabilities map[string]struct{}
+
+	// interceptor is the ResponseInterceptor of the server, or nil.
+	interceptor ResponseInterceptor
+
+	// log logs messages tagged with the fields of the connection. Set when the connection is created,
+	// and again when it is initialized.
+	log *connectionLog
+
+	// requestSeq is the sequence number of the last request received on the connection, starting at 1.
+	// Accessed atomically.
+	requestSeq int64
+
+	// stopStatus is the status the stream is closed with once stop is closed. Set before closing stop.
+	stopStatus *status.Status
+
+	// pendingPushes counts the pushes enqueued for this connection that did not complete yet. Several
+	// enqueued pushes may be merged into a single push. Accessed atomically.
+	pendingPushes int32
+
+	// dequeuedPushes is the number of pending pushes covered by the push being processed, removed from
+	// pendingPushes once it is done. Protected by the push queue lock.
+	dequeuedPushes int32
+
+	// convergedVersion is the push version the proxy was last reported converged at. Only accessed when
+	// processing requests.
+	convergedVersion string
+
+	// tenant identifies the tenant of the proxy, from the node labels in PILOT_XDS_TENANT_LABELS. Empty if
+	// the load is not attributed to tenants.
+	tenant string
+
+	// tenantUsage, if set, accumulates the responses sent to the tenant. Set once the connection is added.
+	tenantUsage *tenantUsage
+
+	// firstPush is the time from connect to the first response of each type sent on the connection, by
+	// type URL. Protected by the proxy lock.
+	firstPush map[string]time.Duration
+
+	// heartbeats tracks the resources sent with a TTL, refreshed until they are pushed again.
+	heartbeats ttlHeartbeats
+}
+
+// ResponseInterceptor inspects, and possibly modifies, the responses sent to the proxies. It can be used to
+// redact or tag resources, or to enforce limits, without changing each generator.
+type ResponseInterceptor interface {
+	// Intercept returns the response to send on the connection in place of res, or an error to abort the
+	// send. It is called before the response is recorded as sent, so the returned response is the one
+	// tracked in the WatchedResource. The resources of CDS and LDS responses may be shared with other
+	// connections, and must be copied before they are modified.
+	Intercept(con *Connection, res *discovery.DiscoveryResponse) (*discovery.DiscoveryResponse, error)
+}
+
+// PushProvenance identifies a full push sent to a connection.
+type PushProvenance struct {
+	// PushVersion is the version of the push context the config was generated from.
+	PushVersion string `json:"pushVersion"`
+	// ConfigVersion is the version of the config store the push context was built from.
+	ConfigVersion string `json:"configVersion,omitempty"`
+	// Reasons are the triggers of the push.
+	Reasons []model.TriggerReason `json:"reasons,omitempty"`
+	// Time is when the push completed.
+	Time time.Time `json:"time"`
+}
+
+// EdsTrigger identifies the services that triggered an incremental EDS push to a connection.
+type EdsTrigger struct {
+	// Services are the hostnames of the updated services, bounded by PILOT_EDS_TRIGGER_SERVICES_LIMIT.
+	Services []string `json:"services"`
+	// Truncated is true if more services than the limit triggered the push.
+	Truncated bool `json:"truncated,omitempty"`
+	// Time is when the push was sent.
+	Time time.Time `json:"time"`
 }
 
 // Event represents a config or registry event that results in a push.
@@ -96,12 +265,18 @@ type Event struct {
 }
 
 func newConnection(peerAddr string, stream DiscoveryStream) *Connection {
-	return &Connection{
+	con := &Connection{
 		pushChannel: make(chan *Event),
+		stop:        make(chan struct{}),
 		PeerAddr:    peerAddr,
 		Connect:     time.Now(),
 		stream:      stream,
 	}
+	if features.XDSAckHistorySize > 0 {
+		con.ackHistory = newAckHistory(features.XDSAckHistorySize)
+	}
+	con.log = newConnectionLog(con)
+	return con
 }
 
 // isExpectedGRPCError checks a gRPC error code and determines whether it is an expected error when
@@ -121,9 +296,94 @@ func isExpectedGRPCError(err error) bool {
 	return false
 }
 
+const (
+	initContextStoreUnavailable = "store_unavailable"
+	initContextTimeout          = "timeout"
+	initContextParseError       = "parse_error"
+)
+
+// classifyInitContextError returns the reason an InitContext call failed, and the gRPC code to return to
+// the client. Timeouts and an unavailable store are transient and may be retried, possibly on another
+// replica, while parse errors indicate a persistent config problem.
+func classifyInitContextError(err error) (string, codes.Code) {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), status.Code(err) == codes.DeadlineExceeded:
+		return initContextTimeout, codes.DeadlineExceeded
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return initContextTimeout, codes.DeadlineExceeded
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return initContextParseError, codes.FailedPrecondition
+	default:
+		return initContextStoreUnavailable, codes.Unavailable
+	}
+}
+
+// Reasons a node is rejected as malformed.
+const (
+	malformedNodeMetadata     = "metadata"
+	malformedNodeMissingParts = "missing_parts"
+	malformedNodeInvalidType  = "invalid_type"
+	malformedNodeNoIPAddress  = "no_ip_address"
+	malformedNodeInvalid      = "invalid"
+)
+
+// maxMalformedNodeIDLength is the length node IDs are truncated to in malformed node errors.
+const maxMalformedNodeIDLength = 256
+
+// malformedNodeLogLimiter limits the rate of malformed node logs, since a misconfigured deployment or a
+// malicious client may connect repeatedly.
+var malformedNodeLogLimiter = rate.NewLimiter(rate.Every(time.Second), 10)
+
+// malformedNodeError is returned when the node of a connection can't be parsed.
+type malformedNodeError struct {
+	// id is the node ID, truncated to maxMalformedNodeIDLength.
+	id string
+	// reason is the category of the failure, one of the malformedNode constants.
+	reason string
+	err    error
+}
+
+func newMalformedNodeError(id string, err error) *malformedNodeError {
+	if len(id) > maxMalformedNodeIDLength {
+		id = id[:maxMalformedNodeIDLength] + "..."
+	}
+	reason := malformedNodeInvalid
+	switch {
+	case errors.Is(err, model.ErrServiceNodeMissingParts):
+		reason = malformedNodeMissingParts
+	case errors.Is(err, model.ErrServiceNodeInvalidType):
+		reason = malformedNodeInvalidType
+	case errors.Is(err, model.ErrServiceNodeNoIPAddress):
+		reason = malformedNodeNoIPAddress
+	}
+	return &malformedNodeError{id: id, reason: reason, err: err}
+}
+
+func (e *malformedNodeError) Error() string {
+	return fmt.Sprintf("malformed node %q (%s): %v", e.id, e.reason, e.err)
+}
+
+func (e *malformedNodeError) Unwrap() error {
+	return e.err
+}
+
+// rejectMalformedNode records the rejection of a connection with a malformed node, and returns the status
+// to close the stream with.
+func rejectMalformedNode(peerAddr string, e *malformedNodeError) error {
+	xdsMalformedNodes.With(reasonTag.Value(e.reason)).Increment()
+	if malformedNodeLogLimiter.Allow() {
+		adsLog.Warnf("ADS: %q rejected: %v", peerAddr, e)
+	}
+	return status.Error(codes.InvalidArgument, e.Error())
+}
+
 func (s *DiscoveryServer) receive(con *Connection, reqChannel chan *discovery.DiscoveryRequest, errP *error) {
 	defer close(reqChannel) // indicates close of the remote side.
 	firstReq := true
+	limiter := newRequestLimiter(features.XDSRequestQPS, features.XDSRequestBurst)
 	for {
 		req, err := con.stream.Recv()
 		if err != nil {
@@ -144,16 +404,36 @@ func (s *DiscoveryServer) receive(con *Connection, reqChannel chan *discovery.Di
 				return
 			}
 			// TODO: We should validate that the namespace in the cert matches the claimed namespace in metadata.
-			if err := s.initConnection(req.Node, con); err != nil {
+			initStart := time.Now()
+			err := s.initConnection(req.Node, con)
+			initProxySetupTime.Record(time.Since(initStart).Seconds())
+			if err != nil {
 				*errP = err
 				return
 			}
 			defer func() {
-				s.removeCon(con.ConID)
+				s.removeCon(con)
 				if s.InternalGen != nil {
 					s.InternalGen.OnDisconnect(con)
 				}
 			}()
+			// A proxy reconnecting with state from a previous connection triggers a full generation. It waits
+			// for its turn once, for the whole connection, before its first request is processed.
+			if (req.ResponseNonce != "" || req.VersionInfo != "") && !s.throttleReconnect(con) {
+				return
+			}
+		}
+
+		if limiter != nil && !limiter.Allow() {
+			adsLog.Warnf("ADS: %q %s exceeded %v requests per second, closing the connection",
+				con.PeerAddr, con.ConID, features.XDSRequestQPS)
+			xdsRateLimitedConnections.Increment()
+			*errP = status.Errorf(codes.ResourceExhausted, "too many requests, limit is %v per second", features.XDSRequestQPS)
+			return
+		}
+
+		if req.ResponseNonce != "" {
+			con.recordResponse(req.TypeUrl, req.ResponseNonce)
 		}
 
 		select {
@@ -165,12 +445,27 @@ func (s *DiscoveryServer) receive(con *Connection, reqChannel chan *discovery.Di
 	}
 }
 
+// newRequestLimiter returns the limiter of the requests received on a connection, or nil if qps is not
+// greater than 0.
+func newRequestLimiter(qps float64, burst int) *rate.Limiter {
+	if qps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(qps), burst)
+}
+
 // processRequest is handling one request. This is currently called from the 'main' thread, which also
 // handles 'push' requests and close - the code will eventually call the 'push' code, and it needs more mutex
 // protection. Original code avoided the mutexes by doing both 'push' and 'process requests' in same thread.
 func (s *DiscoveryServer) processRequest(discReq *discovery.DiscoveryRequest, con *Connection) error {
+	atomic.AddInt64(&con.requestSeq, 1)
 	if s.StatusReporter != nil {
-		s.StatusReporter.RegisterEvent(con.ConID, discReq.TypeUrl, discReq.ResponseNonce)
+		s.StatusReporter.RegisterEvent(con.ConID, discReq.TypeUrl, discReq.ResponseNonce, con.initialSync(discReq.TypeUrl))
+	}
+	discReq.ResourceNames = sanitizeResourceNames(con, discReq.TypeUrl, discReq.ResourceNames)
+
+	if features.EnableFastInitialLds && discReq.TypeUrl == v3.ListenerType && con.firstLdsRequest(discReq) {
+		return s.pushInitialLds(con, discReq)
 	}
 
 	switch discReq.TypeUrl {
@@ -191,9 +486,20 @@ func (s *DiscoveryServer) processRequest(discReq *discovery.DiscoveryRequest, co
 			return err
 		}
 	default:
+		if con.Untrusted {
+			con.log.Warnf("untrusted connection requested %s", discReq.TypeUrl)
+			return status.Errorf(codes.PermissionDenied, "type %s is not allowed for unauthenticated connections", discReq.TypeUrl)
+		}
 		// Allow custom generators to work without 'generator' metadata.
 		// It would be an error/warn for normal XDS - so nothing to lose.
 		err := s.handleCustomGenerator(con, discReq)
+		if errors.Is(err, errUnsupportedType) {
+			xdsUnsupportedTypeRequests.Increment()
+			if features.IgnoreUnsupportedXdsTypes {
+				adsLog.Warnf("ADS: %s ignoring request: %v", con.ConID, err)
+				return nil
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -212,35 +518,72 @@ func (s *DiscoveryServer) StreamAggregatedResources(stream discovery.AggregatedD
 	// ip tables update latencies.
 	// See https://github.com/istio/istio/issues/25495.
 	if !s.IsServerReady() {
-		return errors.New("server is not ready to serve discovery information")
+		xdsNotReadyRejections.Increment()
+		return notReadyError(notReadyBackoff(time.Since(s.notReadySince)))
+	}
+	if s.draining.Load() {
+		return status.Error(codes.Unavailable, "server is draining")
 	}
+	if !s.acquireStream(features.MaxXDSConnections) {
+		adsLog.Warnf("ADS: rejecting connection, %d connections open", features.MaxXDSConnections)
+		xdsRejectedConnections.Increment()
+		return status.Errorf(codes.ResourceExhausted, "too many connections, limit is %d", features.MaxXDSConnections)
+	}
+	defer s.streams.Dec()
 
 	ctx := stream.Context()
+	if s.warmup != nil {
+		if err := s.warmup.Wait(ctx); err != nil {
+			return status.Errorf(codes.Unavailable, "server is warming up: %v", err)
+		}
+	}
 	peerAddr := "0.0.0.0"
 	if peerInfo, ok := peer.FromContext(ctx); ok {
 		peerAddr = peerInfo.Addr.String()
 	}
 
+	authnStart := time.Now()
 	ids, err := s.authenticate(ctx)
+	authenticateSetupTime.Record(time.Since(authnStart).Seconds())
 	if err != nil {
 		return err
 	}
+	untrusted := false
 	if ids != nil {
 		adsLog.Debugf("Authenticated XDS: %v with identity %v", peerAddr, ids)
 	} else {
 		adsLog.Debuga("Unauthenticated XDS: ", peerAddr)
+		xdsUnauthenticatedConnections.With(policyTag.Value(features.UnauthenticatedXDSPolicy)).Increment()
+		switch features.UnauthenticatedXDSPolicy {
+		case unauthenticatedAllow:
+		case unauthenticatedDeny:
+			adsLog.Warnf("Unauthenticated XDS: %v rejected, unauthenticated connections are not allowed", peerAddr)
+			xdsUnauthenticatedRejections.Increment()
+			return status.Error(codes.Unauthenticated, "unauthenticated XDS connections are not allowed")
+		case unauthenticatedUntrusted:
+			untrusted = true
+		}
 	}
 
 	// InitContext returns immediately if the context was already initialized.
-	if err = s.globalPushContext().InitContext(s.Env, nil, nil); err != nil {
+	initContextStart := time.Now()
+	err = s.globalPushContext().InitContext(s.Env, nil, nil)
+	initContextSetupTime.Record(time.Since(initContextStart).Seconds())
+	if err != nil {
 		// Error accessing the data - log and close, maybe a different pilot replica
 		// has more luck
-		adsLog.Warnf("Error reading config %v", err)
-		return err
+		reason, code := classifyInitContextError(err)
+		adsLog.Warnf("Error reading config (%s) %v", reason, err)
+		initContextErrors.With(reasonTag.Value(reason)).Increment()
+		return status.Errorf(code, "error reading config (%s): %v", reason, err)
 	}
 
 	con := newConnection(peerAddr, stream)
 	con.Identities = ids
+	con.Untrusted = untrusted
+	con.sendTimeout = s.sendTimeout
+	con.sendMinBytesPerSecond = s.sendMinBytesPerSecond
+	con.interceptor = s.ResponseInterceptor
 
 	// Do not call: defer close(con.pushChannel). The push channel will be garbage collected
 	// when the connection is no longer used. Closing the channel can cause subtle race conditions
@@ -255,6 +598,16 @@ func (s *DiscoveryServer) StreamAggregatedResources(stream discovery.AggregatedD
 	reqChannel := make(chan *discovery.DiscoveryRequest, 1)
 	go s.receive(con, reqChannel, &receiveError)
 
+	var lifetimeExpired <-chan time.Time
+	if features.MaxConnectionLifetime > 0 {
+		t := time.NewTimer(connectionLifetime(features.MaxConnectionLifetime))
+		defer t.Stop()
+		lifetimeExpired = t.C
+	}
+	defer con.heartbeats.stop()
+	// initialized is set once the first request was received, and the connection initialized.
+	initialized := false
+
 	for {
 		// Block until either a request is received or a push is triggered.
 		// We need 2 go routines because 'read' blocks in Recv().
@@ -269,6 +622,7 @@ func (s *DiscoveryServer) StreamAggregatedResources(stream discovery.AggregatedD
 				// Remote side closed connection or error processing the request.
 				return receiveError
 			}
+			initialized = true
 			// processRequest is calling pushXXX, accessing common structs with pushConnection.
 			// Adding sync is the second issue to be resolved if we want to save 1/2 of the threads.
 			err := s.processRequest(req, con)
@@ -280,12 +634,194 @@ func (s *DiscoveryServer) StreamAggregatedResources(stream discovery.AggregatedD
 			// TODO: possible race condition: if a config change happens while the envoy
 			// was getting the initial config, between LDS and RDS, the push will miss the
 			// monitored 'routes'. Same for CDS/EDS interval. It is very tricky to handle
-			// due to the protocol - but the periodic push recovers from it.
+			// due to the protocol - but the periodic push recovers from it. PILOT_XDS_WAIT_FOR_ACK
+			// reduces it, by waiting for the previous response of each type to be ACKed.
 			err := s.pushConnection(con, pushEv)
 			pushEv.done()
 			if err != nil {
-				return nil
+				if closeStream, st := s.handlePushFailure(con, err); closeStream {
+					return st
+				}
+			}
+
+		case <-con.heartbeats.C():
+			if err := s.sendHeartbeats(con); err != nil {
+				if closeStream, st := s.handlePushFailure(con, err); closeStream {
+					return st
+				}
+			}
+
+		case <-con.stop:
+			adsLog.Infof("ADS: %q %s disconnected by server", con.PeerAddr, con.ConID)
+			return con.stopStatus.Err()
+
+		case <-lifetimeExpired:
+			if !initialized || !con.InitialSyncComplete() {
+				// Do not disconnect a proxy that is still syncing, it would have to start over.
+				lifetimeExpired = time.After(lifetimeRetryInterval)
+				continue
+			}
+			adsLog.Infof("ADS: %q %s reached its maximum lifetime, disconnecting", con.PeerAddr, con.ConID)
+			return status.Error(codes.Unavailable, "maximum connection lifetime reached")
+		}
+	}
+}
+
+// lifetimeRetryInterval is how long to wait before closing a connection that reached its maximum
+// lifetime while it was still syncing.
+const lifetimeRetryInterval = 10 * time.Second
+
+// connectionLifetime returns the lifetime of a new connection: the maximum, plus up to 10% jitter so
+// connections established at the same time, for example after a restart, are not all closed at once.
+func connectionLifetime(max time.Duration) time.Duration {
+	return max + time.Duration(rand.Int63n(int64(max)/10+1))
+}
+
+const (
+	// notReadyInitialBackoff is the retry delay suggested to proxies rejected as soon as the server starts.
+	notReadyInitialBackoff = time.Second
+	// notReadyBackoffStep is how long the server must stay not ready for the suggested delay to double.
+	notReadyBackoffStep = 10 * time.Second
+	// notReadyMaxBackoff caps the suggested delay, so proxies still connect soon after the server is ready.
+	notReadyMaxBackoff = 30 * time.Second
+)
+
+// notReadyBackoff returns the retry delay suggested to proxies rejected because the server has been not ready
+// for the given duration. The longer the server stays not ready, the more the reconnects are spread out.
+func notReadyBackoff(unready time.Duration) time.Duration {
+	backoff := notReadyInitialBackoff
+	for i := unready / notReadyBackoffStep; i > 0 && backoff < notReadyMaxBackoff; i-- {
+		backoff *= 2
+	}
+	if backoff > notReadyMaxBackoff {
+		backoff = notReadyMaxBackoff
+	}
+	return backoff
+}
+
+// notReadyError returns the error rejecting a connection while the server is not ready, with a RetryInfo
+// detail suggesting the backoff before reconnecting.
+func notReadyError(backoff time.Duration) error {
+	st := status.New(codes.Unavailable, "server is not ready to serve discovery information")
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(backoff)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// Stop disconnects the client. The client is expected to reconnect, possibly to another Istiod
+// replica. Calling Stop more than once has no effect.
+func (conn *Connection) Stop() {
+	conn.stopWithStatus(status.New(codes.Unavailable, "server requested disconnect"))
+}
+
+// stopWithStatus disconnects the client, closing the stream with the given status. Only the first call
+// has an effect, including calls to Stop.
+func (conn *Connection) stopWithStatus(st *status.Status) {
+	conn.stopOnce.Do(func() {
+		conn.stopStatus = st
+		close(conn.stop)
+	})
+}
+
+// Disconnect closes the stream of the connection with the given ID with an Aborted status, so the proxy
+// reconnects and syncs again, possibly to another Istiod replica. The connection is cleaned up when its
+// stream returns, like any other disconnect. An error is returned if the connection is already gone.
+func (s *DiscoveryServer) Disconnect(conID string) error {
+	s.adsClientsMutex.RLock()
+	con, f := s.adsClients[conID]
+	s.adsClientsMutex.RUnlock()
+	if !f {
+		return fmt.Errorf("connection %s not found", conID)
+	}
+	adsLog.Infof("ADS: disconnecting %s on request", conID)
+	con.stopWithStatus(status.New(codes.Aborted, "disconnected by the server operator"))
+	return nil
+}
+
+// DrainCohort disconnects all connections whose proxy matches the predicate, so they reconnect and
+// pick up changes, for example during a canary rollout of Istiod. The disconnects are spread evenly
+// over the window, to avoid all matching proxies reconnecting at once. It returns the IDs of the
+// connections that will be disconnected.
+func (s *DiscoveryServer) DrainCohort(predicate func(*model.Proxy) bool, window time.Duration) []string {
+	var cohort []*Connection
+	s.adsClientsMutex.RLock()
+	for _, con := range s.adsClients {
+		if con.proxy != nil && predicate(con.proxy) {
+			cohort = append(cohort, con)
+		}
+	}
+	s.adsClientsMutex.RUnlock()
+	ids := make([]string, 0, len(cohort))
+	if len(cohort) == 0 {
+		return ids
+	}
+	interval := window / time.Duration(len(cohort))
+	for i, con := range cohort {
+		ids = append(ids, con.ConID)
+		if delay := interval * time.Duration(i); delay > 0 {
+			time.AfterFunc(delay, con.Stop)
+		} else {
+			con.Stop()
+		}
+	}
+	adsLog.Infof("ADS: draining %d connections over %v", len(cohort), window)
+	return ids
+}
+
+// acquireStream reserves a slot for a new stream, and returns false if the max number of streams are
+// already open. The slot is reserved atomically, and before the connection is initialized, so concurrent
+// connects cannot go past the limit. The caller must release the slot when the stream closes.
+func (s *DiscoveryServer) acquireStream(max int) bool {
+	if n := s.streams.Inc(); max > 0 && n > int64(max) {
+		s.streams.Dec()
+		return false
+	}
+	return true
+}
+
+// drainPollInterval is how often Drain checks whether the connections closed.
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain stops accepting new connections, and disconnects all the current ones with an Unavailable
+// status, so proxies promptly reconnect to another replica instead of waiting for the connection to
+// reset. A push in progress on a connection completes before it is closed. Drain waits until the
+// connections are closed or the context is done, and returns the number of connections that closed,
+// and the IDs of the ones that did not close in time.
+func (s *DiscoveryServer) Drain(ctx context.Context) (int, []string) {
+	s.draining.Store(true)
+	s.adsClientsMutex.RLock()
+	cons := make([]*Connection, 0, len(s.adsClients))
+	for _, con := range s.adsClients {
+		cons = append(cons, con)
+	}
+	s.adsClientsMutex.RUnlock()
+	for _, con := range cons {
+		con.Stop()
+	}
+
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for {
+		var remaining []string
+		for _, con := range cons {
+			if !s.isRemoved(con) {
+				remaining = append(remaining, con.ConID)
+			}
+		}
+		if len(remaining) == 0 || ctx.Err() != nil {
+			drained := len(cons) - len(remaining)
+			if len(remaining) > 0 {
+				sort.Strings(remaining)
+				adsLog.Warnf("ADS: drained %d connections, %d did not close in time: %v", drained, len(remaining), remaining)
+			} else {
+				adsLog.Infof("ADS: drained %d connections", drained)
 			}
+			return drained, remaining
+		}
+		select {
+		case <-ctx.Done():
+		case <-t.C:
 		}
 	}
 }
@@ -296,22 +832,70 @@ func (s *DiscoveryServer) handleLds(con *Connection, discReq *discovery.Discover
 			return nil
 		}
 	}
-	adsLog.Debugf("ADS:LDS: REQ %s", con.ConID)
-	err := s.pushLds(con, s.globalPushContext(), versionInfo())
+	con.log.Debugf("LDS: REQ")
+	push := s.globalPushContext()
+	err := s.pushLds(con, push, pushVersion(push))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// firstLdsRequest returns true if the request is the first LDS request of a proxy that has no config yet.
+// A proxy reconnecting, possibly from another replica, reports the version it last received, or reconnects
+// with the nonces of other types, and already has listeners; an empty placeholder would remove all of them.
+// Delta clients are never sent the placeholder, for the same reason.
+func (conn *Connection) firstLdsRequest(req *discovery.DiscoveryRequest) bool {
+	if req.ResponseNonce != "" || req.VersionInfo != "" || conn.Delta() || atomic.LoadInt32(&conn.reconnected) != 0 {
+		return false
+	}
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	if conn.proxy.WatchedResources[v3.ListenerType] != nil {
+		return false
+	}
+	for _, w := range conn.proxy.WatchedResources {
+		if w.LastRequest != nil && w.LastRequest.VersionInfo != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// pushInitialLds responds to the first LDS request of a connection with an empty set of listeners,
+// and enqueues a full push to follow. This gives new proxies a response without waiting for the full
+// config generation. The placeholder is sent with its own nonce and version, so the ACK for it is
+// handled like any other and does not interfere with the full push.
+func (s *DiscoveryServer) pushInitialLds(con *Connection, discReq *discovery.DiscoveryRequest) error {
+	if !s.shouldRespond(con, ldsReject, discReq) {
+		return nil
+	}
+	push := s.globalPushContext()
+	response := ldsDiscoveryResponse(nil, con.nextVersion(v3.ListenerType, pushVersion(push)), push.Version)
+	if err := con.send(response); err != nil {
+		recordSendError("LDS", con.ConID, ldsSendErrPushes, err)
+		return err
+	}
+	con.log.Debugf("LDS: INITIAL PUSH")
+
+	s.pushQueue.Enqueue(con, &model.PushRequest{
+		Full:   true,
+		Push:   push,
+		Start:  time.Now(),
+		Reason: []model.TriggerReason{model.ProxyUpdate},
+	})
+	return nil
+}
+
 func (s *DiscoveryServer) handleCds(con *Connection, discReq *discovery.DiscoveryRequest) error {
 	if con.Watching(v3.ClusterType) {
 		if !s.shouldRespond(con, cdsReject, discReq) {
 			return nil
 		}
 	}
-	adsLog.Infof("ADS:CDS: REQ %v version:%s", con.ConID, discReq.VersionInfo)
-	err := s.pushCds(con, s.globalPushContext(), versionInfo())
+	con.log.Infof("CDS: REQ version:%s", discReq.VersionInfo)
+	push := s.globalPushContext()
+	err := s.pushCds(con, push, pushVersion(push))
 	if err != nil {
 		return err
 	}
@@ -319,25 +903,68 @@ func (s *DiscoveryServer) handleCds(con *Connection, discReq *discovery.Discover
 }
 
 func (s *DiscoveryServer) handleEds(con *Connection, discReq *discovery.DiscoveryRequest) error {
+	// shouldRespond records the new resource names, the previous ones are needed to find the added clusters.
+	previous := con.Clusters()
 	if !s.shouldRespond(con, edsReject, discReq) {
 		return nil
 	}
-	con.proxy.WatchedResources[v3.EndpointType].ResourceNames = discReq.ResourceNames
-	adsLog.Debugf("ADS:EDS: REQ %s clusters:%d", con.ConID, len(con.Clusters()))
-	err := s.pushEds(s.globalPushContext(), con, versionInfo(), nil)
+	resourceNames := discReq.ResourceNames
+	if len(resourceNames) == 0 && features.PreserveEdsSubscriptionOnReconnect {
+		// The proxy may have reconnected and requested EDS before CDS is re-established. Serve the
+		// clusters it was watching before, rather than nothing, to avoid blackholing traffic.
+		if clusters := s.restoreEdsSubscription(con.proxy.ID); len(clusters) > 0 {
+			con.log.Debugf("EDS: restored %d clusters", len(clusters))
+			resourceNames = clusters
+		}
+	}
+	con.proxy.Lock()
+	w := con.proxy.WatchedResources[v3.EndpointType]
+	w.ResourceNames = resourceNames
+	// The watched state is reset on the first request, on reconnect, and on nonce resync. Otherwise, this
+	// is a change of the resource names, after the proxy got the endpoints of the previous ones.
+	changed := w.NonceSent != "" && len(previous) > 0
+	con.proxy.Unlock()
+	push := s.globalPushContext()
+	if changed {
+		// Only the added clusters need their endpoints. The removed ones are no longer in the watched set.
+		added := addedResourceNames(previous, resourceNames)
+		con.log.Debugf("EDS: REQ clusters:%d added:%d", len(resourceNames), len(added))
+		if len(added) == 0 {
+			return nil
+		}
+		return s.pushEdsClusters(push, con, pushVersion(push), added, nil)
+	}
+	con.log.Debugf("EDS: REQ clusters:%d", len(con.Clusters()))
+	err := s.pushEds(push, con, pushVersion(push), nil)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// addedResourceNames returns the names in current that are not in previous.
+func addedResourceNames(previous, current []string) []string {
+	known := make(map[string]struct{}, len(previous))
+	for _, name := range previous {
+		known[name] = struct{}{}
+	}
+	var added []string
+	for _, name := range current {
+		if _, f := known[name]; !f {
+			added = append(added, name)
+		}
+	}
+	return added
+}
+
 func (s *DiscoveryServer) handleRds(con *Connection, discReq *discovery.DiscoveryRequest) error {
 	if !s.shouldRespond(con, rdsReject, discReq) {
 		return nil
 	}
 
-	adsLog.Debugf("ADS:RDS: REQ %s routes:%d", con.ConID, len(con.Routes()))
-	err := s.pushRoute(con, s.globalPushContext(), versionInfo())
+	con.log.Debugf("RDS: REQ routes:%d", len(con.Routes()))
+	push := s.globalPushContext()
+	err := s.pushRoute(con, push, pushVersion(push))
 	if err != nil {
 		return err
 	}
@@ -354,8 +981,23 @@ func (s *DiscoveryServer) shouldRespond(con *Connection, rejectMetric monitoring
 	// will be different from the version sent. But it is fragile to rely on that.
 	if request.ErrorDetail != nil {
 		errCode := codes.Code(request.ErrorDetail.Code)
-		adsLog.Warnf("ADS:%s: ACK ERROR %s %s:%s", stype, con.ConID, errCode.String(), request.ErrorDetail.GetMessage())
+		// Versions are per type, so the rejected and active versions identify the changes to this type.
+		rejected := con.respondedVersion(request.TypeUrl, request.ResponseNonce)
+		con.log.Warnf("%s: ACK ERROR %s:%s rejected version:%s active version:%s", stype, errCode.String(),
+			request.ErrorDetail.GetMessage(), rejected, request.VersionInfo)
 		incrementXDSRejects(rejectMetric, con.proxy.ID, errCode.String())
+		atomic.AddInt32(&con.nacks, 1)
+		con.proxy.Lock()
+		if w := con.proxy.WatchedResources[request.TypeUrl]; w != nil {
+			w.LastNack = &model.NackDetail{Code: request.ErrorDetail.Code, Message: request.ErrorDetail.GetMessage(),
+				Version: rejected, Time: time.Now()}
+		}
+		con.proxy.Unlock()
+		if con.proxy.Metadata != nil {
+			s.nackRates.Record(request.TypeUrl, con.proxy.Metadata.IstioVersion, time.Now())
+		}
+		logXdsAccess(con, request.TypeUrl, request.VersionInfo, request.ResponseNonce, 0, accessLogNack, nil)
+		con.recordAckEvent(request, accessLogNack)
 		if s.InternalGen != nil {
 			s.InternalGen.OnNack(con.proxy, request)
 		}
@@ -364,6 +1006,7 @@ func (s *DiscoveryServer) shouldRespond(con *Connection, rejectMetric monitoring
 
 	// This is first request - initialize typeUrl watches.
 	if request.ResponseNonce == "" {
+		logXdsAccess(con, request.TypeUrl, request.VersionInfo, request.ResponseNonce, 0, accessLogRequest, nil)
 		con.proxy.Lock()
 		con.proxy.WatchedResources[request.TypeUrl] = &model.WatchedResource{TypeUrl: request.TypeUrl, ResourceNames: request.ResourceNames, LastRequest: request}
 		con.proxy.Unlock()
@@ -379,7 +1022,9 @@ func (s *DiscoveryServer) shouldRespond(con *Connection, rejectMetric monitoring
 	// because Istiod is restarted or Envoy disconnects and reconnects.
 	// We should always respond with the current resource names.
 	if previousInfo == nil {
-		adsLog.Debugf("ADS:%s: RECONNECT %s %s %s", stype, con.ConID, request.VersionInfo, request.ResponseNonce)
+		con.log.Debugf("%s: RECONNECT %s %s", stype, request.VersionInfo, request.ResponseNonce)
+		logXdsAccess(con, request.TypeUrl, request.VersionInfo, request.ResponseNonce, 0, accessLogReconnect, nil)
+		atomic.StoreInt32(&con.reconnected, 1)
 		con.proxy.Lock()
 		con.proxy.WatchedResources[request.TypeUrl] = &model.WatchedResource{TypeUrl: request.TypeUrl, ResourceNames: request.ResourceNames, LastRequest: request}
 		con.proxy.Unlock()
@@ -389,34 +1034,154 @@ func (s *DiscoveryServer) shouldRespond(con *Connection, rejectMetric monitoring
 	// If there is mismatch in the nonce, that is a case of expired/stale nonce.
 	// A nonce becomes stale following a newer nonce being sent to Envoy.
 	if request.ResponseNonce != previousInfo.NonceSent {
-		adsLog.Debugf("ADS:%s: REQ %s Expired nonce received %s, sent %s", stype,
-			con.ConID, request.ResponseNonce, previousInfo.NonceSent)
+		con.log.Debugf("%s: REQ Expired nonce received %s, sent %s", stype, request.ResponseNonce, previousInfo.NonceSent)
 		xdsExpiredNonce.Increment()
+		con.respondedVersion(request.TypeUrl, request.ResponseNonce)
+		logXdsAccess(con, request.TypeUrl, request.VersionInfo, request.ResponseNonce, 0, accessLogExpiredNonce, nil)
+		con.recordAckEvent(request, accessLogExpiredNonce)
+		con.proxy.Lock()
+		previousInfo.ExpiredNonces++
+		expired := previousInfo.ExpiredNonces
+		con.proxy.Unlock()
+		// A proxy that never sends the last nonce would never get a response again. Past the threshold,
+		// the nonce is assumed to be out of sync, and the type is reset as if the proxy had reconnected.
+		if threshold := features.ExpiredNonceResyncThreshold; threshold > 0 && expired >= threshold {
+			con.log.Warnf("%s: %d consecutive expired nonces, last received %s, sent %s, resetting the watched state",
+				stype, expired, request.ResponseNonce, previousInfo.NonceSent)
+			xdsNonceResyncs.With(typeTag.Value(v3.GetMetricType(request.TypeUrl))).Increment()
+			con.proxy.Lock()
+			con.proxy.WatchedResources[request.TypeUrl] = &model.WatchedResource{TypeUrl: request.TypeUrl, ResourceNames: request.ResourceNames, LastRequest: request}
+			con.proxy.Unlock()
+			return true
+		}
 		return false
 	}
 
 	// If it comes here, that means nonce match. This an ACK. We should record
 	// the ack details and respond if there is a change in resource names.
+	decrementToZero(&con.nacks)
+	con.respondedVersion(request.TypeUrl, request.ResponseNonce)
+	resourceNames := request.ResourceNames
 	con.proxy.Lock()
 	previousResources := con.proxy.WatchedResources[request.TypeUrl].ResourceNames
+	emptied := len(resourceNames) == 0 && len(previousResources) > 0 && !isWildcardType(request.TypeUrl)
+	if emptied && features.EmptyResourceNames == emptyResourceNamesRetain {
+		resourceNames = previousResources
+	}
 	con.proxy.WatchedResources[request.TypeUrl].VersionAcked = request.VersionInfo
 	con.proxy.WatchedResources[request.TypeUrl].NonceAcked = request.ResponseNonce
-	con.proxy.WatchedResources[request.TypeUrl].ResourceNames = request.ResourceNames
+	con.proxy.WatchedResources[request.TypeUrl].ResourceNames = resourceNames
 	con.proxy.WatchedResources[request.TypeUrl].LastRequest = request
+	con.proxy.WatchedResources[request.TypeUrl].LastNack = nil
+	con.proxy.WatchedResources[request.TypeUrl].ExpiredNonces = 0
 	con.proxy.Unlock()
 
+	// An empty list for a type that does not support wildcard subscriptions unsubscribes from all
+	// resources, so there is nothing to respond with. Pushes skip the type while it is empty.
+	if emptied {
+		con.log.Debugf("%s: EMPTY RESOURCES (%s) previous resources: %v %s %s", stype, features.EmptyResourceNames,
+			previousResources, request.VersionInfo, request.ResponseNonce)
+		logXdsAccess(con, request.TypeUrl, request.VersionInfo, request.ResponseNonce, 0, accessLogResourceChange, nil)
+		con.recordAckEvent(request, accessLogResourceChange)
+		return false
+	}
+
 	// Envoy can send two DiscoveryRequests with same version and nonce
 	// when it detects a new resource. We should respond if they change.
 	if listEqualUnordered(previousResources, request.ResourceNames) {
-		adsLog.Debugf("ADS:%s: ACK %s %s %s", stype, con.ConID, request.VersionInfo, request.ResponseNonce)
+		con.log.Debugf("%s: ACK %s %s", stype, request.VersionInfo, request.ResponseNonce)
+		logXdsAccess(con, request.TypeUrl, request.VersionInfo, request.ResponseNonce, 0, accessLogAck, nil)
+		con.recordAckEvent(request, accessLogAck)
+		s.checkConverged(con, request.VersionInfo)
 		return false
 	}
-	adsLog.Debugf("ADS:%s: RESOURCE CHANGE previous resources: %v, new resources: %v %s %s %s", stype,
-		previousResources, request.ResourceNames, con.ConID, request.VersionInfo, request.ResponseNonce)
+	con.log.Debugf("%s: RESOURCE CHANGE previous resources: %v, new resources: %v %s %s", stype,
+		previousResources, request.ResourceNames, request.VersionInfo, request.ResponseNonce)
+	atomic.AddInt64(&con.resourceChurn, 1)
+	xdsResourceChurn.With(typeTag.Value(v3.GetMetricType(request.TypeUrl))).Increment()
+	logXdsAccess(con, request.TypeUrl, request.VersionInfo, request.ResponseNonce, 0, accessLogResourceChange, nil)
+	con.recordAckEvent(request, accessLogResourceChange)
 
 	return true
 }
 
+// Values of PILOT_UNAUTHENTICATED_XDS_POLICY.
+const (
+	unauthenticatedAllow     = "allow"
+	unauthenticatedUntrusted = "untrusted"
+	unauthenticatedDeny      = "deny"
+)
+
+// Values of PILOT_UNKNOWN_GENERATOR_POLICY.
+const (
+	unknownGeneratorFallback = "fallback"
+	unknownGeneratorReject   = "reject"
+)
+
+// setGenerator sets the generator requested by the proxy, if any. Untrusted connections can't select a
+// generator. A generator that is not registered is handled by PILOT_UNKNOWN_GENERATOR_POLICY: the
+// connection is either rejected, or served by the built-in handlers.
+func (s *DiscoveryServer) setGenerator(con *Connection, proxy *model.Proxy) error {
+	name := proxy.Metadata.Generator
+	if name == "" {
+		return nil
+	}
+	if con.Untrusted {
+		adsLog.Warnf("ADS: %s untrusted connection requested generator %q, using the built-in handlers", proxy.ID, name)
+		return nil
+	}
+	proxy.XdsResourceGenerator = s.generator(name)
+	if proxy.XdsResourceGenerator != nil {
+		return nil
+	}
+	xdsUnknownGenerators.Increment()
+	if features.UnknownGeneratorPolicy == unknownGeneratorReject {
+		adsLog.Warnf("ADS: %s requested unknown generator %q, rejecting the connection", proxy.ID, name)
+		return status.Errorf(codes.InvalidArgument, "unknown generator %q", name)
+	}
+	adsLog.Warnf("ADS: %s requested unknown generator %q, using the built-in handlers", proxy.ID, name)
+	return nil
+}
+
+// Values of PILOT_EMPTY_RESOURCE_NAMES.
+const (
+	emptyResourceNamesUnsubscribe = "unsubscribe"
+	emptyResourceNamesRetain      = "retain"
+)
+
+// isWildcardType returns true for the types where an empty list of resource names requests all resources.
+// For other types, an empty list means the proxy is not interested in any resource.
+func isWildcardType(typeURL string) bool {
+	return typeURL != v3.EndpointType && typeURL != v3.RouteType
+}
+
+// throttleReconnect blocks until a reconnecting proxy is allowed to trigger a full generation, so a mass
+// reconnect, for example after an Istiod restart, proceeds at a bounded rate instead of all at once. It is
+// called once per connection, when it is set up. It returns false if the stream was closed, or the
+// connection stopped, while waiting.
+func (s *DiscoveryServer) throttleReconnect(con *Connection) bool {
+	if s.reconnectLimiter == nil {
+		return true
+	}
+	r := s.reconnectLimiter.Reserve()
+	delay := r.Delay()
+	if delay == 0 {
+		return true
+	}
+	xdsThrottledReconnects.Increment()
+	adsLog.Debugf("ADS: throttling reconnect of %s for %v", con.ConID, delay)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-con.stream.Context().Done():
+	case <-con.stop:
+	}
+	r.Cancel()
+	return false
+}
+
 // listEqualUnordered checks that two lists contain all the same elements
 func listEqualUnordered(a []string, b []string) bool {
 	if len(a) != len(b) {
@@ -440,24 +1205,33 @@ func listEqualUnordered(a []string, b []string) bool {
 func (s *DiscoveryServer) initConnection(node *core.Node, con *Connection) error {
 	proxy, err := s.initProxy(node)
 	if err != nil {
+		var malformed *malformedNodeError
+		if errors.As(err, &malformed) {
+			return rejectMalformedNode(con.PeerAddr, malformed)
+		}
 		return err
 	}
 
 	// Based on node metadata and version, we can associate a different generator.
 	// TODO: use a map of generators, so it's easily customizable and to avoid deps
 	proxy.WatchedResources = map[string]*model.WatchedResource{}
-
-	if proxy.Metadata.Generator != "" {
-		proxy.XdsResourceGenerator = s.Generators[proxy.Metadata.Generator]
+	if err := s.setGenerator(con, proxy); err != nil {
+		return err
 	}
 
 	// First request so initialize connection id and start tracking it.
 	con.proxy = proxy
-	con.ConID = connectionID(node.Id)
+	con.ConID = connectionID(s.connectionIDPrefix(node, proxy))
 	con.node = node
+	con.capabilities = xdsCapabilities(proxy.Metadata.XdsCapabilities)
+	con.log = newConnectionLog(con)
+	if s.tenants != nil {
+		con.tenant = s.tenants.tenantOf(proxy)
+	}
 
+	// Unauthenticated connections are handled by PILOT_UNAUTHENTICATED_XDS_POLICY, before the connection
+	// is initialized.
 	if features.EnableXDSIdentityCheck && con.Identities != nil {
-		// TODO: allow locking down, rejecting unauthenticated requests.
 		if err := checkConnectionIdentity(con); err != nil {
 			adsLog.Warnf("Unauthorized XDS: %v with identity %v: %v", con.PeerAddr, con.Identities, err)
 			return fmt.Errorf("authorization failed: %v", err)
@@ -466,43 +1240,134 @@ func (s *DiscoveryServer) initConnection(node *core.Node, con *Connection) error
 
 	s.addCon(con.ConID, con)
 
+	if features.LogProxyLocality {
+		adsLog.Infof("ADS: %s locality %q (source: %s)", con.ConID,
+			util.LocalityToString(proxy.Locality), proxyLocalitySource(proxy))
+	}
+
 	if s.InternalGen != nil {
 		s.InternalGen.OnConnect(con)
 	}
 	return nil
 }
 
-func checkConnectionIdentity(con *Connection) error {
-	for _, rawID := range con.Identities {
-		spiffeID, err := spiffe.ParseIdentity(rawID)
-		if err != nil {
-			continue
-		}
-		if con.proxy.ConfigNamespace != "" && spiffeID.Namespace != con.proxy.ConfigNamespace {
-			continue
-		}
-		if con.proxy.Metadata.ServiceAccount != "" && spiffeID.ServiceAccount != con.proxy.Metadata.ServiceAccount {
-			continue
-		}
+// xdsCapabilities returns the set of type URLs in the capabilities advertised by a client, or nil if it did
+// not advertise any. Short types are expanded to the type URLs of the built-in types.
+func xdsCapabilities(capabilities []string) map[string]struct{} {
+	if len(capabilities) == 0 {
 		return nil
 	}
-	return fmt.Errorf("no identities (%v) matched %v/%v", con.Identities, con.proxy.ConfigNamespace, con.proxy.Metadata.ServiceAccount)
+	out := make(map[string]struct{}, len(capabilities))
+	for _, c := range capabilities {
+		c = strings.TrimSpace(c)
+		typeURL := c
+		for _, t := range []string{v3.ClusterType, v3.EndpointType, v3.ListenerType, v3.RouteType} {
+			if strings.EqualFold(c, v3.GetShortType(t)) {
+				typeURL = t
+				break
+			}
+		}
+		out[typeURL] = struct{}{}
+	}
+	return out
 }
 
-func connectionID(node string) string {
-	id := atomic.AddInt64(&connectionNumber, 1)
-	return node + "-" + strconv.FormatInt(id, 10)
+// supports returns true if the client implements the type. Pushes of unsupported types are skipped, even if
+// the type is watched, since they would only be NACKed or ignored.
+func (conn *Connection) supports(typeURL string) bool {
+	if conn.capabilities == nil {
+		return true
+	}
+	_, f := conn.capabilities[typeURL]
+	return f
 }
 
-// initProxy initializes the Proxy from node.
-func (s *DiscoveryServer) initProxy(node *core.Node) (*model.Proxy, error) {
+// defaultGenerator is reported for proxies served by the built-in handlers, instead of a named generator.
+const defaultGenerator = "default"
+
+// proxyGenerator returns the name of the generator serving the proxy, and the requested generator name
+// if it is not registered, in which case the proxy is served by the built-in handlers.
+func proxyGenerator(proxy *model.Proxy) (resolved string, unknown string) {
+	if proxy.Metadata == nil || proxy.Metadata.Generator == "" {
+		return defaultGenerator, ""
+	}
+	if proxy.XdsResourceGenerator == nil {
+		return defaultGenerator, proxy.Metadata.Generator
+	}
+	return proxy.Metadata.Generator, ""
+}
+
+// Sources of the locality of a proxy.
+const (
+	localitySourceRegistry = "registry"
+	localitySourceNode     = "node"
+	localitySourceNone     = "none"
+)
+
+// proxyLocalitySource returns where the locality of the proxy was resolved from, following the
+// precedence in initProxy and updateProxy: the service registry, then the locality reported by the proxy.
+func proxyLocalitySource(proxy *model.Proxy) string {
+	if util.IsLocalityEmpty(proxy.Locality) {
+		return localitySourceNone
+	}
+	if len(proxy.ServiceInstances) > 0 {
+		registry := util.ConvertLocality(proxy.ServiceInstances[0].Endpoint.Locality.Label)
+		if !util.IsLocalityEmpty(registry) && util.LocalityToString(registry) == util.LocalityToString(proxy.Locality) {
+			return localitySourceRegistry
+		}
+	}
+	return localitySourceNode
+}
+
+func checkConnectionIdentity(con *Connection) error {
+	for _, rawID := range con.Identities {
+		spiffeID, err := spiffe.ParseIdentity(rawID)
+		if err != nil {
+			continue
+		}
+		if con.proxy.ConfigNamespace != "" && spiffeID.Namespace != con.proxy.ConfigNamespace {
+			continue
+		}
+		if con.proxy.Metadata.ServiceAccount != "" && spiffeID.ServiceAccount != con.proxy.Metadata.ServiceAccount {
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no identities (%v) matched %v/%v", con.Identities, con.proxy.ConfigNamespace, con.proxy.Metadata.ServiceAccount)
+}
+
+func connectionID(node string) string {
+	id := atomic.AddInt64(&connectionNumber, 1)
+	return node + "-" + strconv.FormatInt(id, 10)
+}
+
+// connectionIDPrefix returns the prefix for the connection ID of a proxy, defaulting to the node ID.
+func (s *DiscoveryServer) connectionIDPrefix(node *core.Node, proxy *model.Proxy) string {
+	if s.ConnectionIDPrefix != nil {
+		if prefix := s.ConnectionIDPrefix(node, proxy); prefix != "" {
+			return prefix
+		}
+	}
+	return node.Id
+}
+
+// ProxyIDConnectionPrefix uses the proxy ID, typically the pod name and namespace, as the connection ID
+// prefix. This is much shorter than the full node ID, which makes connection IDs easier to read in logs.
+func ProxyIDConnectionPrefix(_ *core.Node, proxy *model.Proxy) string {
+	return proxy.ID
+}
+
+// initProxy initializes the Proxy from node.
+func (s *DiscoveryServer) initProxy(node *core.Node) (*model.Proxy, error) {
 	meta, err := model.ParseMetadata(node.Metadata)
 	if err != nil {
-		return nil, err
+		e := newMalformedNodeError(node.Id, err)
+		e.reason = malformedNodeMetadata
+		return nil, e
 	}
 	proxy, err := model.ParseServiceNodeWithMetadata(node.Id, meta)
 	if err != nil {
-		return nil, err
+		return nil, newMalformedNodeError(node.Id, err)
 	}
 	// Update the config namespace associated with this proxy
 	proxy.ConfigNamespace = model.GetProxyConfigNamespace(proxy)
@@ -568,22 +1433,52 @@ func (s *DiscoveryServer) setProxyState(proxy *model.Proxy, push *model.PushCont
 	return nil
 }
 
-// DeltaAggregatedResources is not implemented.
-// Instead, Generators may send only updates/add, with Delete indicated by an empty spec.
-// This works if both ends follow this model. For example EDS and the API generator follow this
-// pattern.
-//
+// DeltaAggregatedResources implements the incremental ADS interface.
 // The delta protocol changes the request, adding unsubscribe/subscribe instead of sending full
-// list of resources. On the response it adds 'removed resources' and sends changes for everything.
-// TODO: we could implement this method if needed, the change is not very big.
+// list of resources. On the response it adds 'removed resources' and only sends the changed resources.
+// The stream is adapted to the state of the world protocol, see DeltaDiscoveryStreamAdapter, so both
+// share the same request handling and push logic.
 func (s *DiscoveryServer) DeltaAggregatedResources(stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
-	return status.Errorf(codes.Unimplemented, "not implemented")
+	return s.StreamAggregatedResources(NewDeltaDiscoveryStreamAdapter(stream))
 }
 
 // Compute and send the new configuration for a connection. This is blocking and may be slow
 // for large configs. The method will hold a lock on con.pushMutex.
 func (s *DiscoveryServer) pushConnection(con *Connection, pushEv *Event) error {
 	pushRequest := pushEv.pushRequest
+
+	// The connection may have been removed, or its stream closed, after the push was enqueued.
+	// Skip it before doing any work, rather than generating config for a dead stream.
+	if s.isRemoved(con) || con.contextErr() != nil {
+		adsLog.Debugf("Skipping push to %v, connection was removed", con.ConID)
+		xdsRemovedConnectionPushes.Increment()
+		return nil
+	}
+
+	if s.isPaused(con) {
+		// Status is not registered: the proxy did not receive this version, so it should be
+		// reported as stale until it is unpaused.
+		adsLog.Debugf("Skipping push to %v, connection is paused", con.ConID)
+		return nil
+	}
+
+	if con.pushCircuitOpen() {
+		adsLog.Debugf("Skipping push to %v, push circuit breaker is open", con.ConID)
+		con.skipPush(pushRequest)
+		return nil
+	}
+
+	// Overlapping pushes to the same connection could corrupt the nonce state in WatchedResources. The push
+	// queue does not dequeue a connection again before it is marked done, so pushes are serialized today; this
+	// bound is a safeguard against a push started outside of the queue. Instead of running concurrently, the
+	// push is queued again and will run once the current one is done.
+	if !con.acquirePush(features.MaxConcurrentPushesPerConnection) {
+		adsLog.Warnf("Deferring push to %v, too many pushes in flight", con.ConID)
+		xdsOverlappingPushes.Increment()
+		s.pushQueue.Enqueue(con, pushRequest)
+		return nil
+	}
+	defer con.releasePush()
 	// TODO: update the service deps based on NetworkScope
 	if !pushRequest.Full {
 		if !ProxyNeedsPush(con.proxy, pushEv) {
@@ -593,10 +1488,19 @@ func (s *DiscoveryServer) pushConnection(con *Connection, pushEv *Event) error {
 		edsUpdatedServices := model.ConfigNamesOfKind(pushRequest.ConfigsUpdated, gvk.ServiceEntry)
 		// Push only EDS. This is indexed already - push immediately
 		// (may need a throttle)
-		if len(con.Clusters()) > 0 && len(edsUpdatedServices) > 0 {
-			if err := s.pushEds(pushRequest.Push, con, versionInfo(), edsUpdatedServices); err != nil {
-				return err
+		if len(con.Clusters()) > 0 && len(edsUpdatedServices) > 0 && con.supports(v3.EndpointType) {
+			pushStart := time.Now()
+			if err := s.pushEds(pushRequest.Push, con, pushVersion(pushRequest.Push), edsUpdatedServices); err != nil {
+				return &pushError{typeURL: v3.EndpointType, err: err}
 			}
+			recordTypePushTime(v3.EndpointType, false, pushStart)
+			if limit := features.EDSTriggerServicesLimit; limit > 0 {
+				con.recordEdsTrigger(edsUpdatedServices, limit)
+			}
+			atomic.AddInt64(&con.pushes, 1)
+			recordPushTypes(false, 1)
+		} else {
+			recordPushTypes(false, 0)
 		}
 		return nil
 	}
@@ -619,7 +1523,7 @@ func (s *DiscoveryServer) pushConnection(con *Connection, pushEv *Event) error {
 			// this version of the config will never be distributed to this envoy because it is not a relevant diff.
 			// inform distribution status reporter that this connection has been updated, because it effectively has
 			for _, distributionType := range AllEventTypes {
-				s.StatusReporter.RegisterEvent(con.ConID, distributionType, pushRequest.Push.Version)
+				s.StatusReporter.RegisterEvent(con.ConID, distributionType, pushRequest.Push.Version, con.initialSync(distributionType))
 			}
 		}
 		return nil
@@ -627,8 +1531,15 @@ func (s *DiscoveryServer) pushConnection(con *Connection, pushEv *Event) error {
 
 	adsLog.Infof("Pushing %v", con.ConID)
 
-	// check version, suppress if changed.
-	currentVersion := versionInfo()
+	// The proxy may have disconnected while the push was queued or while updating the proxy.
+	if err := con.contextErr(); err != nil {
+		return err
+	}
+
+	// All types are generated from the same push context, so they share its version.
+	currentVersion := pushVersion(pushRequest.Push)
+	// Number of types sent in this push, after filtering the types not affected by the push.
+	typesPushed := 0
 
 	// When using Generator, the generic WatchedResource is used instead of the individual
 	// 'LDSWatch', etc.
@@ -636,52 +1547,374 @@ func (s *DiscoveryServer) pushConnection(con *Connection, pushEv *Event) error {
 	// returning nil if the push is not needed.
 	if con.proxy.XdsResourceGenerator != nil {
 		for _, w := range con.proxy.WatchedResources {
-			err := s.pushGeneratorV2(con, pushRequest.Push, currentVersion, w, pushRequest.ConfigsUpdated)
-			if err != nil {
+			if err := con.contextErr(); err != nil {
 				return err
 			}
+			if !con.supports(w.TypeUrl) {
+				continue
+			}
+			err := s.isolateGenerationError(con, w.TypeUrl, func() error {
+				return s.pushGeneratorV2(con, pushRequest.Push, currentVersion, w, pushRequest.ConfigsUpdated)
+			})
+			if err != nil {
+				return &pushError{typeURL: w.TypeUrl, err: err}
+			}
+			typesPushed++
 		}
 	}
 
 	pushTypes := PushTypeFor(con.proxy, pushEv)
 
-	if con.Watching(v3.ClusterType) && pushTypes[CDS] {
-		err := s.pushCds(con, pushRequest.Push, currentVersion)
-		if err != nil {
+	if con.Watching(v3.ClusterType) && pushTypes[CDS] && con.supports(v3.ClusterType) {
+		s.waitForAck(con, v3.ClusterType)
+		if s.superseded(con, pushRequest) {
+			return nil
+		}
+		if err := con.contextErr(); err != nil {
 			return err
 		}
+		pushStart := time.Now()
+		err := s.isolateGenerationError(con, v3.ClusterType, func() error {
+			return s.pushCds(con, pushRequest.Push, currentVersion)
+		})
+		if err != nil {
+			return &pushError{typeURL: v3.ClusterType, err: err}
+		}
+		recordTypePushTime(v3.ClusterType, true, pushStart)
+		typesPushed++
 	} else if s.StatusReporter != nil {
-		s.StatusReporter.RegisterEvent(con.ConID, v3.ClusterType, pushRequest.Push.Version)
+		s.StatusReporter.RegisterEvent(con.ConID, v3.ClusterType, pushRequest.Push.Version, con.initialSync(v3.ClusterType))
 	}
 
-	if len(con.Clusters()) > 0 && pushTypes[EDS] {
-		err := s.pushEds(pushRequest.Push, con, currentVersion, nil)
-		if err != nil {
+	edsUpdatedServices := edsUpdatedServicesForFullPush(pushRequest)
+	if len(con.Clusters()) > 0 && pushTypes[EDS] && con.supports(v3.EndpointType) &&
+		(edsUpdatedServices == nil || len(edsUpdatedServices) > 0) {
+		s.waitForAck(con, v3.EndpointType)
+		if s.superseded(con, pushRequest) {
+			return nil
+		}
+		if err := con.contextErr(); err != nil {
 			return err
 		}
+		pushStart := time.Now()
+		err := s.isolateGenerationError(con, v3.EndpointType, func() error {
+			return s.pushEds(pushRequest.Push, con, currentVersion, edsUpdatedServices)
+		})
+		if err != nil {
+			return &pushError{typeURL: v3.EndpointType, err: err}
+		}
+		recordTypePushTime(v3.EndpointType, true, pushStart)
+		typesPushed++
 	} else if s.StatusReporter != nil {
-		s.StatusReporter.RegisterEvent(con.ConID, v3.EndpointType, pushRequest.Push.Version)
+		s.StatusReporter.RegisterEvent(con.ConID, v3.EndpointType, pushRequest.Push.Version, con.initialSync(v3.EndpointType))
 	}
-	if con.Watching(v3.ListenerType) && pushTypes[LDS] {
-		err := s.pushLds(con, pushRequest.Push, currentVersion)
-		if err != nil {
+	if con.Watching(v3.ListenerType) && pushTypes[LDS] && con.supports(v3.ListenerType) {
+		s.waitForAck(con, v3.ListenerType)
+		if s.superseded(con, pushRequest) {
+			return nil
+		}
+		if err := con.contextErr(); err != nil {
 			return err
 		}
+		pushStart := time.Now()
+		err := s.isolateGenerationError(con, v3.ListenerType, func() error {
+			return s.pushLds(con, pushRequest.Push, currentVersion)
+		})
+		if err != nil {
+			return &pushError{typeURL: v3.ListenerType, err: err}
+		}
+		recordTypePushTime(v3.ListenerType, true, pushStart)
+		typesPushed++
 	} else if s.StatusReporter != nil {
-		s.StatusReporter.RegisterEvent(con.ConID, v3.ListenerType, pushRequest.Push.Version)
+		s.StatusReporter.RegisterEvent(con.ConID, v3.ListenerType, pushRequest.Push.Version, con.initialSync(v3.ListenerType))
 	}
-	if len(con.Routes()) > 0 && pushTypes[RDS] {
-		err := s.pushRoute(con, pushRequest.Push, currentVersion)
-		if err != nil {
+	if len(con.Routes()) > 0 && pushTypes[RDS] && con.supports(v3.RouteType) {
+		s.waitForAck(con, v3.RouteType)
+		if s.superseded(con, pushRequest) {
+			return nil
+		}
+		if err := con.contextErr(); err != nil {
 			return err
 		}
+		pushStart := time.Now()
+		err := s.isolateGenerationError(con, v3.RouteType, func() error {
+			return s.pushRoute(con, pushRequest.Push, currentVersion)
+		})
+		if err != nil {
+			return &pushError{typeURL: v3.RouteType, err: err}
+		}
+		recordTypePushTime(v3.RouteType, true, pushStart)
+		typesPushed++
 	} else if s.StatusReporter != nil {
-		s.StatusReporter.RegisterEvent(con.ConID, v3.RouteType, pushRequest.Push.Version)
+		s.StatusReporter.RegisterEvent(con.ConID, v3.RouteType, pushRequest.Push.Version, con.initialSync(v3.RouteType))
+	}
+	con.proxy.Lock()
+	con.lastFullPush = &PushProvenance{
+		PushVersion:   currentVersion,
+		ConfigVersion: pushRequest.Push.Version,
+		Reasons:       pushRequest.Reason,
+		Time:          time.Now(),
+	}
+	con.proxy.Unlock()
+
+	if typesPushed > 0 {
+		atomic.AddInt64(&con.pushes, 1)
 	}
+	recordPushTypes(true, typesPushed)
 	proxiesConvergeDelay.Record(time.Since(pushRequest.Start).Seconds())
 	return nil
 }
 
+// superseded returns true if a newer full push was enqueued for the connection while the current one is
+// running. Pushing the remaining types would send config that is about to be replaced, so the current push
+// is stopped, and folded into the newer one.
+func (s *DiscoveryServer) superseded(con *Connection, pushRequest *model.PushRequest) bool {
+	if s.pushQueue == nil || !s.pushQueue.Supersede(con, pushRequest) {
+		return false
+	}
+	adsLog.Debugf("Stopping push to %v, superseded by a newer full push", con.ConID)
+	xdsSupersededPushes.Increment()
+	return true
+}
+
+// pushError is the error of the push of a type to a connection.
+type pushError struct {
+	typeURL string
+	err     error
+}
+
+func (e *pushError) Error() string {
+	return fmt.Sprintf("%s: %v", v3.GetShortType(e.typeURL), e.err)
+}
+
+func (e *pushError) Unwrap() error {
+	return e.err
+}
+
+// pushFailureStatus returns the status closing the stream after a failed push, so the proxy can tell a
+// push failure from a clean disconnect. The stream closing while pushing is a clean disconnect.
+func pushFailureStatus(con *Connection, err error) error {
+	typeURL, cause := "unknown", err
+	var pe *pushError
+	if errors.As(err, &pe) {
+		typeURL, cause = pe.typeURL, pe.err
+	}
+	if isExpectedGRPCError(cause) || errors.Is(cause, context.Canceled) {
+		return nil
+	}
+	adsLog.Warnf("ADS: %s push of %s failed: %v", con.ConID, v3.GetShortType(typeURL), cause)
+	xdsPushFailures.With(typeTag.Value(v3.GetMetricType(typeURL))).Increment()
+	// Errors with a status, for example a response over PILOT_XDS_MAX_RESPONSE_BYTES, keep their code.
+	code := codes.Internal
+	if st, ok := status.FromError(cause); ok && st.Code() != codes.Unknown {
+		code = st.Code()
+	}
+	return status.Errorf(code, "failed to push %s: %v", v3.GetShortType(typeURL), cause)
+}
+
+// isolateGenerationError runs the push of a single type. If PILOT_ISOLATE_GENERATION_ERRORS is enabled,
+// a failure to generate the config, which surfaces as a panic from the generator, is contained to the
+// type: it is logged, counted, and recorded on the watched resource, and the other types are still pushed.
+// Errors sending the response are always returned, since the stream is no longer usable.
+func (s *DiscoveryServer) isolateGenerationError(con *Connection, typeURL string, push func() error) (err error) {
+	if !features.IsolateGenerationErrors {
+		return push()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			adsLog.Errorf("%s: failed to generate config for %s: %v", v3.GetShortType(typeURL), con.ConID, r)
+			xdsGenerationErrors.With(typeTag.Value(v3.GetMetricType(typeURL))).Increment()
+			con.proxy.Lock()
+			if w := con.proxy.WatchedResources[typeURL]; w != nil {
+				w.GenerationError = fmt.Sprint(r)
+			}
+			con.proxy.Unlock()
+			err = nil
+		}
+	}()
+	return push()
+}
+
+// handlePushFailure handles a failed push to the connection, and returns true if the stream must be closed,
+// with the returned status. If PILOT_PUSH_CIRCUIT_BREAKER_THRESHOLD is set, the failure is counted instead,
+// and the connection is kept: once the breaker opens, pushes to it are skipped until the cooldown has passed.
+// A stream closed by the client is always closed, and so is a stream a send timed out on: the timed out send
+// may still be running, and gRPC does not allow another send on the stream concurrently.
+func (s *DiscoveryServer) handlePushFailure(con *Connection, err error) (bool, error) {
+	st := pushFailureStatus(con, err)
+	if st == nil || status.Code(st) == codes.DeadlineExceeded || features.PushCircuitBreakerThreshold <= 0 ||
+		con.contextErr() != nil {
+		return true, st
+	}
+	if con.recordPushFailure() {
+		time.AfterFunc(features.PushCircuitBreakerCooldown, func() {
+			s.resumeSkippedPushes(con)
+		})
+	}
+	return false, nil
+}
+
+// recordPushFailure counts a failed push, and opens the push circuit breaker once the failures
+// reach PILOT_PUSH_CIRCUIT_BREAKER_THRESHOLD. It returns true if the breaker was not open already.
+func (conn *Connection) recordPushFailure() bool {
+	n := atomic.AddInt32(&conn.pushFailures, 1)
+	threshold := features.PushCircuitBreakerThreshold
+	if threshold <= 0 || int(n) < threshold {
+		return false
+	}
+	openedAt := atomic.SwapInt64(&conn.breakerOpenedAt, time.Now().UnixNano())
+	if openedAt != 0 && time.Since(time.Unix(0, openedAt)) < features.PushCircuitBreakerCooldown {
+		return false
+	}
+	adsLog.Warnf("ADS: %s failed %d consecutive pushes, skipping pushes for %v",
+		conn.ConID, n, features.PushCircuitBreakerCooldown)
+	return true
+}
+
+// skipPush records a push skipped while the push circuit breaker is open, merged with the ones skipped before.
+func (conn *Connection) skipPush(req *model.PushRequest) {
+	xdsPushCircuitSkipped.Increment()
+	conn.breakerMutex.Lock()
+	defer conn.breakerMutex.Unlock()
+	conn.breakerSkipped = conn.breakerSkipped.Merge(req)
+}
+
+// resumeSkippedPushes enqueues the pushes skipped while the push circuit breaker of the connection was open,
+// once its cooldown has passed.
+func (s *DiscoveryServer) resumeSkippedPushes(con *Connection) {
+	con.breakerMutex.Lock()
+	req := con.breakerSkipped
+	con.breakerSkipped = nil
+	con.breakerMutex.Unlock()
+	if req == nil || s.isRemoved(con) {
+		return
+	}
+	adsLog.Infof("ADS: %s push circuit breaker cooldown has passed, pushing the skipped config", con.ConID)
+	s.pushQueue.Enqueue(con, req)
+}
+
+// recordPushSuccess resets the push failures, closing the push circuit breaker.
+func (conn *Connection) recordPushSuccess() {
+	atomic.StoreInt32(&conn.pushFailures, 0)
+	atomic.StoreInt64(&conn.breakerOpenedAt, 0)
+}
+
+// pushCircuitOpen returns true if pushes to the connection should be skipped. Once the cooldown has
+// passed, pushes are allowed again; if the next one fails too, the breaker opens for another cooldown.
+func (conn *Connection) pushCircuitOpen() bool {
+	openedAt := atomic.LoadInt64(&conn.breakerOpenedAt)
+	return openedAt != 0 && time.Since(time.Unix(0, openedAt)) < features.PushCircuitBreakerCooldown
+}
+
+// HealthScore returns a score between 0 and 100 reflecting how reliably the proxy receives config.
+// Recent NACKs and send timeouts, and having reconnected, lower the score.
+func (conn *Connection) HealthScore() int {
+	score := 100 - 10*int(atomic.LoadInt32(&conn.nacks)) - 20*int(atomic.LoadInt32(&conn.sendTimeouts))
+	if atomic.LoadInt32(&conn.reconnected) != 0 {
+		score -= 10
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// decrementToZero atomically decrements the counter, unless it is already 0.
+func decrementToZero(addr *int32) {
+	for {
+		v := atomic.LoadInt32(addr)
+		if v <= 0 || atomic.CompareAndSwapInt32(addr, v, v-1) {
+			return
+		}
+	}
+}
+
+// QueueWait returns the time the last push to the connection waited in the push queue.
+func (conn *Connection) QueueWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&conn.queueWait))
+}
+
+// ResourceChurn returns the number of times the proxy changed the resource names it subscribes to.
+// A proxy with a steadily growing count has an unstable subscription, which triggers continuous pushes.
+func (conn *Connection) ResourceChurn() int64 {
+	return atomic.LoadInt64(&conn.resourceChurn)
+}
+
+// EdsRemovals returns the number of clusters sent with an empty assignment, removing all their
+// endpoints, in the last EDS push to the connection.
+func (conn *Connection) EdsRemovals() int {
+	return int(atomic.LoadInt32(&conn.edsRemovals))
+}
+
+// recordEdsRemovals records the number of clusters sent with an empty assignment in an EDS push.
+func (conn *Connection) recordEdsRemovals(removals int) {
+	atomic.StoreInt32(&conn.edsRemovals, int32(removals))
+	edsRemovals.Record(float64(removals))
+}
+
+// recordEdsTrigger records up to limit of the services that triggered an incremental EDS push.
+func (conn *Connection) recordEdsTrigger(services map[string]struct{}, limit int) {
+	trigger := &EdsTrigger{Time: time.Now()}
+	for svc := range services {
+		trigger.Services = append(trigger.Services, svc)
+	}
+	sort.Strings(trigger.Services)
+	if len(trigger.Services) > limit {
+		trigger.Services = trigger.Services[:limit]
+		trigger.Truncated = true
+	}
+	conn.proxy.Lock()
+	conn.lastEdsTrigger = trigger
+	conn.proxy.Unlock()
+}
+
+// LastEdsTrigger returns the services that triggered the last incremental EDS push to the connection,
+// or nil if none were recorded.
+func (conn *Connection) LastEdsTrigger() *EdsTrigger {
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	return conn.lastEdsTrigger
+}
+
+// LastFullPush returns the last full push sent to the connection, or nil if there was none.
+func (conn *Connection) LastFullPush() *PushProvenance {
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	return conn.lastFullPush
+}
+
+// PauseConnection suspends or resumes pushes to a single connection, without disconnecting it.
+// While paused, pushes to the connection are skipped. On resume a full push is triggered, so
+// the proxy catches up with the changes it missed. The paused state is dropped on disconnect.
+func (s *DiscoveryServer) PauseConnection(conID string, paused bool) error {
+	s.adsClientsMutex.Lock()
+	con, f := s.adsClients[conID]
+	if !f {
+		s.adsClientsMutex.Unlock()
+		return fmt.Errorf("connection %s not found", conID)
+	}
+	wasPaused := con.paused
+	con.paused = paused
+	s.adsClientsMutex.Unlock()
+
+	if wasPaused && !paused {
+		s.pushQueue.Enqueue(con, &model.PushRequest{
+			Full:   true,
+			Push:   s.globalPushContext(),
+			Start:  time.Now(),
+			Reason: []model.TriggerReason{model.DebugTrigger},
+		})
+	}
+	adsLog.Infof("ADS: connection %s paused=%v", conID, paused)
+	return nil
+}
+
+func (s *DiscoveryServer) isPaused(con *Connection) bool {
+	s.adsClientsMutex.RLock()
+	defer s.adsClientsMutex.RUnlock()
+	return con.paused
+}
+
 func (s *DiscoveryServer) adsClientCount() int {
 	s.adsClientsMutex.RLock()
 	defer s.adsClientsMutex.RUnlock()
@@ -689,22 +1922,22 @@ func (s *DiscoveryServer) adsClientCount() int {
 }
 
 func (s *DiscoveryServer) ProxyUpdate(clusterID, ip string) {
-	var connection *Connection
+	var connections []*Connection
 
 	s.adsClientsMutex.RLock()
 	for _, v := range s.adsClients {
 		if v.proxy.Metadata.ClusterID == clusterID && v.proxy.IPAddresses[0] == ip {
-			connection = v
-			break
+			connections = append(connections, v)
 		}
 
 	}
 	s.adsClientsMutex.RUnlock()
 
 	// It is possible that the envoy has not connected to this pilot, maybe connected to another pilot
-	if connection == nil {
+	if len(connections) == 0 {
 		return
 	}
+	connection := pushTargets(connections)[0]
 	if adsLog.DebugEnabled() {
 		currentlyPending := s.pushQueue.Pending()
 		if currentlyPending != 0 {
@@ -772,74 +2005,375 @@ func (s *DiscoveryServer) startPush(req *model.PushRequest) {
 	}
 	s.adsClientsMutex.RUnlock()
 
+	s.enqueuePushes(pushTargets(pending), req)
+}
+
+// pushTargets returns the connections to push to. If PILOT_DEDUPLICATE_PROXY_PUSHES is set, only the most
+// recent connection of each proxy is kept.
+func pushTargets(cons []*Connection) []*Connection {
+	if !features.DeduplicateProxyPushes {
+		return cons
+	}
+	return latestConnections(cons)
+}
+
+// latestConnections returns the most recent connection of each proxy, in the order of cons. A proxy may
+// briefly hold two connections while it reconnects, and pushing to the stale one wastes work. Connections
+// of the same proxy have the same connection ID prefix, before the counter.
+func latestConnections(cons []*Connection) []*Connection {
+	prefix := func(con *Connection) string {
+		if i := strings.LastIndex(con.ConID, "-"); i >= 0 {
+			return con.ConID[:i]
+		}
+		return con.ConID
+	}
+	latest := make(map[string]*Connection, len(cons))
+	for _, con := range cons {
+		if other, f := latest[prefix(con)]; !f || con.Connect.After(other.Connect) {
+			latest[prefix(con)] = con
+		}
+	}
+	if len(latest) == len(cons) {
+		return cons
+	}
+	xdsDuplicatePushesSuppressed.Record(float64(len(cons) - len(latest)))
+	out := make([]*Connection, 0, len(latest))
+	for _, con := range cons {
+		if latest[prefix(con)] == con {
+			out = append(out, con)
+		}
+	}
+	return out
+}
+
+// PushToSelector pushes to the connections whose proxy workload labels match the selector, for targeted
+// rollouts or debugging without knowing the connection IDs. An empty selector matches no proxy, use
+// AdsPushAll to push to all of them. It returns the number of connections the push was enqueued for.
+func (s *DiscoveryServer) PushToSelector(selector map[string]string, req *model.PushRequest) int {
+	if len(selector) == 0 {
+		return 0
+	}
+	var matched []*Connection
+	s.adsClientsMutex.RLock()
+	for _, con := range s.adsClients {
+		if con.proxy != nil && con.proxy.Metadata != nil && labels.Instance(selector).SubsetOf(con.proxy.Metadata.Labels) {
+			matched = append(matched, con)
+		}
+	}
+	s.adsClientsMutex.RUnlock()
+	matched = pushTargets(matched)
+
+	adsLog.Infof("XDS: Pushing to %d connections matching %v", len(matched), selector)
+	// A targeted push is not a push to all connections: it is enqueued at once, and does not end the push
+	// generation, which would cancel the batches of a full push in progress.
+	req.Start = time.Now()
+	s.enqueueBatch(matched, req)
+	return len(matched)
+}
+
+// enqueuePushes enqueues the push request for the given connections.
+func (s *DiscoveryServer) enqueuePushes(pending []*Connection, req *model.PushRequest) {
 	if adsLog.DebugEnabled() {
 		currentlyPending := s.pushQueue.Pending()
 		if currentlyPending != 0 {
 			adsLog.Infof("Starting new push while %v were still pending", currentlyPending)
 		}
 	}
+	if features.EnableHealthPushPriority {
+		// Push to healthy proxies first, so flapping proxies do not delay them.
+		scores := make(map[*Connection]int, len(pending))
+		for _, con := range pending {
+			scores[con] = con.HealthScore()
+		}
+		sort.SliceStable(pending, func(i, j int) bool {
+			return scores[pending[i]] > scores[pending[j]]
+		})
+	}
 	req.Start = time.Now()
+	done := s.pushGeneration(req.Full)
+	batchSize := features.PushBatchSize
+	if features.PushBatchFleetSize <= 0 || len(pending) <= features.PushBatchFleetSize || batchSize <= 0 {
+		batchSize = len(pending)
+	}
+	if len(pending) <= batchSize {
+		s.enqueueBatch(pending, req)
+		return
+	}
+	// Enqueue large fleets in waves, to avoid a huge instantaneous queue. The waves are paced on their own
+	// goroutine, so the caller, usually the debounce loop, is not delayed.
+	s.enqueueBatch(pending[:batchSize], req)
+	go s.enqueueBatches(pending[batchSize:], req, batchSize, done)
+}
+
+// enqueueBatches enqueues the push request for the connections in batches of batchSize, one batch every
+// PILOT_PUSH_BATCH_INTERVAL. It stops once done is closed by a newer full push, which covers the remaining
+// connections.
+func (s *DiscoveryServer) enqueueBatches(pending []*Connection, req *model.PushRequest, batchSize int, done <-chan struct{}) {
+	t := time.NewTicker(features.PushBatchInterval)
+	defer t.Stop()
+	for len(pending) > 0 {
+		select {
+		case <-done:
+			adsLog.Debugf("Newer full push started, skipping %d remaining connections", len(pending))
+			return
+		case <-t.C:
+		}
+		n := batchSize
+		if n > len(pending) {
+			n = len(pending)
+		}
+		s.enqueueBatch(pending[:n], req)
+		pending = pending[n:]
+	}
+}
+
+// enqueueBatch enqueues the push request for the given connections at once.
+func (s *DiscoveryServer) enqueueBatch(pending []*Connection, req *model.PushRequest) {
 	for _, p := range pending {
+		if p.pushCircuitOpen() {
+			p.skipPush(req)
+			continue
+		}
+		if s.edsCoalescer != nil && (!req.Full || features.CoalesceFullPushes) {
+			s.edsCoalescer.Enqueue(p, req)
+			continue
+		}
 		s.pushQueue.Enqueue(p, req)
 	}
 }
 
+// pushGeneration returns the channel closed when the current push generation ends. If next is set, for a
+// full push to all connections, a new generation is started, ending the current one.
+func (s *DiscoveryServer) pushGeneration(next bool) <-chan struct{} {
+	s.pushGenerationMutex.Lock()
+	defer s.pushGenerationMutex.Unlock()
+	if next && s.pushGenerationDone != nil {
+		close(s.pushGenerationDone)
+		s.pushGenerationDone = nil
+	}
+	if s.pushGenerationDone == nil {
+		s.pushGenerationDone = make(chan struct{})
+	}
+	return s.pushGenerationDone
+}
+
 func (s *DiscoveryServer) addCon(conID string, con *Connection) {
 	s.adsClientsMutex.Lock()
 	defer s.adsClientsMutex.Unlock()
 	s.adsClients[conID] = con
 	recordXDSClients(con.proxy.Metadata.IstioVersion, 1)
+	if s.tenants != nil {
+		con.tenantUsage = s.tenants.connect(con.tenant)
+	}
+}
+
+// isRemoved returns true once the connection has been removed from the connection table.
+func (s *DiscoveryServer) isRemoved(con *Connection) bool {
+	s.adsClientsMutex.RLock()
+	defer s.adsClientsMutex.RUnlock()
+	return con.removed
 }
 
-func (s *DiscoveryServer) removeCon(conID string) {
+// removeCon removes the connection from the connection table. It is safe to call multiple times
+// for the same connection, for example when a connection is evicted while the client disconnects.
+func (s *DiscoveryServer) removeCon(con *Connection) {
 	s.adsClientsMutex.Lock()
 	defer s.adsClientsMutex.Unlock()
 
-	if con, exist := s.adsClients[conID]; !exist {
-		adsLog.Errorf("ADS: Removing connection for non-existing node:%v.", conID)
+	if con.removed {
+		adsLog.Debugf("ADS: Connection %v already removed", con.ConID)
+		return
+	}
+	con.removed = true
+
+	if _, exist := s.adsClients[con.ConID]; !exist {
+		adsLog.Errorf("ADS: Removing connection for non-existing node:%v.", con.ConID)
 		totalXDSInternalErrors.Increment()
 	} else {
-		delete(s.adsClients, conID)
+		delete(s.adsClients, con.ConID)
 		recordXDSClients(con.proxy.Metadata.IstioVersion, -1)
+		if con.tenantUsage != nil {
+			s.tenants.disconnect(con.tenantUsage)
+		}
+	}
+
+	if features.PreserveEdsSubscriptionOnReconnect {
+		s.saveEdsSubscriptionLocked(con)
+	}
+
+	if s.pushQueue != nil {
+		s.pushQueue.Forget(con)
 	}
 
 	if s.StatusReporter != nil {
-		go s.StatusReporter.RegisterDisconnect(conID, AllEventTypes)
+		go s.StatusReporter.RegisterDisconnect(con.ConID, AllEventTypes)
 	}
 }
 
+// edsSubscriptionTTL is how long the EDS clusters of a disconnected proxy are remembered.
+const edsSubscriptionTTL = 5 * time.Minute
+
+// edsSubscription is the set of EDS clusters a proxy was watching when it disconnected.
+type edsSubscription struct {
+	clusters []string
+	saved    time.Time
+}
+
+// saveEdsSubscriptionLocked remembers the EDS clusters of a disconnecting proxy, so they can be
+// served if it reconnects and requests EDS before CDS is re-established. Expired entries are
+// pruned. Must be called with adsClientsMutex held.
+func (s *DiscoveryServer) saveEdsSubscriptionLocked(con *Connection) {
+	if s.edsSubscriptions == nil {
+		s.edsSubscriptions = map[string]edsSubscription{}
+	}
+	now := time.Now()
+	for id, sub := range s.edsSubscriptions {
+		if now.Sub(sub.saved) > edsSubscriptionTTL {
+			delete(s.edsSubscriptions, id)
+		}
+	}
+	if con.proxy == nil {
+		return
+	}
+	if clusters := con.Clusters(); len(clusters) > 0 {
+		s.edsSubscriptions[con.proxy.ID] = edsSubscription{clusters: clusters, saved: now}
+	}
+}
+
+// restoreEdsSubscription returns, and forgets, the EDS clusters the proxy was watching before it
+// last disconnected. It returns nil if there are none or they have expired.
+func (s *DiscoveryServer) restoreEdsSubscription(proxyID string) []string {
+	s.adsClientsMutex.Lock()
+	defer s.adsClientsMutex.Unlock()
+	sub, f := s.edsSubscriptions[proxyID]
+	if !f {
+		return nil
+	}
+	delete(s.edsSubscriptions, proxyID)
+	if time.Since(sub.saved) > edsSubscriptionTTL {
+		return nil
+	}
+	return sub.clusters
+}
+
+// acquirePush records the start of a push on the connection. It returns false, without recording it,
+// if limit pushes are already in flight. A limit of 0 or less disables the check.
+func (conn *Connection) acquirePush(limit int) bool {
+	n := atomic.AddInt32(&conn.inflightPushes, 1)
+	if limit > 0 && int(n) > limit {
+		atomic.AddInt32(&conn.inflightPushes, -1)
+		return false
+	}
+	return true
+}
+
+// releasePush records the end of a push started with acquirePush.
+func (conn *Connection) releasePush() {
+	atomic.AddInt32(&conn.inflightPushes, -1)
+}
+
+// contextErr returns the error of the stream context, if the stream was closed or its deadline was
+// exceeded. Generating config is expensive, so pushes check it between steps and stop early instead
+// of building config for a client that is gone. Connections without a stream, such as those used for
+// dry runs, are never closed.
+func (conn *Connection) contextErr() error {
+	if conn.stream == nil {
+		return nil
+	}
+	return conn.stream.Context().Err()
+}
+
 // Send with timeout
 func (conn *Connection) send(res *discovery.DiscoveryResponse) error {
+	if conn.interceptor != nil {
+		intercepted, err := conn.interceptor.Intercept(conn, res)
+		if err != nil {
+			adsLog.Warnf("ADS: %s %s response rejected by interceptor: %v", conn.ConID, v3.GetShortType(res.TypeUrl), err)
+			return err
+		}
+		res = intercepted
+	}
+	if features.EnableDeterministicXDS {
+		sortResources(res.Resources)
+	}
+	if conn.capture != nil {
+		conn.capture(res)
+		return nil
+	}
+	sz := 0
+	for _, rc := range res.Resources {
+		sz += len(rc.Value)
+	}
+	if max := features.XDSMaxResponseBytes; max > 0 && sz > max {
+		adsLog.Warnf("ADS: %s %s response of %d bytes for %d resources exceeds the limit of %d bytes, not sending",
+			conn.ConID, v3.GetShortType(res.TypeUrl), sz, len(res.Resources), max)
+		xdsOversizedResponses.With(typeTag.Value(v3.GetMetricType(res.TypeUrl))).Increment()
+		return status.Errorf(codes.ResourceExhausted, "%s response of %d bytes for %d resources exceeds the limit of %d bytes",
+			v3.GetShortType(res.TypeUrl), sz, len(res.Resources), max)
+	}
 	errChan := make(chan error, 1)
-	// hardcoded for now - not sure if we need a setting
-	t := time.NewTimer(sendTimeout)
+	timeout := conn.sendDeadline(sz)
+	t := time.NewTimer(timeout)
 	go func() {
 		errChan <- conn.stream.Send(res)
 		close(errChan)
 	}()
 	select {
 	case <-t.C:
-		// TODO: wait for ACK
-		adsLog.Infof("Timeout writing %s", conn.ConID)
-		xdsResponseWriteTimeouts.Increment()
+		adsLog.Infof("Timeout writing %s: %s response of %d bytes not sent within %v", conn.ConID,
+			v3.GetShortType(res.TypeUrl), sz, timeout)
+		xdsResponseWriteTimeouts.With(sizeTag.Value(responseSizeBucket(sz))).Increment()
+		atomic.AddInt32(&conn.sendTimeouts, 1)
+		logXdsAccess(conn, res.TypeUrl, res.VersionInfo, res.Nonce, 0, accessLogSendTimeout, nil)
 		return status.Errorf(codes.DeadlineExceeded, "timeout sending")
 	case err := <-errChan:
 		if err == nil {
-			sz := 0
-			for _, rc := range res.Resources {
-				sz += len(rc.Value)
+			var sentNames []string
+			if features.XDSSentResourceNamesLimit > 0 {
+				sentNames = resourceNames(res.Resources, features.XDSSentResourceNamesLimit)
 			}
+			previousSize := 0
+			var firstPush time.Duration
 			conn.proxy.Lock()
+			if _, f := conn.firstPush[res.TypeUrl]; !f {
+				if conn.firstPush == nil {
+					conn.firstPush = map[string]time.Duration{}
+				}
+				firstPush = time.Since(conn.Connect)
+				conn.firstPush[res.TypeUrl] = firstPush
+			}
 			if res.Nonce != "" {
 				if conn.proxy.WatchedResources[res.TypeUrl] == nil {
 					conn.proxy.WatchedResources[res.TypeUrl] = &model.WatchedResource{TypeUrl: res.TypeUrl}
 				}
+				previousSize = conn.proxy.WatchedResources[res.TypeUrl].LastSize
 				conn.proxy.WatchedResources[res.TypeUrl].NonceSent = res.Nonce
 				conn.proxy.WatchedResources[res.TypeUrl].VersionSent = res.VersionInfo
+				recordPendingVersion(conn.proxy.WatchedResources[res.TypeUrl], res.Nonce, res.VersionInfo)
 				conn.proxy.WatchedResources[res.TypeUrl].LastSent = time.Now()
 				conn.proxy.WatchedResources[res.TypeUrl].LastSize = sz
+				conn.proxy.WatchedResources[res.TypeUrl].GenerationError = ""
+				if sentNames != nil {
+					conn.proxy.WatchedResources[res.TypeUrl].LastSentResourceNames = sentNames
+				}
 			}
 			conn.proxy.Unlock()
+			recordConfigGrowth(res.TypeUrl, conn.ConID, previousSize, sz)
+			recordConfigSize(res.TypeUrl, sz)
+			if atomic.CompareAndSwapInt32(&conn.firstResponseSent, 0, 1) {
+				firstPushSetupTime.Record(time.Since(conn.Connect).Seconds())
+			}
+			if firstPush > 0 {
+				firstTypePushTime.With(typeTag.Value(v3.GetMetricType(res.TypeUrl))).Record(firstPush.Seconds())
+			}
+			logXdsAccess(conn, res.TypeUrl, res.VersionInfo, res.Nonce, sz, accessLogSent, nil)
+			decrementToZero(&conn.sendTimeouts)
+			conn.recordPushSuccess()
+			if conn.tenantUsage != nil {
+				conn.tenantUsage.sent(sz)
+			}
+		} else {
+			logXdsAccess(conn, res.TypeUrl, res.VersionInfo, res.Nonce, 0, accessLogSendError, err)
 		}
 		// To ensure the channel is empty after a call to Stop, check the
 		// return value and drain the channel (from Stop docs).
@@ -850,6 +2384,104 @@ func (conn *Connection) send(res *discovery.DiscoveryResponse) error {
 	}
 }
 
+// defaultSendTimeout is the send timeout of connections that were not created by a DiscoveryServer.
+const defaultSendTimeout = 5 * time.Second
+
+// sendDeadline returns the max time to wait for a response of the given size to be sent. This helps
+// detect clients in a bad state (not reading). The timeout is extended for responses that would take
+// longer to send at the minimum expected rate, so large configs are not cut off on slow links.
+func (conn *Connection) sendDeadline(size int) time.Duration {
+	timeout := conn.sendTimeout
+	if timeout <= 0 {
+		timeout = defaultSendTimeout
+	}
+	if conn.sendMinBytesPerSecond > 0 {
+		scaled := time.Duration(float64(size) / float64(conn.sendMinBytesPerSecond) * float64(time.Second))
+		if scaled > timeout {
+			timeout = scaled
+		}
+	}
+	return timeout
+}
+
+// connectionAgeBuckets are the labels of the connection age ranges, in the order of connectionAgeBucket.
+var connectionAgeBuckets = []string{"<1m", "1m-10m", "10m-1h", ">1h"}
+
+// connectionAgeBucket returns a coarse age range of a connection, for use as a metric label.
+func connectionAgeBucket(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return connectionAgeBuckets[0]
+	case age < 10*time.Minute:
+		return connectionAgeBuckets[1]
+	case age < time.Hour:
+		return connectionAgeBuckets[2]
+	default:
+		return connectionAgeBuckets[3]
+	}
+}
+
+// responseSizeBucket returns a coarse size range of a response, for use as a metric label.
+func responseSizeBucket(size int) string {
+	switch {
+	case size < 1<<20:
+		return "<1MB"
+	case size < 10<<20:
+		return "1MB-10MB"
+	default:
+		return ">10MB"
+	}
+}
+
+// nextVersion returns the version for the next response of the given type. Each type has its own
+// version stream, tracked in the WatchedResource, so an ACK for one type is not conflated with the
+// versions sent for other types. The push version is kept as a prefix to correlate a response with
+// the push that generated it. The version is not derived from the config kinds in ConfigsUpdated: the
+// config of a proxy also changes with pushes to that proxy only, such as proxy updates, which do not set
+// ConfigsUpdated, so such a version could not tell an unchanged type apart.
+func (conn *Connection) nextVersion(typeURL string, pushVersion string) string {
+	conn.proxy.Lock()
+	defer conn.proxy.Unlock()
+	w := conn.proxy.WatchedResources[typeURL]
+	if w == nil {
+		w = &model.WatchedResource{TypeUrl: typeURL}
+		conn.proxy.WatchedResources[typeURL] = w
+	}
+	w.Updates++
+	return pushVersion + "/" + strconv.Itoa(w.Updates)
+}
+
+// maxPendingVersions bounds the responses of a type remembered until the proxy responds to them.
+const maxPendingVersions = 16
+
+// recordPendingVersion remembers the version of a response sent with the given nonce, until the proxy
+// responds to it. It must be called with the proxy lock held.
+func recordPendingVersion(w *model.WatchedResource, nonce, version string) {
+	if len(w.PendingVersions) == maxPendingVersions {
+		w.PendingVersions = w.PendingVersions[1:]
+	}
+	w.PendingVersions = append(w.PendingVersions, model.NonceVersion{Nonce: nonce, Version: version})
+}
+
+// respondedVersion returns the version of the response of the given type sent with the nonce the proxy
+// responded to, or empty if it is not known. The proxy handles responses in order, so the response and the
+// older ones are forgotten.
+func (conn *Connection) respondedVersion(typeURL, nonce string) string {
+	conn.proxy.Lock()
+	defer conn.proxy.Unlock()
+	w := conn.proxy.WatchedResources[typeURL]
+	if w == nil {
+		return ""
+	}
+	for i, p := range w.PendingVersions {
+		if p.Nonce == nonce {
+			w.PendingVersions = w.PendingVersions[i+1:]
+			return p.Version
+		}
+	}
+	return ""
+}
+
 // nolint
 func (conn *Connection) NonceAcked(typeUrl string) string {
 	conn.proxy.RLock()
@@ -860,6 +2492,35 @@ func (conn *Connection) NonceAcked(typeUrl string) string {
 	return ""
 }
 
+// LastNack returns the last NACK of the type, or nil if the proxy ACKed the last response.
+func (conn *Connection) LastNack(typeURL string) *model.NackDetail {
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	if w := conn.proxy.WatchedResources[typeURL]; w != nil && w.LastNack != nil {
+		nack := *w.LastNack
+		return &nack
+	}
+	return nil
+}
+
+// LastNacks returns the last NACK of each type that was not ACKed since, by short type name.
+func (conn *Connection) LastNacks() map[string]*model.NackDetail {
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	var nacks map[string]*model.NackDetail
+	for typeURL, w := range conn.proxy.WatchedResources {
+		if w.LastNack == nil {
+			continue
+		}
+		if nacks == nil {
+			nacks = map[string]*model.NackDetail{}
+		}
+		nack := *w.LastNack
+		nacks[v3.GetShortType(typeURL)] = &nack
+	}
+	return nacks
+}
+
 // nolint
 func (conn *Connection) NonceSent(typeUrl string) string {
 	conn.proxy.RLock()
@@ -870,22 +2531,140 @@ func (conn *Connection) NonceSent(typeUrl string) string {
 	return ""
 }
 
-func (conn *Connection) Clusters() []string {
+// ResourceNames returns the names of the resources of the type watched by the proxy, or an empty list if
+// it watches all of them or does not watch the type. The list is replaced, not modified, on new requests,
+// and must not be modified by the caller.
+func (conn *Connection) ResourceNames(typeURL string) []string {
 	conn.proxy.RLock()
 	defer conn.proxy.RUnlock()
-	if conn.proxy.WatchedResources != nil && conn.proxy.WatchedResources[v3.EndpointType] != nil {
-		return conn.proxy.WatchedResources[v3.EndpointType].ResourceNames
+	if conn.proxy.WatchedResources != nil && conn.proxy.WatchedResources[typeURL] != nil {
+		return conn.proxy.WatchedResources[typeURL].ResourceNames
 	}
 	return []string{}
 }
 
+// Clusters returns the names of the clusters the proxy watches endpoints for.
+func (conn *Connection) Clusters() []string {
+	return conn.ResourceNames(v3.EndpointType)
+}
+
+// RequestedClusters returns the names of the clusters requested by the proxy, or an empty list if it
+// requested all the clusters.
+func (conn *Connection) RequestedClusters() []string {
+	return conn.ResourceNames(v3.ClusterType)
+}
+
+// Listeners returns the names of the listeners requested by the proxy, or an empty list if it
+// requested all the listeners.
+func (conn *Connection) Listeners() []string {
+	return conn.ResourceNames(v3.ListenerType)
+}
+
+// Routes returns the names of the routes the proxy watches.
 func (conn *Connection) Routes() []string {
+	return conn.ResourceNames(v3.RouteType)
+}
+
+// initialSync returns true while no config of the type has been ACKed by the proxy, which is the case
+// until the initial push of the type completes.
+func (conn *Connection) initialSync(typeURL string) bool {
+	if conn.proxy == nil {
+		return true
+	}
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	w := conn.proxy.WatchedResources[typeURL]
+	return w == nil || w.NonceAcked == ""
+}
+
+// InitialSyncComplete returns true once the proxy has ACKed a response for every type it watches.
+func (conn *Connection) InitialSyncComplete() bool {
 	conn.proxy.RLock()
 	defer conn.proxy.RUnlock()
-	if conn.proxy.WatchedResources != nil && conn.proxy.WatchedResources[v3.RouteType] != nil {
-		return conn.proxy.WatchedResources[v3.RouteType].ResourceNames
+	if len(conn.proxy.WatchedResources) == 0 {
+		return false
+	}
+	for _, w := range conn.proxy.WatchedResources {
+		if w.NonceAcked == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// recordSyncedProxies records the percentage of connected proxies that completed their initial sync.
+func (s *DiscoveryServer) recordSyncedProxies() {
+	s.adsClientsMutex.RLock()
+	total, synced := len(s.adsClients), 0
+	for _, con := range s.adsClients {
+		if con.InitialSyncComplete() {
+			synced++
+		}
+	}
+	s.adsClientsMutex.RUnlock()
+	if total == 0 {
+		syncedProxies.Record(100)
+		return
+	}
+	syncedProxies.Record(100 * float64(synced) / float64(total))
+}
+
+// recordConnectionAges records the number of connections in each age range, and the total number of pushes
+// sent on the current connections. Many young connections with few pushes point to flapping proxies.
+func (s *DiscoveryServer) recordConnectionAges(now time.Time) {
+	ages := make(map[string]int, len(connectionAgeBuckets))
+	var pushes int64
+	s.adsClientsMutex.RLock()
+	for _, con := range s.adsClients {
+		ages[connectionAgeBucket(now.Sub(con.Connect))]++
+		pushes += con.Pushes()
+	}
+	s.adsClientsMutex.RUnlock()
+	for _, bucket := range connectionAgeBuckets {
+		xdsConnectionAges.With(ageTag.Value(bucket)).Record(float64(ages[bucket]))
+	}
+	xdsConnectionPushes.Record(float64(pushes))
+}
+
+// PendingPushes returns the number of pushes enqueued for the connection that did not complete yet. A
+// growing number points to a proxy that does not keep up with the pushes.
+func (conn *Connection) PendingPushes() int {
+	return int(atomic.LoadInt32(&conn.pendingPushes))
+}
+
+// pendingPushesBucket returns a coarse range of a number of pending pushes, for use as a metric label.
+func pendingPushesBucket(pending int) string {
+	switch {
+	case pending == 0:
+		return pendingPushesBuckets[0]
+	case pending == 1:
+		return pendingPushesBuckets[1]
+	case pending <= 10:
+		return pendingPushesBuckets[2]
+	default:
+		return pendingPushesBuckets[3]
 	}
-	return []string{}
+}
+
+// pendingPushesBuckets are the labels of the ranges of pending pushes, in the order of pendingPushesBucket.
+var pendingPushesBuckets = []string{"0", "1", "2-10", ">10"}
+
+// recordPendingPushes records the number of connections in each range of pending pushes.
+func (s *DiscoveryServer) recordPendingPushes() {
+	counts := make(map[string]int, len(pendingPushesBuckets))
+	s.adsClientsMutex.RLock()
+	for _, con := range s.adsClients {
+		counts[pendingPushesBucket(con.PendingPushes())]++
+	}
+	s.adsClientsMutex.RUnlock()
+	for _, bucket := range pendingPushesBuckets {
+		xdsPendingPushes.With(pendingTag.Value(bucket)).Record(float64(counts[bucket]))
+	}
+}
+
+// Pushes returns the number of pushes that sent at least one response on the connection.
+func (conn *Connection) Pushes() int64 {
+	return atomic.LoadInt64(&conn.pushes)
 }
 
 // nolint
@@ -907,3 +2686,34 @@ func (conn *Connection) Watched(typeUrl string) *model.WatchedResource {
 	}
 	return nil
 }
+
+// converged returns true if the proxy has ACKed the last response sent for each of the types it watches.
+func (conn *Connection) converged() bool {
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	if len(conn.proxy.WatchedResources) == 0 {
+		return false
+	}
+	for _, w := range conn.proxy.WatchedResources {
+		if w.NonceSent == "" || w.NonceAcked != w.NonceSent || w.VersionAcked != w.VersionSent {
+			return false
+		}
+	}
+	return true
+}
+
+// checkConverged calls OnConverged if the ACK of the given version made the proxy converge.
+func (s *DiscoveryServer) checkConverged(con *Connection, version string) {
+	if s.OnConverged == nil || !con.converged() {
+		return
+	}
+	// Versions are per type, prefixed by the version of the push that generated them.
+	if i := strings.LastIndex(version, "/"); i >= 0 {
+		version = version[:i]
+	}
+	if version == con.convergedVersion {
+		return
+	}
+	con.convergedVersion = version
+	s.OnConverged(con, version)
+}
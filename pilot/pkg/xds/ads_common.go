@@ -94,6 +94,35 @@ func ProxyNeedsPush(proxy *model.Proxy, pushEv *Event) bool {
 	return false
 }
 
+// endpointIndependentKinds are the config kinds that do not change clusters or their endpoints.
+var endpointIndependentKinds = map[resource.GroupVersionKind]struct{}{
+	gvk.Gateway:               {},
+	gvk.VirtualService:        {},
+	gvk.WorkloadGroup:         {},
+	gvk.AuthorizationPolicy:   {},
+	gvk.RequestAuthentication: {},
+}
+
+// edsUpdatedServicesForFullPush returns the services whose endpoints a full push needs to recompute, or nil
+// if the endpoints of all clusters must be recomputed. Endpoints are scoped to the updated services when
+// they are the only changes that can affect endpoints, in which case the clusters of other services are
+// unchanged too, so the proxy does not need their endpoints to warm them.
+func edsUpdatedServicesForFullPush(pushRequest *model.PushRequest) map[string]struct{} {
+	// The changes are unknown, for example on a mesh config update.
+	if len(pushRequest.ConfigsUpdated) == 0 {
+		return nil
+	}
+	for config := range pushRequest.ConfigsUpdated {
+		if _, f := endpointIndependentKinds[config.Kind]; f {
+			continue
+		}
+		if config.Kind != gvk.ServiceEntry {
+			return nil
+		}
+	}
+	return model.ConfigNamesOfKind(pushRequest.ConfigsUpdated, gvk.ServiceEntry)
+}
+
 type Type int
 
 const (
@@ -360,3 +360,25 @@ func TestCheckConnectionIdentity(t *testing.T) {
 		})
 	}
 }
+
+func TestEdsUpdatedServicesForFullPush(t *testing.T) {
+	se := model.ConfigKey{Kind: gvk.ServiceEntry, Name: "foo.com", Namespace: "default"}
+	vs := model.ConfigKey{Kind: gvk.VirtualService, Name: "vs", Namespace: "default"}
+	dr := model.ConfigKey{Kind: gvk.DestinationRule, Name: "dr", Namespace: "default"}
+	cases := []struct {
+		name     string
+		configs  map[model.ConfigKey]struct{}
+		expected map[string]struct{}
+	}{
+		{"unknown", nil, nil},
+		{"service entry", map[model.ConfigKey]struct{}{se: {}, vs: {}}, map[string]struct{}{"foo.com": {}}},
+		{"no endpoint change", map[model.ConfigKey]struct{}{vs: {}}, map[string]struct{}{}},
+		{"destination rule", map[model.ConfigKey]struct{}{se: {}, dr: {}}, nil},
+	}
+	for _, tt := range cases {
+		got := edsUpdatedServicesForFullPush(&model.PushRequest{Full: true, ConfigsUpdated: tt.configs})
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,1054 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/features"
+	model "istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestConnectionNextVersion(t *testing.T) {
+	con := &Connection{proxy: &model.Proxy{WatchedResources: map[string]*model.WatchedResource{}}}
+
+	if got := con.nextVersion(v3.ClusterType, "v1"); got != "v1/1" {
+		t.Fatalf("expected v1/1, got %v", got)
+	}
+	if got := con.nextVersion(v3.ClusterType, "v1"); got != "v1/2" {
+		t.Fatalf("expected v1/2, got %v", got)
+	}
+	// Each type has an independent version stream.
+	if got := con.nextVersion(v3.ListenerType, "v2"); got != "v2/1" {
+		t.Fatalf("expected v2/1, got %v", got)
+	}
+	if got := con.nextVersion(v3.ClusterType, "v2"); got != "v2/3" {
+		t.Fatalf("expected v2/3, got %v", got)
+	}
+}
+
+func TestRemoveConIdempotent(t *testing.T) {
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}}
+	con := &Connection{
+		ConID: "proxy-1",
+		proxy: &model.Proxy{Metadata: &model.NodeMetadata{}},
+	}
+	s.addCon(con.ConID, con)
+
+	s.removeCon(con)
+	if !con.removed {
+		t.Fatalf("expected connection to be marked removed")
+	}
+	if s.adsClientCount() != 0 {
+		t.Fatalf("expected no connections, got %d", s.adsClientCount())
+	}
+	// A second removal, for example from a concurrent eviction, is a no-op.
+	s.removeCon(con)
+	if s.adsClientCount() != 0 {
+		t.Fatalf("expected no connections, got %d", s.adsClientCount())
+	}
+}
+
+func TestConnectionIDPrefix(t *testing.T) {
+	node := &core.Node{Id: "sidecar~1.1.1.1~pod.namespace~namespace.svc.cluster.local"}
+	proxy := &model.Proxy{ID: "pod.namespace"}
+
+	s := &DiscoveryServer{}
+	if got := s.connectionIDPrefix(node, proxy); got != node.Id {
+		t.Fatalf("expected node ID %v, got %v", node.Id, got)
+	}
+	s.ConnectionIDPrefix = ProxyIDConnectionPrefix
+	if got := s.connectionIDPrefix(node, proxy); got != proxy.ID {
+		t.Fatalf("expected proxy ID %v, got %v", proxy.ID, got)
+	}
+	// IDs stay unique across reconnects, since a counter is always appended.
+	if a, b := connectionID(proxy.ID), connectionID(proxy.ID); a == b {
+		t.Fatalf("expected unique connection IDs, got %v twice", a)
+	}
+}
+
+func TestPauseConnection(t *testing.T) {
+	s := &DiscoveryServer{
+		Env:        &model.Environment{},
+		adsClients: map[string]*Connection{},
+		pushQueue:  NewPushQueue(),
+	}
+	con := &Connection{
+		ConID: "proxy-1",
+		proxy: &model.Proxy{Metadata: &model.NodeMetadata{}},
+	}
+	s.addCon(con.ConID, con)
+
+	if err := s.PauseConnection("unknown", true); err == nil {
+		t.Fatalf("expected error pausing unknown connection")
+	}
+	if err := s.PauseConnection(con.ConID, true); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isPaused(con) {
+		t.Fatalf("expected connection to be paused")
+	}
+	// Pushes are skipped while paused.
+	if err := s.pushConnection(con, &Event{pushRequest: &model.PushRequest{Full: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PauseConnection(con.ConID, false); err != nil {
+		t.Fatal(err)
+	}
+	if s.isPaused(con) {
+		t.Fatalf("expected connection to be resumed")
+	}
+	if pending := s.pushQueue.Pending(); pending != 1 {
+		t.Fatalf("expected a full push to be queued on resume, got %d pending", pending)
+	}
+}
+
+func TestClassifyInitContextError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		reason string
+		code   codes.Code
+	}{
+		{"timeout", fmt.Errorf("list: %w", context.DeadlineExceeded), initContextTimeout, codes.DeadlineExceeded},
+		{"parse", fmt.Errorf("decode: %w", &json.SyntaxError{}), initContextParseError, codes.FailedPrecondition},
+		{"other", errors.New("connection refused"), initContextStoreUnavailable, codes.Unavailable},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, code := classifyInitContextError(tt.err)
+			if reason != tt.reason || code != tt.code {
+				t.Fatalf("expected %v/%v, got %v/%v", tt.reason, tt.code, reason, code)
+			}
+		})
+	}
+}
+
+type contextStream struct {
+	DiscoveryStream
+	ctx context.Context
+}
+
+func (c contextStream) Context() context.Context {
+	return c.ctx
+}
+
+func TestThrottleReconnect(t *testing.T) {
+	s := &DiscoveryServer{}
+	// Without a limiter, reconnects are never throttled.
+	if !s.throttleReconnect(&Connection{}) {
+		t.Fatalf("expected reconnect not to be throttled without a limiter")
+	}
+
+	s.reconnectLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	con := &Connection{ConID: "con", stream: contextStream{ctx: ctx}, stop: make(chan struct{})}
+	if !s.throttleReconnect(con) {
+		t.Fatalf("expected the first reconnect to use the burst")
+	}
+
+	// The burst is used up, so the next reconnects wait until the stream is closed, or the connection stopped.
+	throttled := func(con *Connection) chan bool {
+		done := make(chan bool, 1)
+		go func() {
+			done <- s.throttleReconnect(con)
+		}()
+		select {
+		case <-done:
+			t.Fatalf("expected reconnect to be throttled")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return done
+	}
+	done := throttled(con)
+	cancel()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatalf("expected throttled reconnect to be cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected throttled reconnect to return once the stream is closed")
+	}
+
+	stopped := &Connection{ConID: "stopped", stream: contextStream{ctx: context.Background()}, stop: make(chan struct{})}
+	done = throttled(stopped)
+	stopped.Stop()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatalf("expected throttled reconnect to be cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected throttled reconnect to return once the connection is stopped")
+	}
+}
+
+func TestThrottleReconnectOncePerConnection(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	conn := s.NewReplayConnection(nil)
+	// The connection is set up: no token is left for the types it requests.
+	s.Discovery.reconnectLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	s.Discovery.reconnectLimiter.Allow()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, typeURL := range []string{v3.ClusterType, v3.ListenerType} {
+			conn.Send(&discovery.DiscoveryRequest{TypeUrl: typeURL, VersionInfo: "v1", ResponseNonce: "stale"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the reconnected types not to be throttled again")
+	}
+	if atomic.LoadInt32(&conn.con.reconnected) != 1 {
+		t.Fatalf("expected the connection to be marked as reconnected")
+	}
+}
+
+func TestEdsSubscriptionRestore(t *testing.T) {
+	s := &DiscoveryServer{}
+	con := &Connection{
+		ConID: "proxy-1",
+		proxy: &model.Proxy{
+			ID: "proxy-1.ns",
+			WatchedResources: map[string]*model.WatchedResource{
+				v3.EndpointType: {TypeUrl: v3.EndpointType, ResourceNames: []string{"outbound|80||a.ns.svc.cluster.local"}},
+			},
+		},
+	}
+	s.saveEdsSubscriptionLocked(con)
+
+	if got := s.restoreEdsSubscription("other.ns"); got != nil {
+		t.Fatalf("expected no clusters for another proxy, got %v", got)
+	}
+	if got := s.restoreEdsSubscription("proxy-1.ns"); !reflect.DeepEqual(got, []string{"outbound|80||a.ns.svc.cluster.local"}) {
+		t.Fatalf("unexpected restored clusters: %v", got)
+	}
+	// A subscription is only restored once.
+	if got := s.restoreEdsSubscription("proxy-1.ns"); got != nil {
+		t.Fatalf("expected subscription to be forgotten, got %v", got)
+	}
+
+	// Expired subscriptions are not restored.
+	s.edsSubscriptions["proxy-1.ns"] = edsSubscription{clusters: []string{"c"}, saved: time.Now().Add(-2 * edsSubscriptionTTL)}
+	if got := s.restoreEdsSubscription("proxy-1.ns"); got != nil {
+		t.Fatalf("expected expired subscription to be ignored, got %v", got)
+	}
+}
+
+func TestDrainCohort(t *testing.T) {
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}}
+	newCon := func(id, version string) *Connection {
+		con := newConnection("", nil)
+		con.ConID = id
+		con.proxy = &model.Proxy{Metadata: &model.NodeMetadata{IstioVersion: version}}
+		s.addCon(id, con)
+		return con
+	}
+	old := newCon("old", "1.7.0")
+	current := newCon("current", "1.8.0")
+
+	drained := s.DrainCohort(func(proxy *model.Proxy) bool {
+		return proxy.Metadata.IstioVersion == "1.7.0"
+	}, 0)
+	if !reflect.DeepEqual(drained, []string{"old"}) {
+		t.Fatalf("unexpected drained connections: %v", drained)
+	}
+	select {
+	case <-old.stop:
+	default:
+		t.Fatalf("expected matching connection to be stopped")
+	}
+	select {
+	case <-current.stop:
+		t.Fatalf("expected other connection to stay connected")
+	default:
+	}
+	// Stopping twice is a no-op.
+	old.Stop()
+}
+
+func TestConnectionHealthScore(t *testing.T) {
+	con := &Connection{}
+	if score := con.HealthScore(); score != 100 {
+		t.Fatalf("expected a new connection to be healthy, got %d", score)
+	}
+	con.nacks = 2
+	con.sendTimeouts = 1
+	con.reconnected = 1
+	if score := con.HealthScore(); score != 50 {
+		t.Fatalf("expected score 50, got %d", score)
+	}
+	// The score recovers as the proxy ACKs again.
+	decrementToZero(&con.nacks)
+	if score := con.HealthScore(); score != 60 {
+		t.Fatalf("expected score 60, got %d", score)
+	}
+	con.sendTimeouts = 10
+	if score := con.HealthScore(); score != 0 {
+		t.Fatalf("expected score to be floored at 0, got %d", score)
+	}
+	con.nacks = 0
+	decrementToZero(&con.nacks)
+	if con.nacks != 0 {
+		t.Fatalf("expected counter to stay at 0, got %d", con.nacks)
+	}
+}
+
+func TestProxyLocalitySource(t *testing.T) {
+	registryInstance := []*model.ServiceInstance{{Endpoint: &model.IstioEndpoint{Locality: model.Locality{Label: "region/zone"}}}}
+	cases := []struct {
+		name   string
+		proxy  *model.Proxy
+		source string
+	}{
+		{"none", &model.Proxy{}, localitySourceNone},
+		{"registry", &model.Proxy{
+			Locality:         &core.Locality{Region: "region", Zone: "zone"},
+			ServiceInstances: registryInstance,
+		}, localitySourceRegistry},
+		{"node", &model.Proxy{Locality: &core.Locality{Region: "other"}}, localitySourceNode},
+		{"node overrides empty registry", &model.Proxy{
+			Locality:         &core.Locality{Region: "other"},
+			ServiceInstances: []*model.ServiceInstance{{Endpoint: &model.IstioEndpoint{}}},
+		}, localitySourceNode},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyLocalitySource(tt.proxy); got != tt.source {
+				t.Fatalf("expected %v, got %v", tt.source, got)
+			}
+		})
+	}
+}
+
+func TestInitialSyncComplete(t *testing.T) {
+	con := &Connection{proxy: &model.Proxy{WatchedResources: map[string]*model.WatchedResource{}}}
+	if con.InitialSyncComplete() {
+		t.Fatalf("expected a proxy watching nothing not to be synced")
+	}
+	con.proxy.WatchedResources[v3.ClusterType] = &model.WatchedResource{TypeUrl: v3.ClusterType, NonceAcked: "n1"}
+	con.proxy.WatchedResources[v3.EndpointType] = &model.WatchedResource{TypeUrl: v3.EndpointType}
+	if con.InitialSyncComplete() {
+		t.Fatalf("expected proxy not to be synced until every type is ACKed")
+	}
+	con.proxy.WatchedResources[v3.EndpointType].NonceAcked = "n2"
+	if !con.InitialSyncComplete() {
+		t.Fatalf("expected proxy to be synced")
+	}
+}
+
+func TestIsolateGenerationError(t *testing.T) {
+	s := &DiscoveryServer{}
+	con := &Connection{ConID: "con", proxy: &model.Proxy{WatchedResources: map[string]*model.WatchedResource{
+		v3.ListenerType: {TypeUrl: v3.ListenerType},
+	}}}
+	failing := func() error {
+		panic("bad config")
+	}
+	sendErr := errors.New("send failed")
+
+	old := features.IsolateGenerationErrors
+	defer func() { features.IsolateGenerationErrors = old }()
+	features.IsolateGenerationErrors = true
+
+	if err := s.isolateGenerationError(con, v3.ListenerType, failing); err != nil {
+		t.Fatalf("expected generation failure to be isolated, got %v", err)
+	}
+	if got := con.Watched(v3.ListenerType).GenerationError; got != "bad config" {
+		t.Fatalf("expected generation error to be recorded, got %q", got)
+	}
+	// Send errors still close the stream.
+	if err := s.isolateGenerationError(con, v3.ListenerType, func() error { return sendErr }); err != sendErr {
+		t.Fatalf("expected send error to be returned, got %v", err)
+	}
+}
+
+func TestPushCircuitBreaker(t *testing.T) {
+	old := features.PushCircuitBreakerThreshold
+	defer func() { features.PushCircuitBreakerThreshold = old }()
+	features.PushCircuitBreakerThreshold = 2
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	con := s.NewReplayConnection(nil)
+	con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+	con.con.interceptor = fakeInterceptor(func(*Connection, *discovery.DiscoveryResponse) (*discovery.DiscoveryResponse, error) {
+		return nil, errors.New("send failed")
+	})
+	for i := 0; i < features.PushCircuitBreakerThreshold; i++ {
+		err := s.Discovery.pushConnection(con.con, &Event{pushRequest: &model.PushRequest{Full: true, Push: s.PushContext()}})
+		if err == nil {
+			t.Fatalf("expected push %d to fail", i)
+		}
+		if closeStream, st := s.Discovery.handlePushFailure(con.con, err); closeStream {
+			t.Fatalf("expected push %d to keep the connection, got %v", i, st)
+		}
+	}
+	if !con.con.pushCircuitOpen() {
+		t.Fatalf("expected breaker to open after consecutive failures")
+	}
+
+	// Pushes are skipped while the breaker is open, even once the connection recovered.
+	con.con.interceptor = nil
+	if pushed := con.Push(nil); len(pushed) != 0 {
+		t.Fatalf("expected pushes to be skipped while the breaker is open, got %d responses", len(pushed))
+	}
+	if con.con.breakerSkipped == nil {
+		t.Fatalf("expected the skipped push to be recorded")
+	}
+
+	// Once the cooldown has passed, pushes are tried again, and a success closes the breaker.
+	con.con.breakerOpenedAt = time.Now().Add(-2 * features.PushCircuitBreakerCooldown).UnixNano()
+	if pushed := con.Push(nil); len(pushed) != 1 {
+		t.Fatalf("expected a push after the cooldown, got %d responses", len(pushed))
+	}
+	if con.con.pushCircuitOpen() || atomic.LoadInt32(&con.con.pushFailures) != 0 {
+		t.Fatalf("expected the breaker to close after a successful push")
+	}
+
+	// A send timeout closes the stream, since the timed out send may still be running.
+	closeStream, st := s.Discovery.handlePushFailure(con.con,
+		&pushError{typeURL: v3.ClusterType, err: status.Error(codes.DeadlineExceeded, "timeout sending")})
+	if !closeStream || status.Code(st) != codes.DeadlineExceeded {
+		t.Fatalf("expected the stream to be closed after a send timeout, got %v %v", closeStream, st)
+	}
+
+	// Without a threshold, a failed push closes the stream.
+	features.PushCircuitBreakerThreshold = 0
+	closeStream, st = s.Discovery.handlePushFailure(con.con, &pushError{typeURL: v3.ClusterType, err: errors.New("failed")})
+	if !closeStream || status.Code(st) != codes.Internal {
+		t.Fatalf("expected the stream to be closed with Internal, got %v %v", closeStream, st)
+	}
+}
+
+func TestResumeSkippedPushes(t *testing.T) {
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}, pushQueue: NewPushQueue()}
+	con := &Connection{ConID: "con"}
+	con.skipPush(&model.PushRequest{Full: false, Reason: []model.TriggerReason{model.EndpointUpdate}})
+	con.skipPush(&model.PushRequest{Full: true, Reason: []model.TriggerReason{model.ConfigUpdate}})
+
+	s.resumeSkippedPushes(con)
+	if pending := s.pushQueue.Pending(); pending != 1 {
+		t.Fatalf("expected the skipped pushes to be enqueued once, got %d pending", pending)
+	}
+	if req := s.pushQueue.pending[con]; !req.Full || len(req.Reason) != 2 {
+		t.Fatalf("expected the skipped pushes to be merged, got %+v", req)
+	}
+	if con.breakerSkipped != nil {
+		t.Fatalf("expected the skipped pushes to be cleared")
+	}
+	// Nothing is enqueued again, nor for removed connections.
+	s.resumeSkippedPushes(con)
+	removed := &Connection{ConID: "removed", removed: true}
+	removed.skipPush(&model.PushRequest{Full: true})
+	s.resumeSkippedPushes(removed)
+	if pending := s.pushQueue.Pending(); pending != 1 {
+		t.Fatalf("expected no other push to be enqueued, got %d pending", pending)
+	}
+}
+
+func TestRecordEdsTrigger(t *testing.T) {
+	con := &Connection{proxy: &model.Proxy{}}
+	if con.LastEdsTrigger() != nil {
+		t.Fatalf("expected no trigger recorded")
+	}
+	con.recordEdsTrigger(map[string]struct{}{"c.ns": {}, "a.ns": {}, "b.ns": {}}, 2)
+	trigger := con.LastEdsTrigger()
+	if !reflect.DeepEqual(trigger.Services, []string{"a.ns", "b.ns"}) || !trigger.Truncated {
+		t.Fatalf("unexpected trigger: %+v", trigger)
+	}
+}
+
+func TestConnectionLifetime(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if got := connectionLifetime(time.Hour); got < time.Hour || got > time.Hour+6*time.Minute {
+			t.Fatalf("expected lifetime within 10%% of an hour, got %v", got)
+		}
+	}
+}
+
+func TestProxyGenerator(t *testing.T) {
+	cases := []struct {
+		name     string
+		proxy    *model.Proxy
+		resolved string
+		unknown  string
+	}{
+		{"none requested", &model.Proxy{Metadata: &model.NodeMetadata{}}, defaultGenerator, ""},
+		{"registered", &model.Proxy{
+			Metadata:             &model.NodeMetadata{Generator: "api"},
+			XdsResourceGenerator: &InternalGen{},
+		}, "api", ""},
+		{"unknown", &model.Proxy{Metadata: &model.NodeMetadata{Generator: "missing"}}, defaultGenerator, "missing"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, unknown := proxyGenerator(tt.proxy)
+			if resolved != tt.resolved || unknown != tt.unknown {
+				t.Fatalf("expected (%q, %q), got (%q, %q)", tt.resolved, tt.unknown, resolved, unknown)
+			}
+		})
+	}
+}
+
+func TestPushToSelector(t *testing.T) {
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}, pushQueue: NewPushQueue()}
+	newCon := func(id string, labels map[string]string) {
+		con := newConnection("", nil)
+		con.ConID = id
+		con.proxy = &model.Proxy{Metadata: &model.NodeMetadata{Labels: labels}}
+		s.addCon(id, con)
+	}
+	newCon("v1", map[string]string{"app": "reviews", "version": "v1"})
+	newCon("v2", map[string]string{"app": "reviews", "version": "v2"})
+	newCon("other", map[string]string{"app": "ratings"})
+	done := s.pushGeneration(false)
+
+	if n := s.PushToSelector(nil, &model.PushRequest{Full: true}); n != 0 {
+		t.Fatalf("expected an empty selector to match nothing, got %d", n)
+	}
+	if n := s.PushToSelector(map[string]string{"app": "reviews"}, &model.PushRequest{Full: true}); n != 2 {
+		t.Fatalf("expected 2 matching connections, got %d", n)
+	}
+	if n := s.PushToSelector(map[string]string{"app": "reviews", "version": "v2"}, &model.PushRequest{Full: true}); n != 1 {
+		t.Fatalf("expected 1 matching connection, got %d", n)
+	}
+	if pending := s.pushQueue.Pending(); pending != 2 {
+		t.Fatalf("expected pushes to be enqueued for the 2 matching connections, got %d", pending)
+	}
+	select {
+	case <-done:
+		t.Fatal("a push to a selector must not cancel the batches of a full push")
+	default:
+	}
+}
+
+func TestPushToSelectorNotBatched(t *testing.T) {
+	defer func(fleetSize, batchSize int, interval time.Duration) {
+		features.PushBatchFleetSize = fleetSize
+		features.PushBatchSize = batchSize
+		features.PushBatchInterval = interval
+	}(features.PushBatchFleetSize, features.PushBatchSize, features.PushBatchInterval)
+	features.PushBatchFleetSize = 1
+	features.PushBatchSize = 1
+	features.PushBatchInterval = time.Hour
+
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}, pushQueue: NewPushQueue()}
+	for _, id := range []string{"a", "b", "c"} {
+		con := newConnection("", nil)
+		con.ConID = id
+		con.proxy = &model.Proxy{Metadata: &model.NodeMetadata{Labels: map[string]string{"app": "reviews"}}}
+		s.addCon(id, con)
+	}
+	if n := s.PushToSelector(map[string]string{"app": "reviews"}, &model.PushRequest{Full: true}); n != 3 {
+		t.Fatalf("expected 3 matching connections, got %d", n)
+	}
+	if pending := s.pushQueue.Pending(); pending != 3 {
+		t.Fatalf("expected all matching connections to be enqueued at once, got %d", pending)
+	}
+}
+
+func TestUntrustedConnectionTypes(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	con := newConnection("", &fakeStream{})
+	con.ConID = "untrusted"
+	con.Untrusted = true
+	con.proxy = &model.Proxy{Metadata: &model.NodeMetadata{}, WatchedResources: map[string]*model.WatchedResource{}}
+	err := s.Discovery.processRequest(&discovery.DiscoveryRequest{TypeUrl: "istio.io/debug/syncz"}, con)
+	if got := status.Code(err); got != codes.PermissionDenied {
+		t.Fatalf("expected a custom type to be denied for an untrusted connection, got %v", err)
+	}
+}
+
+func TestPushRemovedConnection(t *testing.T) {
+	s := &DiscoveryServer{Env: &model.Environment{}, adsClients: map[string]*Connection{}, pushQueue: NewPushQueue()}
+	con := &Connection{ConID: "proxy-1", proxy: &model.Proxy{Metadata: &model.NodeMetadata{}}}
+	s.addCon(con.ConID, con)
+	s.removeCon(con)
+
+	// The push is skipped before updating the proxy, which would fail without a push context.
+	if err := s.pushConnection(con, &Event{pushRequest: &model.PushRequest{Full: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isRemoved(con) {
+		t.Fatalf("expected the connection to be removed")
+	}
+}
+
+func TestSendDeadline(t *testing.T) {
+	con := &Connection{}
+	if got := con.sendDeadline(100 << 20); got != defaultSendTimeout {
+		t.Fatalf("expected the default timeout, got %v", got)
+	}
+	con = &Connection{sendTimeout: 5 * time.Second, sendMinBytesPerSecond: 1 << 20}
+	cases := []struct {
+		size    int
+		timeout time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1 << 20, 5 * time.Second},
+		{40 << 20, 40 * time.Second},
+	}
+	for _, tt := range cases {
+		if got := con.sendDeadline(tt.size); got != tt.timeout {
+			t.Errorf("size %d: expected timeout %v, got %v", tt.size, tt.timeout, got)
+		}
+	}
+	if got := responseSizeBucket(40 << 20); got != ">10MB" {
+		t.Fatalf("expected the largest size bucket, got %q", got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}}
+	newCon := func(id string) *Connection {
+		con := newConnection("", nil)
+		con.ConID = id
+		con.proxy = &model.Proxy{Metadata: &model.NodeMetadata{}}
+		s.addCon(id, con)
+		return con
+	}
+	closing := newCon("closing")
+	newCon("stuck")
+	go func() {
+		<-closing.stop
+		s.removeCon(closing)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	drained, remaining := s.Drain(ctx)
+	if drained != 1 || !reflect.DeepEqual(remaining, []string{"stuck"}) {
+		t.Fatalf("expected one drained and one remaining connection, got %d %v", drained, remaining)
+	}
+	if !s.draining.Load() {
+		t.Fatalf("expected the server to reject new connections")
+	}
+}
+
+func TestAcquireStream(t *testing.T) {
+	s := &DiscoveryServer{}
+	if !s.acquireStream(2) || !s.acquireStream(2) {
+		t.Fatalf("expected streams within the limit to be accepted")
+	}
+	if s.acquireStream(2) {
+		t.Fatalf("expected the stream over the limit to be rejected")
+	}
+	if s.streams.Load() != 2 {
+		t.Fatalf("expected the rejected stream to release its slot, got %d streams", s.streams.Load())
+	}
+	s.streams.Dec()
+	if !s.acquireStream(2) {
+		t.Fatalf("expected a stream to be accepted once another closed")
+	}
+	if !s.acquireStream(0) {
+		t.Fatalf("expected no limit when the max is 0")
+	}
+}
+
+func TestConnectionAgeBucket(t *testing.T) {
+	cases := map[time.Duration]string{
+		0:                "<1m",
+		time.Minute:      "1m-10m",
+		30 * time.Minute: "10m-1h",
+		2 * time.Hour:    ">1h",
+	}
+	for age, expected := range cases {
+		if got := connectionAgeBucket(age); got != expected {
+			t.Errorf("connectionAgeBucket(%v): expected %q, got %q", age, expected, got)
+		}
+	}
+	con := newConnection("10.0.0.1:1234", nil)
+	atomic.AddInt64(&con.pushes, 2)
+	if got := con.Pushes(); got != 2 {
+		t.Errorf("expected 2 pushes, got %d", got)
+	}
+}
+
+func TestConnectionSupports(t *testing.T) {
+	con := newConnection("10.0.0.1:1234", nil)
+	con.capabilities = xdsCapabilities(nil)
+	if !con.supports(v3.RouteType) {
+		t.Fatalf("expected all types to be supported without capabilities")
+	}
+	con.capabilities = xdsCapabilities([]string{"cds", " LDS", "istio.io/debug/syncz"})
+	for typeURL, expected := range map[string]bool{
+		v3.ClusterType:         true,
+		v3.ListenerType:        true,
+		"istio.io/debug/syncz": true,
+		v3.RouteType:           false,
+		v3.EndpointType:        false,
+	} {
+		if got := con.supports(typeURL); got != expected {
+			t.Errorf("supports(%v): expected %v, got %v", typeURL, expected, got)
+		}
+	}
+}
+
+func TestNotReadyBackoff(t *testing.T) {
+	cases := map[time.Duration]time.Duration{
+		0:                time.Second,
+		9 * time.Second:  time.Second,
+		10 * time.Second: 2 * time.Second,
+		35 * time.Second: 8 * time.Second,
+		time.Hour:        30 * time.Second,
+	}
+	for unready, expected := range cases {
+		if got := notReadyBackoff(unready); got != expected {
+			t.Errorf("notReadyBackoff(%v): expected %v, got %v", unready, expected, got)
+		}
+	}
+
+	st := status.Convert(notReadyError(2 * time.Second))
+	if st.Code() != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", st.Code())
+	}
+	if len(st.Details()) != 1 {
+		t.Fatalf("expected a RetryInfo detail, got %v", st.Details())
+	}
+	info, ok := st.Details()[0].(*errdetails.RetryInfo)
+	if !ok {
+		t.Fatalf("expected a RetryInfo detail, got %T", st.Details()[0])
+	}
+	if got, _ := ptypes.Duration(info.RetryDelay); got != 2*time.Second {
+		t.Fatalf("expected a retry delay of 2s, got %v", got)
+	}
+}
+
+type fakeInterceptor func(*Connection, *discovery.DiscoveryResponse) (*discovery.DiscoveryResponse, error)
+
+func (f fakeInterceptor) Intercept(con *Connection, res *discovery.DiscoveryResponse) (*discovery.DiscoveryResponse, error) {
+	return f(con, res)
+}
+
+func TestResponseInterceptor(t *testing.T) {
+	con := newConnection("10.0.0.1:1234", nil)
+	var sent *discovery.DiscoveryResponse
+	con.capture = func(res *discovery.DiscoveryResponse) { sent = res }
+	con.interceptor = fakeInterceptor(func(_ *Connection, res *discovery.DiscoveryResponse) (*discovery.DiscoveryResponse, error) {
+		if res.TypeUrl == v3.RouteType {
+			return nil, errors.New("routes are not allowed")
+		}
+		return &discovery.DiscoveryResponse{TypeUrl: res.TypeUrl, VersionInfo: "intercepted"}, nil
+	})
+
+	if err := con.send(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, VersionInfo: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if sent == nil || sent.VersionInfo != "intercepted" {
+		t.Fatalf("expected the intercepted response to be sent, got %v", sent)
+	}
+	sent = nil
+	if err := con.send(&discovery.DiscoveryResponse{TypeUrl: v3.RouteType}); err == nil || sent != nil {
+		t.Fatalf("expected the send to be aborted, got %v, sent %v", err, sent)
+	}
+}
+
+func TestSendOversizedResponse(t *testing.T) {
+	old := features.XDSMaxResponseBytes
+	defer func() { features.XDSMaxResponseBytes = old }()
+	features.XDSMaxResponseBytes = 10
+
+	con := newConnection("10.0.0.1:1234", nil)
+	res := &discovery.DiscoveryResponse{
+		TypeUrl:   v3.ClusterType,
+		Resources: []*any.Any{{Value: make([]byte, 6)}, {Value: make([]byte, 6)}},
+	}
+	err := con.send(res)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the response to be rejected, got %v", err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}}
+	con := newConnection("10.0.0.1:1234", nil)
+	con.ConID = "con"
+	s.adsClients[con.ConID] = con
+
+	if err := s.Disconnect("con"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-con.stop:
+	default:
+		t.Fatalf("expected the connection to be stopped")
+	}
+	if got := status.Code(con.stopStatus.Err()); got != codes.Aborted {
+		t.Fatalf("expected the stream to be closed with Aborted, got %v", got)
+	}
+	// Stopping again, for example while draining, keeps the first status.
+	con.Stop()
+	if got := status.Code(con.stopStatus.Err()); got != codes.Aborted {
+		t.Fatalf("expected the first status to be kept, got %v", got)
+	}
+	if err := s.Disconnect("missing"); err == nil {
+		t.Fatalf("expected an error for a missing connection")
+	}
+}
+
+func TestConnectionRespondedVersion(t *testing.T) {
+	con := &Connection{proxy: &model.Proxy{WatchedResources: map[string]*model.WatchedResource{}}}
+	if got := con.respondedVersion(v3.ClusterType, "nonce-1"); got != "" {
+		t.Fatalf("expected no version before a response is sent, got %q", got)
+	}
+	w := &model.WatchedResource{TypeUrl: v3.ClusterType}
+	con.proxy.WatchedResources[v3.ClusterType] = w
+	for i := 1; i <= 3; i++ {
+		recordPendingVersion(w, fmt.Sprintf("nonce-%d", i), con.nextVersion(v3.ClusterType, "push"))
+	}
+	// A NACK for an older response reports its version, not the version of the last response.
+	if got := con.respondedVersion(v3.ClusterType, "nonce-2"); got != "push/2" {
+		t.Fatalf("expected the version of the responded nonce, got %q", got)
+	}
+	if got := con.respondedVersion(v3.ClusterType, "nonce-1"); got != "" {
+		t.Fatalf("expected older responses to be forgotten, got %q", got)
+	}
+	if got := con.respondedVersion(v3.ClusterType, "nonce-3"); got != "push/3" {
+		t.Fatalf("expected the version of the last response, got %q", got)
+	}
+
+	for i := 0; i < maxPendingVersions+1; i++ {
+		recordPendingVersion(w, fmt.Sprintf("bounded-%d", i), "version")
+	}
+	if len(w.PendingVersions) != maxPendingVersions {
+		t.Fatalf("expected %d pending versions, got %d", maxPendingVersions, len(w.PendingVersions))
+	}
+}
+
+func TestAddedResourceNames(t *testing.T) {
+	cases := []struct {
+		previous, current, expected []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b", "c"}, []string{"c"}},
+		{[]string{"a", "b"}, []string{"b"}, nil},
+		{[]string{"a"}, []string{"b", "c"}, []string{"b", "c"}},
+		{nil, []string{"a"}, []string{"a"}},
+	}
+	for _, tt := range cases {
+		if got := addedResourceNames(tt.previous, tt.current); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("addedResourceNames(%v, %v): expected %v, got %v", tt.previous, tt.current, tt.expected, got)
+		}
+	}
+}
+
+func TestNewRequestLimiter(t *testing.T) {
+	if l := newRequestLimiter(0, 10); l != nil {
+		t.Fatalf("expected no limiter by default")
+	}
+	l := newRequestLimiter(1, 2)
+	if !l.Allow() || !l.Allow() {
+		t.Fatalf("expected the burst to be allowed")
+	}
+	if l.Allow() {
+		t.Fatalf("expected requests beyond the burst to be limited")
+	}
+}
+
+func TestPushFailureStatus(t *testing.T) {
+	con := &Connection{ConID: "con"}
+	cases := []struct {
+		name     string
+		err      error
+		expected codes.Code
+	}{
+		{"generation", &pushError{typeURL: v3.ClusterType, err: errors.New("bad config")}, codes.Internal},
+		{"status", &pushError{typeURL: v3.EndpointType, err: status.Error(codes.ResourceExhausted, "too big")}, codes.ResourceExhausted},
+		{"closed", &pushError{typeURL: v3.ListenerType, err: status.Error(codes.Canceled, "closed")}, codes.OK},
+		{"canceled", context.Canceled, codes.OK},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(pushFailureStatus(con, tt.err)); got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+	if err := pushFailureStatus(con, &pushError{typeURL: v3.RouteType, err: errors.New("failed")}); !strings.Contains(err.Error(), "RDS") {
+		t.Fatalf("expected the status to name the type, got %v", err)
+	}
+}
+
+func TestConnectionResourceNames(t *testing.T) {
+	con := newConnection("10.0.0.1:1234", nil)
+	con.proxy = &model.Proxy{WatchedResources: map[string]*model.WatchedResource{
+		v3.ListenerType: {TypeUrl: v3.ListenerType, ResourceNames: []string{"l"}},
+		v3.ClusterType:  {TypeUrl: v3.ClusterType, ResourceNames: []string{"c"}},
+		v3.EndpointType: {TypeUrl: v3.EndpointType, ResourceNames: []string{"e"}},
+		v3.RouteType:    {TypeUrl: v3.RouteType, ResourceNames: []string{"r"}},
+	}}
+	cases := map[string][]string{
+		"listeners":         con.Listeners(),
+		"requestedClusters": con.RequestedClusters(),
+		"clusters":          con.Clusters(),
+		"routes":            con.Routes(),
+		"unwatched":         con.ResourceNames("type.googleapis.com/unwatched"),
+	}
+	expected := map[string][]string{
+		"listeners":         {"l"},
+		"requestedClusters": {"c"},
+		"clusters":          {"e"},
+		"routes":            {"r"},
+		"unwatched":         {},
+	}
+	for name, got := range cases {
+		if !reflect.DeepEqual(got, expected[name]) {
+			t.Errorf("%s: expected %v, got %v", name, expected[name], got)
+		}
+	}
+}
+
+func TestCheckConverged(t *testing.T) {
+	var converged []string
+	s := &DiscoveryServer{OnConverged: func(con *Connection, version string) {
+		converged = append(converged, version)
+	}}
+	con := &Connection{proxy: &model.Proxy{WatchedResources: map[string]*model.WatchedResource{
+		v3.ClusterType:  {NonceSent: "c1", VersionSent: "push/1", NonceAcked: "c1", VersionAcked: "push/1"},
+		v3.ListenerType: {NonceSent: "l1", VersionSent: "push/1"},
+	}}}
+
+	s.checkConverged(con, "push/1")
+	if len(converged) != 0 {
+		t.Fatalf("expected no convergence while LDS is not ACKed, got %v", converged)
+	}
+	con.proxy.WatchedResources[v3.ListenerType].NonceAcked = "l1"
+	con.proxy.WatchedResources[v3.ListenerType].VersionAcked = "push/1"
+	s.checkConverged(con, "push/1")
+	s.checkConverged(con, "push/1")
+	if !reflect.DeepEqual(converged, []string{"push"}) {
+		t.Fatalf("expected a single convergence on push, got %v", converged)
+	}
+}
+
+func TestMalformedNodeError(t *testing.T) {
+	cases := map[string]string{
+		"sidecar~10.0.0.1~foo":                          malformedNodeMissingParts,
+		"unknown~10.0.0.1~foo~default.svc":              malformedNodeInvalidType,
+		"sidecar~not-an-ip~foo~default.svc":             malformedNodeNoIPAddress,
+		strings.Repeat("x", 2*maxMalformedNodeIDLength): malformedNodeMissingParts,
+	}
+	for id, expected := range cases {
+		_, err := model.ParseServiceNodeWithMetadata(id, &model.NodeMetadata{})
+		e := newMalformedNodeError(id, err)
+		if e.reason != expected {
+			t.Errorf("%q: expected reason %s, got %s", id, expected, e.reason)
+		}
+		if len(e.id) > maxMalformedNodeIDLength+len("...") {
+			t.Errorf("%q: expected the node ID to be truncated, got %d bytes", id, len(e.id))
+		}
+		st := rejectMalformedNode("10.0.0.1:1234", e)
+		if status.Code(st) != codes.InvalidArgument || !strings.Contains(st.Error(), expected) {
+			t.Errorf("%q: expected an InvalidArgument status with the reason, got %v", id, st)
+		}
+	}
+}
+
+func TestSetGeneratorUnknown(t *testing.T) {
+	old := features.UnknownGeneratorPolicy
+	defer func() { features.UnknownGeneratorPolicy = old }()
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	newProxy := func() *model.Proxy {
+		return &model.Proxy{ID: "test", Metadata: &model.NodeMetadata{Generator: "missing"}}
+	}
+
+	features.UnknownGeneratorPolicy = unknownGeneratorFallback
+	proxy := newProxy()
+	if err := s.Discovery.setGenerator(&Connection{}, proxy); err != nil || proxy.XdsResourceGenerator != nil {
+		t.Fatalf("expected the built-in handlers, got %v, %v", proxy.XdsResourceGenerator, err)
+	}
+
+	features.UnknownGeneratorPolicy = unknownGeneratorReject
+	if err := s.Discovery.setGenerator(&Connection{}, newProxy()); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an InvalidArgument status, got %v", err)
+	}
+	if err := s.Discovery.setGenerator(&Connection{Untrusted: true}, newProxy()); err != nil {
+		t.Fatalf("expected untrusted connections to use the built-in handlers, got %v", err)
+	}
+}
+
+func TestLatestConnections(t *testing.T) {
+	now := time.Now()
+	stale := &Connection{ConID: "sidecar~10.0.0.1~a.ns~ns.svc.cluster.local-1", Connect: now.Add(-time.Minute)}
+	current := &Connection{ConID: "sidecar~10.0.0.1~a.ns~ns.svc.cluster.local-5", Connect: now}
+	other := &Connection{ConID: "sidecar~10.0.0.2~b.ns~ns.svc.cluster.local-3", Connect: now.Add(-time.Hour)}
+
+	got := latestConnections([]*Connection{stale, other, current})
+	ids := make([]string, 0, len(got))
+	for _, con := range got {
+		ids = append(ids, con.ConID)
+	}
+	if !reflect.DeepEqual(ids, []string{other.ConID, current.ConID}) {
+		t.Fatalf("expected the most recent connection of each proxy in order, got %v", ids)
+	}
+}
+
+func TestFirstPushTime(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	con := s.NewReplayConnection(nil)
+	con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+	first := con.con.firstPush[v3.ClusterType]
+	if first <= 0 {
+		t.Fatalf("expected the time to the first CDS response to be recorded, got %v", first)
+	}
+	con.Push(nil)
+	if got := con.con.firstPush[v3.ClusterType]; got != first {
+		t.Fatalf("expected the time to the first CDS response to be kept, got %v", got)
+	}
+	if _, f := con.con.firstPush[v3.ListenerType]; f {
+		t.Fatalf("expected no LDS push time before LDS is sent")
+	}
+}
+
+func TestConnectionPushLimit(t *testing.T) {
+	con := &Connection{}
+	if !con.acquirePush(1) {
+		t.Fatalf("expected first push to be allowed")
+	}
+	if con.acquirePush(1) {
+		t.Fatalf("expected overlapping push to be rejected")
+	}
+	con.releasePush()
+	if !con.acquirePush(1) {
+		t.Fatalf("expected push to be allowed after the previous one is done")
+	}
+	// A limit of 0 disables the check.
+	if !con.acquirePush(0) {
+		t.Fatalf("expected push to be allowed without a limit")
+	}
+}
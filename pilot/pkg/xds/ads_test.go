@@ -21,10 +21,13 @@ import (
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/status"
 
 	mesh "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/util/sets"
 	"istio.io/istio/pilot/pkg/xds"
@@ -198,6 +201,113 @@ func TestInternalEvents(t *testing.T) {
 
 }
 
+func TestReplayAckNack(t *testing.T) {
+	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	con := s.NewReplayConnection(nil)
+
+	responses := con.Replay([]*discovery.DiscoveryRequest{
+		// Initial request.
+		{TypeUrl: v3.ClusterType},
+		// ACK of the initial response.
+		{TypeUrl: v3.ClusterType, ResponseNonce: xds.ReplayLastNonce, VersionInfo: xds.ReplayLastNonce},
+		// NACK of the initial response.
+		{TypeUrl: v3.ClusterType, ResponseNonce: xds.ReplayLastNonce, ErrorDetail: &status.Status{Message: "rejected"}},
+		// Expired nonce.
+		{TypeUrl: v3.ClusterType, ResponseNonce: "stale"},
+	})
+	for i, expected := range []int{1, 0, 0, 0} {
+		if len(responses[i]) != expected {
+			t.Errorf("request %d: expected %d responses, got %d", i, expected, len(responses[i]))
+		}
+	}
+}
+
+func TestReplayPush(t *testing.T) {
+	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	con := s.NewReplayConnection(nil)
+	con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+
+	// A push before the initial response is ACKed is still sent.
+	pushed := con.Push(nil)
+	if len(pushed) != 1 || pushed[0].TypeUrl != v3.ClusterType {
+		t.Fatalf("expected a CDS push, got %v", pushed)
+	}
+	// The ACK of the pushed response does not trigger another response.
+	if ack := con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType,
+		ResponseNonce: xds.ReplayLastNonce, VersionInfo: xds.ReplayLastNonce}); len(ack) != 0 {
+		t.Fatalf("expected no response to the ACK, got %d", len(ack))
+	}
+}
+
+func TestFastInitialLdsReconnect(t *testing.T) {
+	defer func(old bool) { features.EnableFastInitialLds = old }(features.EnableFastInitialLds)
+	features.EnableFastInitialLds = true
+	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+
+	// A new proxy gets an empty placeholder, and the listeners follow in a full push.
+	initial := s.NewReplayConnection(nil).Send(&discovery.DiscoveryRequest{TypeUrl: v3.ListenerType})
+	if len(initial) != 1 || len(initial[0].Resources) != 0 {
+		t.Fatalf("expected an empty placeholder for a new proxy, got %v", initial)
+	}
+
+	// A proxy reconnecting with the version it last received keeps its listeners.
+	reconnect := s.NewReplayConnection(nil).Send(&discovery.DiscoveryRequest{TypeUrl: v3.ListenerType, VersionInfo: "v1"})
+	if len(reconnect) != 1 || len(reconnect[0].Resources) == 0 {
+		t.Fatalf("expected the listeners for a reconnecting proxy, got %v", reconnect)
+	}
+
+	// So does a proxy reconnecting with the state of another type.
+	con := s.NewReplayConnection(nil)
+	con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "v1"})
+	if lds := con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ListenerType}); len(lds) != 1 || len(lds[0].Resources) == 0 {
+		t.Fatalf("expected the listeners for a proxy reconnecting with CDS state, got %v", lds)
+	}
+}
+
+func TestDryRunPush(t *testing.T) {
+	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	con := s.NewReplayConnection(nil)
+	initial := con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+	if len(initial) != 1 {
+		t.Fatalf("expected an initial CDS response, got %d", len(initial))
+	}
+
+	plan, err := s.Discovery.DryRunPush(con.ID(), &model.PushRequest{Full: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.NeedsPush || len(plan.Responses) != 1 || plan.Responses[0].TypeURL != v3.ClusterType {
+		t.Fatalf("expected a plan with a single CDS response, got %+v", plan)
+	}
+	if plan.Responses[0].Resources != len(initial[0].Resources) {
+		t.Fatalf("expected %d clusters, got %d", len(initial[0].Resources), plan.Responses[0].Resources)
+	}
+
+	if _, err := s.Discovery.DryRunPush("unknown", &model.PushRequest{Full: true}); err == nil {
+		t.Fatalf("expected an error for an unknown connection")
+	}
+}
+
+func TestConfigSnapshot(t *testing.T) {
+	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	con := s.NewReplayConnection(nil)
+	initial := con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+
+	responses, err := s.Discovery.ConfigSnapshot(con.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 1 || responses[0].TypeUrl != v3.ClusterType {
+		t.Fatalf("expected a snapshot with the CDS response, got %v", responses)
+	}
+	if len(responses[0].Resources) != len(initial[0].Resources) {
+		t.Fatalf("expected %d clusters, got %d", len(initial[0].Resources), len(responses[0].Resources))
+	}
+	if _, err := s.Discovery.ConfigSnapshot("unknown"); err == nil {
+		t.Fatalf("expected an error for an unknown connection")
+	}
+}
+
 func TestAdsReconnectAfterRestart(t *testing.T) {
 	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
 	adscon := s.ConnectADS()
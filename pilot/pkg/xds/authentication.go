@@ -24,8 +24,15 @@ import (
 	"google.golang.org/grpc/peer"
 
 	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/security/pkg/server/ca/authenticate"
 )
 
+// ErrAuthenticatorNotApplicable is returned, possibly wrapped, by an authenticator when the request does not
+// carry the credentials it checks, for example a JWT authenticator on a request without a token. The
+// authenticator is skipped, rather than failed, which matters with RequireAllAuthenticators. The built-in
+// client certificate and JWT authenticators return it.
+var ErrAuthenticatorNotApplicable = authenticate.ErrNotApplicable
+
 // authenticate authenticates the ADS request using the configured authenticators.
 // Returns the validated principals or an error.
 // If no authenticators are configured, or if the request is on a non-secure
@@ -49,13 +56,39 @@ func (s *DiscoveryServer) authenticate(ctx context.Context) ([]string, error) {
 		return nil, nil
 	}
 	authFailMsgs := []string{}
+	var identities []string
+	seen := map[string]struct{}{}
 	for _, authn := range s.Authenticators {
 		u, err := authn.Authenticate(ctx)
-		// If one authenticator passes, return
+		if errors.Is(err, ErrAuthenticatorNotApplicable) {
+			authFailMsgs = append(authFailMsgs, fmt.Sprintf("Authenticator %s: not applicable", authn.AuthenticatorType()))
+			continue
+		}
 		if u != nil && u.Identities != nil && err == nil {
-			return u.Identities, nil
+			// If one authenticator passes, return, unless identities from all authenticators are combined.
+			if !s.UnionIdentities && !s.RequireAllAuthenticators {
+				return u.Identities, nil
+			}
+			for _, id := range u.Identities {
+				if _, f := seen[id]; !f {
+					seen[id] = struct{}{}
+					identities = append(identities, id)
+				}
+			}
+			continue
 		}
 		authFailMsgs = append(authFailMsgs, fmt.Sprintf("Authenticator %s: %v", authn.AuthenticatorType(), err))
+		if s.RequireAllAuthenticators {
+			adsLog.Errora("Failed to authenticate client from ", peerInfo.Addr.String(), " ", strings.Join(authFailMsgs, "; "))
+			return nil, errors.New("authentication failure")
+		}
+	}
+	if identities != nil {
+		if len(authFailMsgs) > 0 {
+			adsLog.Debugf("Authenticated client from %s, some authenticators did not apply: %s",
+				peerInfo.Addr.String(), strings.Join(authFailMsgs, "; "))
+		}
+		return identities, nil
 	}
 
 	adsLog.Errora("Failed to authenticate client from ", peerInfo.Addr.String(), " ", strings.Join(authFailMsgs, "; "))
@@ -0,0 +1,99 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"istio.io/istio/security/pkg/server/ca/authenticate"
+)
+
+type fakeAuthenticator struct {
+	identities    []string
+	notApplicable bool
+}
+
+func (f fakeAuthenticator) Authenticate(context.Context) (*authenticate.Caller, error) {
+	if f.notApplicable {
+		return nil, ErrAuthenticatorNotApplicable
+	}
+	if f.identities == nil {
+		return nil, errors.New("not authenticated")
+	}
+	return &authenticate.Caller{Identities: f.identities}, nil
+}
+
+func (f fakeAuthenticator) AuthenticatorType() string {
+	return "fake"
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.IPAddr{IP: net.ParseIP("1.1.1.1")},
+		AuthInfo: credentials.TLSInfo{},
+	})
+	authenticators := []authenticate.Authenticator{
+		fakeAuthenticator{},
+		fakeAuthenticator{identities: []string{"a", "b"}},
+		fakeAuthenticator{identities: []string{"b", "c"}},
+	}
+	applicable := []authenticate.Authenticator{
+		fakeAuthenticator{notApplicable: true},
+		fakeAuthenticator{identities: []string{"a", "b"}},
+		fakeAuthenticator{identities: []string{"b", "c"}},
+	}
+	cases := []struct {
+		name           string
+		authenticators []authenticate.Authenticator
+		union          bool
+		requireAll     bool
+		identities     []string
+		err            bool
+	}{
+		{"first success", authenticators, false, false, []string{"a", "b"}, false},
+		{"union", authenticators, true, false, []string{"a", "b", "c"}, false},
+		{"all fail", []authenticate.Authenticator{fakeAuthenticator{}}, false, false, nil, true},
+		{"all fail union", []authenticate.Authenticator{fakeAuthenticator{}}, true, false, nil, true},
+		{"require all with failure", authenticators, false, true, nil, true},
+		{"require all applicable", applicable, false, true, []string{"a", "b", "c"}, false},
+		{"none applicable", []authenticate.Authenticator{fakeAuthenticator{notApplicable: true}}, false, true, nil, true},
+		// The connection is TLS without client certificate: the built-in client certificate authenticator does
+		// not apply.
+		{"client cert not applicable", []authenticate.Authenticator{
+			&authenticate.ClientCertAuthenticator{},
+			fakeAuthenticator{identities: []string{"a"}},
+		}, false, true, []string{"a"}, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &DiscoveryServer{Authenticators: tt.authenticators, UnionIdentities: tt.union,
+				RequireAllAuthenticators: tt.requireAll}
+			ids, err := s.authenticate(ctx)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tt.identities) {
+				t.Fatalf("expected %v, got %v", tt.identities, ids)
+			}
+		})
+	}
+}
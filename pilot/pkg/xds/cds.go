@@ -19,6 +19,7 @@ import (
 
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes/any"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
@@ -26,7 +27,7 @@ import (
 )
 
 // clusters aggregate a DiscoveryResponse for pushing.
-func cdsDiscoveryResponse(response []*cluster.Cluster, noncePrefix string) *discovery.DiscoveryResponse {
+func cdsDiscoveryResponse(response []*cluster.Cluster, version, noncePrefix string) *discovery.DiscoveryResponse {
 	out := &discovery.DiscoveryResponse{
 		// All resources for CDS ought to be of the type Cluster
 		TypeUrl: v3.ClusterType,
@@ -35,7 +36,7 @@ func cdsDiscoveryResponse(response []*cluster.Cluster, noncePrefix string) *disc
 		// available to it, irrespective of whether Envoy chooses to accept or reject CDS
 		// responses. Pilot believes in eventual consistency and that at some point, Envoy
 		// will begin seeing results it deems to be good.
-		VersionInfo: versionInfo(),
+		VersionInfo: version,
 		Nonce:       nonce(noncePrefix),
 	}
 
@@ -46,13 +47,47 @@ func cdsDiscoveryResponse(response []*cluster.Cluster, noncePrefix string) *disc
 	return out
 }
 
+// filterClusters returns the clusters with the given names.
+func filterClusters(clusters []*cluster.Cluster, names []string) []*cluster.Cluster {
+	requested := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		requested[name] = struct{}{}
+	}
+	out := make([]*cluster.Cluster, 0, len(names))
+	for _, c := range clusters {
+		if _, f := requested[c.Name]; f {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
 func (s *DiscoveryServer) pushCds(con *Connection, push *model.PushContext, version string) error {
 	pushStart := time.Now()
 	defer func() { cdsPushTime.Record(time.Since(pushStart).Seconds()) }()
 
-	rawClusters := s.ConfigGenerator.BuildClusters(con.proxy, push)
-
-	response := cdsDiscoveryResponse(rawClusters, push.Version)
+	version = con.nextVersion(v3.ClusterType, version)
+	var response *discovery.DiscoveryResponse
+	// Clusters are requested by name for on-demand discovery. An empty list requests all of them.
+	names := con.RequestedClusters()
+	var cached []*any.Any
+	key := ""
+	if len(names) == 0 {
+		cached, key = s.cachedShapeResources(v3.ClusterType, con, push)
+	}
+	if cached != nil {
+		response = cdsDiscoveryResponse(nil, version, push.Version)
+		response.Resources = cached
+	} else {
+		rawClusters := s.ConfigGenerator.BuildClusters(con.proxy, push)
+		if len(names) > 0 {
+			rawClusters = filterClusters(rawClusters, names)
+		}
+		response = cdsDiscoveryResponse(rawClusters, version, push.Version)
+		if key != "" {
+			s.shapeCache.add(pushVersion(push), key, response.Resources)
+		}
+	}
 	err := con.send(response)
 	if err != nil {
 		recordSendError("CDS", con.ConID, cdsSendErrPushes, err)
@@ -62,6 +97,6 @@ func (s *DiscoveryServer) pushCds(con *Connection, push *model.PushContext, vers
 
 	// The response can't be easily read due to 'any' marshaling.
 	adsLog.Infof("CDS: PUSH for node:%s clusters:%d services:%d version:%s",
-		con.proxy.ID, len(rawClusters), len(push.Services(nil)), version)
+		con.proxy.ID, len(response.Resources), len(push.Services(nil)), version)
 	return nil
 }
@@ -0,0 +1,40 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+
+	model "istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestFilterClusters(t *testing.T) {
+	con := newConnection("10.0.0.1:1234", nil)
+	con.proxy = &model.Proxy{WatchedResources: map[string]*model.WatchedResource{}}
+	if got := con.RequestedClusters(); len(got) != 0 {
+		t.Fatalf("expected no requested clusters, got %v", got)
+	}
+	con.proxy.WatchedResources[v3.ClusterType] = &model.WatchedResource{
+		TypeUrl: v3.ClusterType, ResourceNames: []string{"b", "missing"}}
+
+	clusters := []*cluster.Cluster{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	got := filterClusters(clusters, con.RequestedClusters())
+	if len(got) != 1 || got[0].Name != "b" {
+		t.Fatalf("expected only cluster b, got %v", got)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+
+	"istio.io/istio/pilot/pkg/features"
+)
+
+// Supported values of PILOT_XDS_SEND_COMPRESSION.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// sendCompressor returns the compressor for the given algorithm, or nil for no compression.
+func sendCompressor(algorithm string) (encoding.Compressor, error) {
+	switch algorithm {
+	case "", compressionNone:
+		return nil, nil
+	case compressionGzip:
+		return countingCompressor{gzipCompressor{}}, nil
+	case compressionZstd:
+		return countingCompressor{zstdCompressor{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q, expected one of %s, %s or %s",
+			algorithm, compressionNone, compressionGzip, compressionZstd)
+	}
+}
+
+// RegisterSendCompressors registers the gRPC compressor of the algorithm set in PILOT_XDS_SEND_COMPRESSION.
+// An unsupported algorithm is logged and no compressor is registered. It must be called before the XDS server
+// accepts connections.
+//
+// The gRPC version we depend on cannot set the compressor of a stream from the server: a stream accepted
+// without a server wide compressor is answered with the compression of the requests of the client, if its
+// compressor is registered. A connection is therefore compressed when the client compresses its requests with
+// the registered algorithm, and its responses are all compressed, whatever their size.
+func RegisterSendCompressors() {
+	cp, err := sendCompressor(features.XDSSendCompression)
+	if err != nil {
+		adsLog.Warnf("Ignoring PILOT_XDS_SEND_COMPRESSION: %v", err)
+		return
+	}
+	if cp == nil {
+		return
+	}
+	encoding.RegisterCompressor(cp)
+}
+
+// countingCompressor records the compression metrics of the messages compressed by the wrapped compressor.
+type countingCompressor struct {
+	encoding.Compressor
+}
+
+func (c countingCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	cw := &countingWriter{w: w}
+	z, err := c.Compressor.Compress(cw)
+	if err != nil {
+		return nil, err
+	}
+	return &countingWriteCloser{WriteCloser: z, compressed: cw}, nil
+}
+
+// countingWriteCloser counts the bytes written before compression, and records the metrics when closed.
+type countingWriteCloser struct {
+	io.WriteCloser
+	n          int
+	compressed *countingWriter
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.n += n
+	return n, err
+}
+
+func (c *countingWriteCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	xdsCompressionSends.Increment()
+	xdsCompressionBytes.With(stageTag.Value("uncompressed")).Record(float64(c.n))
+	xdsCompressionBytes.With(stageTag.Value("compressed")).Record(float64(c.compressed.n))
+	return nil
+}
+
+// gzipCompressor is the gzip encoding.Compressor. It is not registered by importing the gRPC gzip package,
+// which would register it for all servers, whatever PILOT_XDS_SEND_COMPRESSION.
+type gzipCompressor struct{}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+func (gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	z := gzipWriters.Get().(*gzip.Writer)
+	z.Reset(w)
+	return &gzipWriter{Writer: z}, nil
+}
+
+func (gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCompressor) Name() string {
+	return compressionGzip
+}
+
+// gzipWriter returns its writer to the pool when closed.
+type gzipWriter struct {
+	*gzip.Writer
+}
+
+func (z *gzipWriter) Close() error {
+	defer gzipWriters.Put(z.Writer)
+	return z.Writer.Close()
+}
+
+// zstdCompressor is the zstd encoding.Compressor. Messages are buffered and compressed when the writer is
+// closed, with an encoder and a decoder shared by all streams.
+type zstdCompressor struct{}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func (zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &zstdWriter{w: w}, nil
+}
+
+func (zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err = zstdDecoder.DecodeAll(b, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+func (zstdCompressor) Name() string {
+	return compressionZstd
+}
+
+// zstdWriter writes the compressed message to w when closed.
+type zstdWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	return z.buf.Write(p)
+}
+
+func (z *zstdWriter) Close() error {
+	_, err := z.w.Write(zstdEncoder.EncodeAll(z.buf.Bytes(), nil))
+	return err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
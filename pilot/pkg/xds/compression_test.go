@@ -0,0 +1,134 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestSendCompressor(t *testing.T) {
+	cases := []struct {
+		algorithm string
+		want      string
+		wantErr   bool
+	}{
+		{algorithm: "", want: ""},
+		{algorithm: "none", want: ""},
+		{algorithm: "gzip", want: "gzip"},
+		{algorithm: "zstd", want: "zstd"},
+		{algorithm: "brotli", wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			cp, err := sendCompressor(tt.algorithm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := ""
+			if cp != nil {
+				got = cp.Name()
+			}
+			if got != tt.want {
+				t.Fatalf("expected compressor %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGzipSendCompressor(t *testing.T) {
+	res := &discovery.DiscoveryResponse{TypeUrl: "type", VersionInfo: "version", Nonce: "nonce"}
+	want, err := proto.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := sendCompressor("gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := cp.Compress(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	z, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected decompressed message %q, expected %q", got, want)
+	}
+
+	r, err := cp.Decompress(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err = ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected decompressed message %q, expected %q", got, want)
+	}
+}
+
+func TestZstdSendCompressor(t *testing.T) {
+	want := bytes.Repeat([]byte("cluster.local"), 100)
+	cp, err := sendCompressor("zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := cp.Compress(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(want) {
+		t.Fatalf("expected the message to be compressed, got %d bytes from %d", buf.Len(), len(want))
+	}
+	r, err := cp.Decompress(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected decompressed message %q, expected %q", got, want)
+	}
+}
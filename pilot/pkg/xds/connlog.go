@@ -0,0 +1,78 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// connectionLog logs messages about a connection, tagged with the fields identifying it: the connection
+// ID, the peer address, the cluster and namespace of the proxy, and the sequence number of the request
+// being processed, to correlate the messages of a request.
+type connectionLog struct {
+	con    *Connection
+	prefix string
+	// debug is set if the proxy requested debug logs with the XDS_DEBUG metadata. They are logged at the
+	// info level, so they are emitted without raising the level of the ads scope for all the connections.
+	debug bool
+}
+
+// newConnectionLog returns the log of the connection, tagged with its current fields. It is created again
+// once the connection is initialized, since the proxy is not known before the first request.
+func newConnectionLog(con *Connection) *connectionLog {
+	cluster, namespace := "", ""
+	if con.proxy != nil {
+		namespace = con.proxy.ConfigNamespace
+		if con.proxy.Metadata != nil {
+			cluster = con.proxy.Metadata.ClusterID
+		}
+	}
+	return &connectionLog{
+		con:    con,
+		prefix: fmt.Sprintf("ADS: conID=%s peer=%s cluster=%s namespace=%s", con.ConID, con.PeerAddr, cluster, namespace),
+		// A proxy could flood the logs, so only trusted connections may raise the verbosity.
+		debug: !con.Untrusted && con.proxy != nil && con.proxy.Metadata != nil && bool(con.proxy.Metadata.XdsDebug),
+	}
+}
+
+// format returns the message tagged with the fields of the connection. A nil log, for connections created
+// without newConnection, only adds the ADS prefix.
+func (l *connectionLog) format(template string, args []interface{}) string {
+	if l == nil {
+		return "ADS: " + fmt.Sprintf(template, args...)
+	}
+	return fmt.Sprintf("%s req=%d: %s", l.prefix, atomic.LoadInt64(&l.con.requestSeq), fmt.Sprintf(template, args...))
+}
+
+func (l *connectionLog) Debugf(template string, args ...interface{}) {
+	if adsLog.DebugEnabled() {
+		adsLog.Debug(l.format(template, args))
+	} else if l != nil && l.debug && adsLog.InfoEnabled() {
+		adsLog.Info(l.format(template, args))
+	}
+}
+
+func (l *connectionLog) Infof(template string, args ...interface{}) {
+	if adsLog.InfoEnabled() {
+		adsLog.Info(l.format(template, args))
+	}
+}
+
+func (l *connectionLog) Warnf(template string, args ...interface{}) {
+	if adsLog.WarnEnabled() {
+		adsLog.Warn(l.format(template, args))
+	}
+}
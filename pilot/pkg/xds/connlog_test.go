@@ -0,0 +1,56 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestConnectionLogFormat(t *testing.T) {
+	con := newConnection("10.0.0.1:1234", nil)
+	con.ConID = "sidecar~1"
+	con.proxy = &model.Proxy{ConfigNamespace: "default", Metadata: &model.NodeMetadata{ClusterID: "Kubernetes"}}
+	con.log = newConnectionLog(con)
+	con.requestSeq = 3
+
+	expected := "ADS: conID=sidecar~1 peer=10.0.0.1:1234 cluster=Kubernetes namespace=default req=3: CDS: REQ version:v1"
+	if got := con.log.format("CDS: REQ version:%s", []interface{}{"v1"}); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+
+	var nilLog *connectionLog
+	if got := nilLog.format("LDS: REQ", nil); got != "ADS: LDS: REQ" {
+		t.Fatalf("expected the nil log to only add the prefix, got %q", got)
+	}
+}
+
+func TestConnectionLogDebug(t *testing.T) {
+	con := newConnection("10.0.0.1:1234", nil)
+	con.proxy = &model.Proxy{Metadata: &model.NodeMetadata{XdsDebug: true}}
+	if !newConnectionLog(con).debug {
+		t.Fatalf("expected debug logs to be requested by the metadata")
+	}
+	con.Untrusted = true
+	if newConnectionLog(con).debug {
+		t.Fatalf("expected debug logs to be ignored for an untrusted connection")
+	}
+	con.Untrusted = false
+	con.proxy.Metadata.XdsDebug = false
+	if newConnectionLog(con).debug {
+		t.Fatalf("expected no debug logs without the metadata")
+	}
+}
@@ -15,16 +15,21 @@
 package xds
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/http/pprof"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/any"
@@ -38,6 +43,7 @@ import (
 	"istio.io/istio/pilot/pkg/serviceregistry/memory"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/config/schema/collection"
+	"istio.io/istio/pkg/config/schema/gvk"
 	"istio.io/istio/pkg/config/schema/resource"
 	"istio.io/istio/pkg/kube/inject"
 )
@@ -89,13 +95,112 @@ type AdsClient struct {
 	ConnectionID string    `json:"connectionId"`
 	ConnectedAt  time.Time `json:"connectedAt"`
 	PeerAddress  string    `json:"address"`
+	// Metadata is the node metadata presented by the proxy, with sensitive values redacted.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// LastFullPush identifies the push that produced the config the proxy is running.
+	LastFullPush *PushProvenance `json:"lastFullPush,omitempty"`
+	// LastQueueWait is the time the last push to the proxy waited in the push queue.
+	LastQueueWait string `json:"lastQueueWait,omitempty"`
+	// LastEdsTrigger has the services that triggered the last incremental EDS push to the proxy.
+	LastEdsTrigger *EdsTrigger `json:"lastEdsTrigger,omitempty"`
+	// LastEdsRemovals is the number of clusters sent with an empty assignment in the last EDS push.
+	LastEdsRemovals int `json:"lastEdsRemovals,omitempty"`
+	// ResourceChurn is the number of times the proxy changed the resource names it subscribes to.
+	ResourceChurn int64 `json:"resourceChurn,omitempty"`
+	// Untrusted is true if the proxy has no authenticated identity and is restricted to the Envoy types.
+	Untrusted bool `json:"untrusted,omitempty"`
+	// Locality is the locality resolved for the proxy, and LocalitySource where it was resolved from.
+	Locality       string `json:"locality,omitempty"`
+	LocalitySource string `json:"localitySource,omitempty"`
+	// PushCircuitOpen is true if pushes to the proxy are skipped after consecutive failures.
+	PushCircuitOpen bool `json:"pushCircuitOpen,omitempty"`
+	// HealthScore reflects how reliably the proxy receives config, from 0 to 100.
+	HealthScore int `json:"healthScore"`
+	// Generator is the generator serving the proxy. UnknownGenerator is set if the proxy requested
+	// a generator that is not registered.
+	Generator        string `json:"generator,omitempty"`
+	UnknownGenerator string `json:"unknownGenerator,omitempty"`
+	// LastNacks has the last rejection of each type the proxy did not accept a response of since.
+	LastNacks map[string]*model.NackDetail `json:"lastNacks,omitempty"`
 }
 
+// sensitiveMetadataKeys are substrings of node metadata keys whose values are redacted in debug output.
+var sensitiveMetadataKeys = []string{"TOKEN", "SECRET", "PASSWORD", "CREDENTIAL", "KEY"}
+
 // AdsClients is collection of AdsClient connected to this Istiod.
 type AdsClients struct {
 	Connected []AdsClient `json:"clients"`
 }
 
+// ConnectionSnapshot is a copy of the state of a connection, with the ACK state of each watched type.
+type ConnectionSnapshot struct {
+	ConnectionID string    `json:"connectionId"`
+	PeerAddress  string    `json:"address"`
+	Identities   []string  `json:"identities,omitempty"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	// Watched has the state of each type watched by the proxy, by type URL.
+	Watched map[string]WatchedResourceSnapshot `json:"watched,omitempty"`
+}
+
+// WatchedResourceSnapshot is a copy of the ACK state of a type watched by a proxy.
+type WatchedResourceSnapshot struct {
+	VersionAcked string    `json:"versionAcked,omitempty"`
+	NonceAcked   string    `json:"nonceAcked,omitempty"`
+	NonceSent    string    `json:"nonceSent,omitempty"`
+	LastSent     time.Time `json:"lastSent,omitempty"`
+	LastSize     int       `json:"lastSize,omitempty"`
+	// FirstPush is the time from connect to the first response of the type.
+	FirstPush time.Duration `json:"firstPush,omitempty"`
+}
+
+// ConnectionsSnapshot returns a copy of the state of all the connections, sorted by connection ID.
+// The connection table lock is released before the proxy locks are taken, so it cannot deadlock with
+// pushes, and the data is copied so the result can be used without holding any lock.
+func (s *DiscoveryServer) ConnectionsSnapshot() []ConnectionSnapshot {
+	s.adsClientsMutex.RLock()
+	cons := make([]*Connection, 0, len(s.adsClients))
+	for _, con := range s.adsClients {
+		cons = append(cons, con)
+	}
+	s.adsClientsMutex.RUnlock()
+
+	snapshots := make([]ConnectionSnapshot, 0, len(cons))
+	for _, con := range cons {
+		snapshot := ConnectionSnapshot{
+			ConnectionID: con.ConID,
+			PeerAddress:  con.PeerAddr,
+			Identities:   append([]string(nil), con.Identities...),
+			ConnectedAt:  con.Connect,
+			Watched:      map[string]WatchedResourceSnapshot{},
+		}
+		con.proxy.RLock()
+		for typeURL, w := range con.proxy.WatchedResources {
+			snapshot.Watched[typeURL] = WatchedResourceSnapshot{
+				VersionAcked: w.VersionAcked,
+				NonceAcked:   w.NonceAcked,
+				NonceSent:    w.NonceSent,
+				LastSent:     w.LastSent,
+				LastSize:     w.LastSize,
+				FirstPush:    con.firstPush[typeURL],
+			}
+		}
+		con.proxy.RUnlock()
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ConnectionID < snapshots[j].ConnectionID
+	})
+	return snapshots
+}
+
+// connectionsz lists the connected proxies, with the ACK state of each type they watch.
+func (s *DiscoveryServer) connectionsz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(s.ConnectionsSnapshot(), "  ", "  "); err == nil {
+		_, _ = w.Write(b)
+	}
+}
+
 // SyncStatus is the synchronization status between Pilot and a given Envoy
 type SyncStatus struct {
 	ProxyID       string `json:"proxy,omitempty"`
@@ -155,6 +260,19 @@ func (s *DiscoveryServer) AddDebugHandlers(mux *http.ServeMux, enableProfiling b
 	s.addDebugHandler(mux, "/debug/edsz", "Status and debug interface for EDS", s.Edsz)
 	s.addDebugHandler(mux, "/debug/adsz", "Status and debug interface for ADS", s.adsz)
 	s.addDebugHandler(mux, "/debug/adsz?push=true", "Initiates push of the current state to all connected endpoints", s.adsz)
+	s.addDebugHandler(mux, "/debug/connectionsz", "Connected proxies, with the ACK state of each type they watch", s.connectionsz)
+	s.addDebugHandler(mux, "/debug/triggerEds", "Triggers an incremental EDS push of the passed in services "+
+		"(services=a,b&namespace=ns) to the passed in conid", s.triggerEds)
+	s.addDebugHandler(mux, "/debug/config_archive", "Generates the full current config of the passed in conid, "+
+		"as a tar.gz of Envoy JSON files, one per response", s.configArchive)
+	s.addDebugHandler(mux, "/debug/sentz", "Names of the resources in the last response of each type sent to the passed in proxyID", s.sentz)
+	s.addDebugHandler(mux, "/debug/drainz", "Disconnect proxies matching the passed in version and/or namespace, "+
+		"staggered over window. Lists the matching proxies unless confirm=true", s.drainz)
+	s.addDebugHandler(mux, "/debug/ack_history", "Most recent ACK and NACK events of the passed in proxyID", s.ackHistoryz)
+	s.addDebugHandler(mux, "/debug/pausez", "Pause or resume pushes to the passed in proxyID, with paused=true|false", s.pausez)
+	s.addDebugHandler(mux, "/debug/tenantz", "XDS connections, responses and bytes sent by tenant, "+
+		"as identified by PILOT_XDS_TENANT_LABELS", s.tenantz)
+	s.addDebugHandler(mux, "/debug/disconnectz", "Disconnect the passed in proxyID, so it reconnects and syncs again", s.disconnectz)
 
 	s.addDebugHandler(mux, "/debug/syncz", "Synchronization status of all Envoys connected to this Pilot instance", s.Syncz)
 	s.addDebugHandler(mux, "/debug/config_distribution", "Version status of all Envoys connected to this Pilot instance", s.distributedVersions)
@@ -459,6 +577,21 @@ func (s *DiscoveryServer) adsz(w http.ResponseWriter, req *http.Request) {
 			ConnectionID: c.ConID,
 			ConnectedAt:  c.Connect,
 			PeerAddress:  c.PeerAddr,
+			Metadata:     redactedMetadata(c.proxy.Metadata),
+			LastFullPush: c.LastFullPush(),
+			HealthScore:  c.HealthScore(),
+		}
+		adsClient.PushCircuitOpen = c.pushCircuitOpen()
+		adsClient.LastEdsTrigger = c.LastEdsTrigger()
+		adsClient.LastEdsRemovals = c.EdsRemovals()
+		adsClient.ResourceChurn = c.ResourceChurn()
+		adsClient.Untrusted = c.Untrusted
+		adsClient.Locality = util.LocalityToString(c.proxy.Locality)
+		adsClient.LocalitySource = proxyLocalitySource(c.proxy)
+		adsClient.Generator, adsClient.UnknownGenerator = proxyGenerator(c.proxy)
+		adsClient.LastNacks = c.LastNacks()
+		if wait := c.QueueWait(); wait > 0 {
+			adsClient.LastQueueWait = wait.String()
 		}
 		adsClients.Connected = append(adsClients.Connected, adsClient)
 	}
@@ -467,6 +600,294 @@ func (s *DiscoveryServer) adsz(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// triggerEds pushes EDS for the given services to a single connection, using the incremental push path.
+// It is mapped to /debug/triggerEds?conid=...&services=a,b&namespace=ns
+func (s *DiscoveryServer) triggerEds(w http.ResponseWriter, req *http.Request) {
+	conID := req.URL.Query().Get("conid")
+	services := req.URL.Query().Get("services")
+	if conID == "" || services == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide conid and services in the query string"))
+		return
+	}
+	s.adsClientsMutex.RLock()
+	con := s.adsClients[conID]
+	s.adsClientsMutex.RUnlock()
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Connection not found on this Pilot instance"))
+		return
+	}
+
+	namespace := req.URL.Query().Get("namespace")
+	configsUpdated := map[model.ConfigKey]struct{}{}
+	for _, svc := range strings.Split(services, ",") {
+		configsUpdated[model.ConfigKey{Kind: gvk.ServiceEntry, Name: svc, Namespace: namespace}] = struct{}{}
+	}
+	s.cache.Clear(configsUpdated)
+	s.pushQueue.Enqueue(con, &model.PushRequest{
+		Full:           false,
+		Push:           s.globalPushContext(),
+		Start:          time.Now(),
+		ConfigsUpdated: configsUpdated,
+		Reason:         []model.TriggerReason{model.DebugTrigger},
+	})
+	_, _ = fmt.Fprintf(w, "Triggered EDS push of %d services to %s", len(configsUpdated), conID)
+}
+
+// configArchive generates the config a full push would send to a connection, and writes it as a tar.gz
+// with one JSON file for each response, for offline debugging and bug reports.
+// It is mapped to /debug/config_archive?conid=...
+func (s *DiscoveryServer) configArchive(w http.ResponseWriter, req *http.Request) {
+	conID := req.URL.Query().Get("conid")
+	if conID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide a conid in the query string"))
+		return
+	}
+	responses, err := s.ConfigSnapshot(conID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	archive, err := buildConfigArchive(responses)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", conID+".tar.gz"))
+	_, _ = w.Write(archive)
+}
+
+// buildConfigArchive returns a tar.gz with the responses as JSON files, named after their order and type.
+func buildConfigArchive(responses []*discovery.DiscoveryResponse) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	jsonm := &jsonpb.Marshaler{Indent: "  "}
+	for i, res := range responses {
+		content, err := jsonm.MarshalToString(res)
+		if err != nil {
+			return nil, err
+		}
+		typeName := strings.NewReplacer("/", "_", ".", "_").Replace(strings.ToLower(v3.GetShortType(res.TypeUrl)))
+		hdr := &tar.Header{
+			Name:    fmt.Sprintf("%02d-%s.json", i, typeName),
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sentz dumps the names of the resources included in the last response of each type sent to a proxy.
+// This requires PILOT_XDS_SENT_RESOURCE_NAMES_LIMIT to be set.
+func (s *DiscoveryServer) sentz(w http.ResponseWriter, req *http.Request) {
+	proxyID := req.URL.Query().Get("proxyID")
+	if proxyID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide a proxyID in the query string"))
+		return
+	}
+	con := s.getProxyConnection(proxyID)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Proxy not connected to this Pilot instance"))
+		return
+	}
+
+	sent := map[string][]string{}
+	con.proxy.RLock()
+	for typeURL, wr := range con.proxy.WatchedResources {
+		sent[typeURL] = wr.LastSentResourceNames
+	}
+	con.proxy.RUnlock()
+
+	out, err := json.MarshalIndent(sent, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, "unable to marshal sent resources: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// ackHistoryz shows the most recent ACK and NACK events of a single proxy, oldest first.
+// It is mapped to /debug/ack_history?proxyID=...
+func (s *DiscoveryServer) ackHistoryz(w http.ResponseWriter, req *http.Request) {
+	proxyID := req.URL.Query().Get("proxyID")
+	if proxyID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide a proxyID in the query string"))
+		return
+	}
+	con := s.getProxyConnection(proxyID)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Proxy not connected to this Pilot instance"))
+		return
+	}
+	if b, err := json.MarshalIndent(con.AckHistory(), "  ", "  "); err == nil {
+		_, _ = w.Write(b)
+	}
+}
+
+// pausez suspends or resumes pushes to a single proxy, for debugging.
+// It is mapped to /debug/pausez?proxyID=...&paused=true|false
+func (s *DiscoveryServer) pausez(w http.ResponseWriter, req *http.Request) {
+	proxyID := req.URL.Query().Get("proxyID")
+	if proxyID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide a proxyID in the query string"))
+		return
+	}
+	paused, err := strconv.ParseBool(req.URL.Query().Get("paused"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide paused=true|false in the query string"))
+		return
+	}
+	con := s.getProxyConnection(proxyID)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Proxy not connected to this Pilot instance"))
+		return
+	}
+	if err := s.PauseConnection(con.ConID, paused); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Connection %s paused=%v", con.ConID, paused)
+}
+
+// tenantz returns the XDS load of each tenant.
+func (s *DiscoveryServer) tenantz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(s.TenantsSnapshot(), "  ", "  "); err == nil {
+		_, _ = w.Write(b)
+	}
+}
+
+// disconnectz disconnects a single proxy, so it reconnects and syncs again.
+func (s *DiscoveryServer) disconnectz(w http.ResponseWriter, req *http.Request) {
+	proxyID := req.URL.Query().Get("proxyID")
+	if proxyID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide a proxyID in the query string"))
+		return
+	}
+	con := s.getProxyConnection(proxyID)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Proxy not connected to this Pilot instance"))
+		return
+	}
+	if err := s.Disconnect(con.ConID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Connection %s disconnected", con.ConID)
+}
+
+// drainz disconnects the proxies of a given Istio version and/or namespace, so they reconnect and pick
+// up changes. As a safety measure, the matching connections are only listed unless confirm=true is passed.
+func (s *DiscoveryServer) drainz(w http.ResponseWriter, req *http.Request) {
+	version := req.URL.Query().Get("version")
+	namespace := req.URL.Query().Get("namespace")
+	if version == "" && namespace == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide a version and/or namespace in the query string"))
+		return
+	}
+	window := time.Duration(0)
+	if ws := req.URL.Query().Get("window"); ws != "" {
+		d, err := time.ParseDuration(ws)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("Invalid window: " + err.Error()))
+			return
+		}
+		window = d
+	}
+	predicate := func(proxy *model.Proxy) bool {
+		if namespace != "" && proxy.ConfigNamespace != namespace {
+			return false
+		}
+		if version != "" && (proxy.Metadata == nil || proxy.Metadata.IstioVersion != version) {
+			return false
+		}
+		return true
+	}
+
+	if req.URL.Query().Get("confirm") != "true" {
+		matching := make([]string, 0)
+		s.adsClientsMutex.RLock()
+		for _, con := range s.adsClients {
+			if con.proxy != nil && predicate(con.proxy) {
+				matching = append(matching, con.ConID)
+			}
+		}
+		s.adsClientsMutex.RUnlock()
+		sort.Strings(matching)
+		_, _ = fmt.Fprintf(w, "%d connections would be drained, pass confirm=true to drain them:\n%s\n",
+			len(matching), strings.Join(matching, "\n"))
+		return
+	}
+
+	drained := s.DrainCohort(predicate, window)
+	_, _ = fmt.Fprintf(w, "Draining %d connections over %v", len(drained), window)
+}
+
+// redactedMetadata returns a copy of the metadata presented by the proxy, with the values of
+// sensitive keys redacted.
+func redactedMetadata(meta *model.NodeMetadata) map[string]interface{} {
+	if meta == nil {
+		return nil
+	}
+	raw := meta.Raw
+	if raw == nil {
+		// Not parsed from a node, fall back to the known fields.
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return nil
+		}
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil
+		}
+	}
+	out := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		out[k] = v
+		upper := strings.ToUpper(k)
+		for _, sensitive := range sensitiveMetadataKeys {
+			if strings.Contains(upper, sensitive) {
+				out[k] = "<redacted>"
+				break
+			}
+		}
+	}
+	return out
+}
+
 // ConfigDump returns information in the form of the Envoy admin API config dump for the specified proxy
 // The dump will only contain dynamic listeners/clusters/routes and can be used to compare what an Envoy instance
 // should look like according to Pilot vs what it currently does look like.
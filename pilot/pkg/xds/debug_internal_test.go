@@ -0,0 +1,52 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+
+	model "istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestConnectionsSnapshot(t *testing.T) {
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}}
+	for _, id := range []string{"b", "a"} {
+		con := newConnection("10.0.0.1:1234", nil)
+		con.ConID = id
+		con.Identities = []string{"spiffe://cluster.local/ns/default/sa/" + id}
+		con.proxy = &model.Proxy{
+			Metadata: &model.NodeMetadata{},
+			WatchedResources: map[string]*model.WatchedResource{
+				v3.ClusterType: {TypeUrl: v3.ClusterType, NonceSent: "n2", NonceAcked: "n1", VersionAcked: "v1", LastSize: 10},
+			},
+		}
+		s.addCon(id, con)
+	}
+
+	snapshot := s.ConnectionsSnapshot()
+	if len(snapshot) != 2 || snapshot[0].ConnectionID != "a" || snapshot[1].ConnectionID != "b" {
+		t.Fatalf("expected both connections sorted by ID, got %+v", snapshot)
+	}
+	expected := WatchedResourceSnapshot{VersionAcked: "v1", NonceAcked: "n1", NonceSent: "n2", LastSize: 10}
+	if got := snapshot[0].Watched[v3.ClusterType]; got != expected {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+	// The snapshot is a copy, it does not change with the connection.
+	s.adsClients["a"].proxy.WatchedResources[v3.ClusterType].NonceAcked = "n2"
+	if got := snapshot[0].Watched[v3.ClusterType].NonceAcked; got != "n1" {
+		t.Fatalf("expected the snapshot to be unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes/any"
+	"google.golang.org/grpc"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// DeltaDiscoveryStream is an interface for incremental ADS.
+type DeltaDiscoveryStream interface {
+	Send(*discovery.DeltaDiscoveryResponse) error
+	Recv() (*discovery.DeltaDiscoveryRequest, error)
+	grpc.ServerStream
+}
+
+// DeltaDiscoveryStreamAdapter is a DiscoveryStream that converts incremental (delta) xDS messages to
+// state of the world messages, similar to DiscoveryStreamV2Adapter. This allows delta clients to connect,
+// while keeping the core logic of Pilot, including the nonce and ACK handling, in state of the world XDS.
+//
+// Requests are converted by applying the subscribed and unsubscribed names to the set of names the proxy
+// is subscribed to, and responses by only sending the resources that changed since they were last sent.
+// Resources of wildcard types that are no longer generated are sent as removed.
+type DeltaDiscoveryStreamAdapter struct {
+	DeltaDiscoveryStream
+
+	mu sync.Mutex
+	// subscribed is the set of resource names the proxy is subscribed to, by type.
+	subscribed map[string]map[string]struct{}
+	// sent is the version of each resource the proxy has, by type and resource name.
+	sent map[string]map[string]string
+	// lastNonce and lastVersion are the nonce and version of the last response sent for each type, so the
+	// version can be set on the state of the world ACK.
+	lastNonce   map[string]string
+	lastVersion map[string]string
+}
+
+// We implement the v3 DiscoveryStream API
+var _ DiscoveryStream = &DeltaDiscoveryStreamAdapter{}
+
+// NewDeltaDiscoveryStreamAdapter returns a DiscoveryStream serving the delta stream.
+func NewDeltaDiscoveryStreamAdapter(stream DeltaDiscoveryStream) *DeltaDiscoveryStreamAdapter {
+	return &DeltaDiscoveryStreamAdapter{
+		DeltaDiscoveryStream: stream,
+		subscribed:           map[string]map[string]struct{}{},
+		sent:                 map[string]map[string]string{},
+		lastNonce:            map[string]string{},
+		lastVersion:          map[string]string{},
+	}
+}
+
+func (d *DeltaDiscoveryStreamAdapter) Send(res *discovery.DiscoveryResponse) error {
+	return d.DeltaDiscoveryStream.Send(d.toDeltaResponse(res))
+}
+
+func (d *DeltaDiscoveryStreamAdapter) Recv() (*discovery.DiscoveryRequest, error) {
+	req, err := d.DeltaDiscoveryStream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return d.toDiscoveryRequest(req), nil
+}
+
+// toDiscoveryRequest applies the delta request to the subscriptions, and returns the equivalent state of
+// the world request, listing all the subscribed resources. The existing shouldRespond logic then
+// reconciles the nonce and ACK, and responds if the subscriptions changed.
+func (d *DeltaDiscoveryStreamAdapter) toDiscoveryRequest(req *discovery.DeltaDiscoveryRequest) *discovery.DiscoveryRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subscribed := d.subscribed[req.TypeUrl]
+	sent := d.sent[req.TypeUrl]
+	if subscribed == nil {
+		// First request for the type, possibly after a reconnect: the proxy reports the resources it has,
+		// so they are not sent again unless they changed.
+		subscribed = map[string]struct{}{}
+		sent = map[string]string{}
+		for name, version := range req.InitialResourceVersions {
+			if !isWildcardType(req.TypeUrl) {
+				subscribed[name] = struct{}{}
+			}
+			sent[name] = version
+		}
+		d.subscribed[req.TypeUrl] = subscribed
+		d.sent[req.TypeUrl] = sent
+	}
+	for _, name := range req.ResourceNamesSubscribe {
+		// "*" explicitly requests all the resources, which is the default for wildcard types.
+		if name != "*" {
+			subscribed[name] = struct{}{}
+		}
+	}
+	for _, name := range req.ResourceNamesUnsubscribe {
+		delete(subscribed, name)
+		// The proxy drops the resource, so it must be sent again if it is subscribed to later.
+		delete(sent, name)
+	}
+
+	names := make([]string, 0, len(subscribed))
+	for name := range subscribed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	version := ""
+	if req.ResponseNonce != "" && req.ResponseNonce == d.lastNonce[req.TypeUrl] {
+		version = d.lastVersion[req.TypeUrl]
+	}
+	return &discovery.DiscoveryRequest{
+		VersionInfo:   version,
+		Node:          req.Node,
+		ResourceNames: names,
+		TypeUrl:       req.TypeUrl,
+		ResponseNonce: req.ResponseNonce,
+		ErrorDetail:   req.ErrorDetail,
+	}
+}
+
+// toDeltaResponse returns the delta response for a state of the world response, with the resources that
+// changed since they were last sent. The response is returned even if nothing changed, since the proxy
+// must ACK the nonce.
+func (d *DeltaDiscoveryStreamAdapter) toDeltaResponse(res *discovery.DiscoveryResponse) *discovery.DeltaDiscoveryResponse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sent := d.sent[res.TypeUrl]
+	if sent == nil {
+		sent = map[string]string{}
+		d.sent[res.TypeUrl] = sent
+	}
+	d.lastNonce[res.TypeUrl] = res.Nonce
+	d.lastVersion[res.TypeUrl] = res.VersionInfo
+
+	delta := &discovery.DeltaDiscoveryResponse{
+		SystemVersionInfo: res.VersionInfo,
+		TypeUrl:           res.TypeUrl,
+		Nonce:             res.Nonce,
+	}
+	generated := make(map[string]struct{}, len(res.Resources))
+	unchanged := 0
+	for _, r := range res.Resources {
+		name := resourceName(r)
+		version := resourceVersion(r)
+		if name != "" {
+			generated[name] = struct{}{}
+			if sent[name] == version {
+				unchanged++
+				continue
+			}
+			sent[name] = version
+		}
+		// Resources of custom types have no known name, so they are always sent.
+		delta.Resources = append(delta.Resources, &discovery.Resource{
+			Name:     name,
+			Version:  version,
+			Resource: r,
+		})
+	}
+	// Responses for wildcard types contain all the resources, so the ones missing were removed. Responses
+	// for other types may only contain the updated resources, for example incremental EDS pushes, and the
+	// proxy unsubscribes from the resources it no longer needs.
+	if isWildcardType(res.TypeUrl) {
+		for name := range sent {
+			if _, f := generated[name]; !f {
+				delta.RemovedResources = append(delta.RemovedResources, name)
+				delete(sent, name)
+			}
+		}
+		sort.Strings(delta.RemovedResources)
+	}
+	if unchanged > 0 {
+		xdsDeltaUnchangedResources.With(typeTag.Value(v3.GetMetricType(res.TypeUrl))).Record(float64(unchanged))
+	}
+	return delta
+}
+
+// Subscriptions returns the resource names the proxy is subscribed to for the type.
+func (d *DeltaDiscoveryStreamAdapter) Subscriptions(typeURL string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.subscribed[typeURL]))
+	for name := range d.subscribed[typeURL] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resourceVersion returns a version of the resource, derived from its content.
+func resourceVersion(r *any.Any) string {
+	h := fnv.New64a()
+	_, _ = h.Write(r.Value)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// Delta returns true if the connection uses the incremental (delta) xDS protocol.
+func (conn *Connection) Delta() bool {
+	_, ok := conn.stream.(*DeltaDiscoveryStreamAdapter)
+	return ok
+}
+
+// DeltaSubscriptions returns the resource names the proxy subscribed to for the type over the delta
+// protocol, or nil if the connection uses the state of the world protocol.
+func (conn *Connection) DeltaSubscriptions(typeURL string) []string {
+	d, ok := conn.stream.(*DeltaDiscoveryStreamAdapter)
+	if !ok {
+		return nil
+	}
+	return d.Subscriptions(typeURL)
+}
@@ -0,0 +1,149 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/duration"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func deltaNames(resources []*discovery.Resource) []string {
+	names := make([]string, 0, len(resources))
+	for _, r := range resources {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func TestDeltaAdapterSubscriptions(t *testing.T) {
+	d := NewDeltaDiscoveryStreamAdapter(nil)
+	req := d.toDiscoveryRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                 v3.EndpointType,
+		ResourceNamesSubscribe:  []string{"b", "a"},
+		InitialResourceVersions: map[string]string{"c": "1"},
+	})
+	if !reflect.DeepEqual(req.ResourceNames, []string{"a", "b", "c"}) {
+		t.Fatalf("expected the initial subscriptions, got %v", req.ResourceNames)
+	}
+
+	res := d.toDeltaResponse(&discovery.DiscoveryResponse{TypeUrl: v3.EndpointType, VersionInfo: "v1", Nonce: "n1"})
+	req = d.toDiscoveryRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                  v3.EndpointType,
+		ResponseNonce:            res.Nonce,
+		ResourceNamesSubscribe:   []string{"d"},
+		ResourceNamesUnsubscribe: []string{"a", "c"},
+	})
+	if !reflect.DeepEqual(req.ResourceNames, []string{"b", "d"}) {
+		t.Fatalf("expected the updated subscriptions, got %v", req.ResourceNames)
+	}
+	if req.VersionInfo != "v1" {
+		t.Fatalf("expected the version of the acknowledged response, got %q", req.VersionInfo)
+	}
+	if _, f := d.sent[v3.EndpointType]["c"]; f {
+		t.Fatalf("expected the unsubscribed resource to be forgotten")
+	}
+
+	req = d.toDiscoveryRequest(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.ClusterType, ResourceNamesSubscribe: []string{"*"}})
+	if len(req.ResourceNames) != 0 {
+		t.Fatalf("expected a wildcard request, got %v", req.ResourceNames)
+	}
+}
+
+func TestDeltaAdapterResponses(t *testing.T) {
+	d := NewDeltaDiscoveryStreamAdapter(nil)
+	clusters := func(names ...string) []*any.Any {
+		res := make([]*any.Any, 0, len(names))
+		for _, n := range names {
+			res = append(res, util.MessageToAny(&cluster.Cluster{Name: n}))
+		}
+		return res
+	}
+	res := d.toDeltaResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Resources: clusters("a", "b")})
+	if got := deltaNames(res.Resources); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("expected all clusters on the first response, got %v", got)
+	}
+
+	changed := util.MessageToAny(&cluster.Cluster{Name: "b", ConnectTimeout: &duration.Duration{Seconds: 5}})
+	res = d.toDeltaResponse(&discovery.DiscoveryResponse{
+		TypeUrl:   v3.ClusterType,
+		Resources: append(clusters("c"), changed),
+	})
+	if got := deltaNames(res.Resources); !reflect.DeepEqual(got, []string{"c", "b"}) {
+		t.Fatalf("expected only the changed clusters, got %v", got)
+	}
+	if !reflect.DeepEqual(res.RemovedResources, []string{"a"}) {
+		t.Fatalf("expected the missing cluster to be removed, got %v", res.RemovedResources)
+	}
+
+	// Incremental EDS pushes only contain the updated clusters, so the others are not removed.
+	cla := func(name string, weight uint32) *any.Any {
+		return util.MessageToAny(&endpoint.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints:   []*endpoint.LocalityLbEndpoints{{Priority: weight}},
+		})
+	}
+	d.toDeltaResponse(&discovery.DiscoveryResponse{TypeUrl: v3.EndpointType, Resources: []*any.Any{cla("a", 1), cla("b", 1)}})
+	res = d.toDeltaResponse(&discovery.DiscoveryResponse{TypeUrl: v3.EndpointType, Resources: []*any.Any{cla("a", 1), cla("b", 2)}})
+	if got := deltaNames(res.Resources); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("expected only the changed assignment, got %v", got)
+	}
+	res = d.toDeltaResponse(&discovery.DiscoveryResponse{TypeUrl: v3.EndpointType, Resources: []*any.Any{cla("a", 3)}})
+	if got := deltaNames(res.Resources); !reflect.DeepEqual(got, []string{"a"}) || len(res.RemovedResources) != 0 {
+		t.Fatalf("expected an update without removals, got %v removed %v", got, res.RemovedResources)
+	}
+}
+
+func TestDeltaAdapterResume(t *testing.T) {
+	d := NewDeltaDiscoveryStreamAdapter(nil)
+	a := util.MessageToAny(&cluster.Cluster{Name: "a"})
+	b := util.MessageToAny(&cluster.Cluster{Name: "b"})
+	// The proxy reconnects with the clusters it has: a is up to date, b changed and c was removed.
+	d.toDiscoveryRequest(&discovery.DeltaDiscoveryRequest{
+		TypeUrl:                 v3.ClusterType,
+		InitialResourceVersions: map[string]string{"a": resourceVersion(a), "b": "stale", "c": "1"},
+	})
+
+	res := d.toDeltaResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Resources: []*any.Any{a, b}})
+	if got := deltaNames(res.Resources); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("expected only the changed cluster, got %v", got)
+	}
+	if !reflect.DeepEqual(res.RemovedResources, []string{"c"}) {
+		t.Fatalf("expected the removed cluster, got %v", res.RemovedResources)
+	}
+}
+
+func TestConnectionDelta(t *testing.T) {
+	d := NewDeltaDiscoveryStreamAdapter(nil)
+	d.toDiscoveryRequest(&discovery.DeltaDiscoveryRequest{TypeUrl: v3.EndpointType, ResourceNamesSubscribe: []string{"a"}})
+	con := newConnection("", d)
+	if !con.Delta() {
+		t.Fatalf("expected a delta connection")
+	}
+	if got := con.DeltaSubscriptions(v3.EndpointType); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("expected the subscriptions of the stream, got %v", got)
+	}
+	if con := newConnection("", nil); con.Delta() || con.DeltaSubscriptions(v3.EndpointType) != nil {
+		t.Fatalf("expected a state of the world connection")
+	}
+}
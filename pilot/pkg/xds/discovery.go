@@ -15,14 +15,18 @@
 package xds
 
 import (
+	"fmt"
 	"strconv"
 	"sync"
 	"time"
 
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discoveryv2 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	lrs "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
 	"github.com/google/uuid"
 	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 
 	"istio.io/istio/pilot/pkg/features"
@@ -44,6 +48,8 @@ var (
 	version = "0"
 	// versionNum counts versions
 	versionNum = atomic.NewUint64(0)
+	// nonceNum counts nonces, when deterministic nonces are enabled.
+	nonceNum = atomic.NewUint64(0)
 
 	periodicRefreshMetrics = 10 * time.Second
 )
@@ -83,8 +89,13 @@ type DiscoveryServer struct {
 	// default generator, or the combination of Generator metadata and TypeUrl to select a
 	// different generator for a type.
 	// Normal istio clients use the default generator - will not be impacted by this.
+	// Once the server is started, generators should only be changed with RegisterGenerator and
+	// UnregisterGenerator.
 	Generators map[string]model.XdsResourceGenerator
 
+	// generatorsMutex protects Generators, which may be changed while connections exist.
+	generatorsMutex sync.RWMutex
+
 	concurrentPushLimit chan struct{}
 
 	// mutex protecting global structs updated or read by ADS service, including ConfigsUpdated and
@@ -100,6 +111,10 @@ type DiscoveryServer struct {
 	// mutex used for config update scheduling (former cache update mutex)
 	updateMutex sync.RWMutex
 
+	// lastGoodPushContext is the last fully built push context, served if PILOT_SERVE_STALE_PUSH_CONTEXT is
+	// enabled while the push context of the environment is not initialized. Protected by updateMutex.
+	lastGoodPushContext *model.PushContext
+
 	// pushQueue is the buffer that used after debounce and before the real xds push.
 	pushQueue *PushQueue
 
@@ -110,21 +125,90 @@ type DiscoveryServer struct {
 	adsClients      map[string]*Connection
 	adsClientsMutex sync.RWMutex
 
+	// edsSubscriptions holds the EDS clusters of recently disconnected proxies, keyed by proxy ID.
+	// Guarded by adsClientsMutex.
+	edsSubscriptions map[string]edsSubscription
+
+	// edsCoalescer, if set, accumulates incremental EDS pushes to each connection before enqueueing them.
+	edsCoalescer *edsCoalescer
+
+	// reconnectLimiter limits the rate of full generations triggered by reconnecting proxies.
+	// If nil, reconnects are not limited.
+	reconnectLimiter *rate.Limiter
+
+	// warmup limits the rate new connections are accepted at after the server becomes ready.
+	warmup *warmupLimiter
+
+	// nackRates tracks the rate of NACKs by type and proxy version, if PILOT_NACK_RATE_WINDOW is set.
+	nackRates *nackRateTracker
+
+	// sendTimeout is the minimum time to wait for a response to be sent to a connection, and
+	// sendMinBytesPerSecond the slowest expected send rate, which extends the timeout of large responses.
+	sendTimeout           time.Duration
+	sendMinBytesPerSecond int
+
+	// pushGenerationDone is closed when a full push to all connections starts. Batched pushes stop
+	// enqueueing then, since the newer push covers the remaining connections.
+	pushGenerationMutex sync.Mutex
+	pushGenerationDone  chan struct{}
+
+	// draining is set once Drain is called, after which new connections are rejected.
+	draining atomic.Bool
+
+	// streams is the number of open XDS streams, including the ones not yet added to adsClients.
+	streams atomic.Int64
+
 	StatusReporter DistributionStatusCache
 
 	// Authenticators for XDS requests. Should be same/subset of the CA authenticators.
 	Authenticators []authenticate.Authenticator
 
+	// UnionIdentities, if set, consults all Authenticators in order, and the identities of the connection
+	// are the union of those returned by each one that succeeds. This allows combining mechanisms, for
+	// example mTLS and JWT. By default, the identities of the first authenticator that succeeds are used.
+	// Set from PILOT_XDS_UNION_IDENTITIES.
+	UnionIdentities bool
+
+	// RequireAllAuthenticators, if set, requires each of the Authenticators that applies to the request to
+	// succeed, and the identities of the connection are the union of their identities. Authenticators that
+	// return ErrAuthenticatorNotApplicable are skipped, but at least one must succeed. Set from
+	// PILOT_XDS_REQUIRE_ALL_AUTHENTICATORS.
+	RequireAllAuthenticators bool
+
 	// InternalGen is notified of connect/disconnect/nack on all connections
 	InternalGen *InternalGen
 
+	// LoadStatsListener, if set, is notified of the load reported by proxies over LRS.
+	LoadStatsListener LoadStatsListener
+
+	// ResponseInterceptor, if set, is called with every response before it is sent.
+	ResponseInterceptor ResponseInterceptor
+
+	// OnConverged, if set, is called once a proxy has ACKed the last response sent for each of the types
+	// it watches, with the push version of the ACK that completed it. It is called again after the proxy
+	// converges on a later push. It is called while processing requests, and must not block.
+	OnConverged func(con *Connection, version string)
+
+	// ConnectionIDPrefix, if set, returns the prefix used for connection IDs. A unique counter is
+	// always appended to it. If nil or if it returns an empty string, the node ID is used.
+	ConnectionIDPrefix func(node *corev3.Node, proxy *model.Proxy) string
+
 	// serverReady indicates caches have been synced up and server is ready to process requests.
 	serverReady bool
 
+	// notReadySince is the time the server started, and has not been ready since, until serverReady is set.
+	notReadySince time.Time
+
 	debounceOptions debounceOptions
 
 	// Cache for XDS resources
 	cache model.XdsCache
+
+	// shapeCache, if set, shares the CDS resources between proxies of the same shape.
+	shapeCache *proxyShapeCache
+
+	// tenants, if set, attributes the XDS load to the tenants of the connections.
+	tenants *tenantStats
 }
 
 // EndpointShards holds the set of endpoint shards of a service. Registries update
@@ -167,6 +251,13 @@ func NewDiscoveryServer(env *model.Environment, plugins []string) *DiscoveryServ
 		},
 		cache: model.DisabledCache{},
 	}
+	out.sendTimeout = features.XDSSendTimeout
+	out.sendMinBytesPerSecond = features.XDSSendMinBytesPerSecond
+	out.notReadySince = time.Now()
+	if features.EnableProxyShapeCache {
+		out.shapeCache = newProxyShapeCache()
+	}
+	out.tenants = newTenantStats(features.XDSTenantLabels)
 
 	// Flush cached discovery responses when detecting jwt public key change.
 	model.GetJwtKeyResolver().PushFunc = func() {
@@ -175,6 +266,26 @@ func NewDiscoveryServer(env *model.Environment, plugins []string) *DiscoveryServ
 
 	out.initGenerators()
 
+	if features.EDSCoalesceWindow > 0 {
+		out.edsCoalescer = newEdsCoalescer(out.pushQueue, features.EDSCoalesceWindow, features.EDSCoalesceMaxDelay)
+	}
+
+	if features.ReconnectGenerationQPS > 0 {
+		out.reconnectLimiter = rate.NewLimiter(rate.Limit(features.ReconnectGenerationQPS), features.ReconnectGenerationBurst)
+	}
+
+	if features.NackRateWindow > 0 {
+		out.nackRates = newNackRateTracker(features.NackRateWindow)
+	}
+
+	if features.WarmupDuration > 0 {
+		out.warmup = newWarmupLimiter(features.WarmupDuration, features.WarmupInitialQPS, features.WarmupFinalQPS)
+	}
+
+	if features.EnableShortConnectionID {
+		out.ConnectionIDPrefix = ProxyIDConnectionPrefix
+	}
+
 	if features.EnableEDSCaching {
 		out.cache = model.NewXdsCache()
 	}
@@ -186,6 +297,9 @@ func NewDiscoveryServer(env *model.Environment, plugins []string) *DiscoveryServ
 func (s *DiscoveryServer) Register(rpcs *grpc.Server) {
 	// Register v3 server
 	discovery.RegisterAggregatedDiscoveryServiceServer(rpcs, s)
+	if features.LoadReportingInterval > 0 {
+		lrs.RegisterLoadReportingServiceServer(rpcs, s)
+	}
 }
 
 func (s *DiscoveryServer) RegisterLegacyv2(rpcs *grpc.Server) {
@@ -195,9 +309,17 @@ func (s *DiscoveryServer) RegisterLegacyv2(rpcs *grpc.Server) {
 
 // CachesSynced is called when caches have been synced so that server can accept connections.
 func (s *DiscoveryServer) CachesSynced() {
+	if path := features.WarmStartStatePath; path != "" && (features.EnableEDSCaching || s.shapeCache != nil) {
+		if err := s.preGenerateWarmStart(path); err != nil {
+			adsLog.Warnf("Warm start: failed to pre-generate config from %s: %v", path, err)
+		}
+	}
 	s.updateMutex.Lock()
 	s.serverReady = true
 	s.updateMutex.Unlock()
+	if s.warmup != nil {
+		s.warmup.Start(time.Now())
+	}
 }
 
 func (s *DiscoveryServer) IsServerReady() bool {
@@ -206,10 +328,31 @@ func (s *DiscoveryServer) IsServerReady() bool {
 	return s.serverReady
 }
 
+// IsPushQueueReady reports whether the push queue backlog is within PILOT_PUSH_QUEUE_READINESS_THRESHOLD.
+// A replica with a large backlog is serving stale config, so it should not take new connections
+// until it catches up. The check is disabled if the threshold is not set.
+func (s *DiscoveryServer) IsPushQueueReady() (bool, error) {
+	threshold := features.PushQueueReadinessThreshold
+	if threshold <= 0 {
+		return true, nil
+	}
+	if pending := s.pushQueue.Pending(); pending > threshold {
+		return false, fmt.Errorf("%d proxies pending push, threshold is %d", pending, threshold)
+	}
+	return true, nil
+}
+
 func (s *DiscoveryServer) Start(stopCh <-chan struct{}) {
 	go s.handleUpdates(stopCh)
 	go s.periodicRefreshMetrics(stopCh)
 	go s.sendPushes(stopCh)
+	if interval := features.XDSKeepaliveInterval; interval > 0 {
+		idle := features.XDSKeepaliveIdle
+		if idle <= 0 {
+			idle = interval
+		}
+		go s.keepalive(stopCh, interval, idle)
+	}
 }
 
 func (s *DiscoveryServer) getNonK8sRegistries() []serviceregistry.Instance {
@@ -254,6 +397,11 @@ func (s *DiscoveryServer) periodicRefreshMetrics(stopCh <-chan struct{}) {
 			model.LastPushMutex.Unlock()
 
 			push.Mutex.Unlock()
+
+			s.recordSyncedProxies()
+			s.recordConnectionAges(time.Now())
+			s.recordPendingPushes()
+			s.nackRates.recordNackRates(time.Now())
 		case <-stopCh:
 			return
 		}
@@ -277,12 +425,15 @@ func (s *DiscoveryServer) Push(req *model.PushRequest) {
 	// saved.
 	t0 := time.Now()
 
-	push, err := s.initPushContext(req, oldPushContext)
+	versionLocal := strconv.FormatUint(versionNum.Load(), 10)
+	if !features.EnableDeterministicXDS {
+		versionLocal = t0.Format(time.RFC3339) + "/" + versionLocal
+	}
+	push, err := s.initPushContext(req, oldPushContext, versionLocal)
 	if err != nil {
 		return
 	}
 
-	versionLocal := time.Now().Format(time.RFC3339) + "/" + strconv.FormatUint(versionNum.Load(), 10)
 	versionNum.Inc()
 	initContextTime := time.Since(t0)
 	adsLog.Debugf("InitContext %v for push took %s", versionLocal, initContextTime)
@@ -296,6 +447,9 @@ func (s *DiscoveryServer) Push(req *model.PushRequest) {
 }
 
 func nonce(noncePrefix string) string {
+	if features.EnableDeterministicXDS {
+		return noncePrefix + strconv.FormatUint(nonceNum.Inc(), 10)
+	}
 	return noncePrefix + uuid.New().String()
 }
 
@@ -305,10 +459,24 @@ func versionInfo() string {
 	return version
 }
 
+// pushVersion returns the version for config generated from the push context. It falls back
+// to the global version for contexts that were not created by a push.
+func pushVersion(push *model.PushContext) string {
+	if push != nil && push.PushVersion != "" {
+		return push.PushVersion
+	}
+	return versionInfo()
+}
+
 // Returns the global push context.
 func (s *DiscoveryServer) globalPushContext() *model.PushContext {
 	s.updateMutex.RLock()
 	defer s.updateMutex.RUnlock()
+	if features.ServeStalePushContext && s.lastGoodPushContext != nil && !s.Env.PushContext.IsInitialized() {
+		// The push context of the environment was not built, serve the last good one rather than initializing
+		// it in the connection.
+		return s.lastGoodPushContext
+	}
 	return s.Env.PushContext
 }
 
@@ -447,8 +615,11 @@ func doSendPushes(stopCh <-chan struct{}, semaphore chan struct{}, queue *PushQu
 }
 
 // initPushContext creates a global push context and stores it on the environment.
-func (s *DiscoveryServer) initPushContext(req *model.PushRequest, oldPushContext *model.PushContext) (*model.PushContext, error) {
+// The version is recorded on the push context, as the version of the config generated from it.
+func (s *DiscoveryServer) initPushContext(req *model.PushRequest, oldPushContext *model.PushContext,
+	version string) (*model.PushContext, error) {
 	push := model.NewPushContext()
+	push.PushVersion = version
 	if err := push.InitContext(s.Env, oldPushContext, req); err != nil {
 		adsLog.Errorf("XDS: Failed to update services: %v", err)
 		// We can't push if we can't read the data - stick with previous version.
@@ -460,8 +631,11 @@ func (s *DiscoveryServer) initPushContext(req *model.PushRequest, oldPushContext
 		return nil, err
 	}
 
+	// The context is only published once it is built, so readers of the environment keep the previous one
+	// while it is built.
 	s.updateMutex.Lock()
 	s.Env.PushContext = push
+	s.lastGoodPushContext = push
 	s.updateMutex.Unlock()
 
 	return push, nil
@@ -485,7 +659,37 @@ func (s *DiscoveryServer) initGenerators() {
 	s.Generators["event"] = s.InternalGen
 }
 
+// RegisterGenerator adds, or replaces, the generator with the given name. The name is matched against the
+// GENERATOR node metadata of the proxies, or the combination of GENERATOR and a type URL, as in
+// Generators. It is safe to call while connections exist: new connections use the registered generator,
+// while existing connections keep the default generator they were initialized with.
+func (s *DiscoveryServer) RegisterGenerator(name string, gen model.XdsResourceGenerator) {
+	s.generatorsMutex.Lock()
+	defer s.generatorsMutex.Unlock()
+	s.Generators[name] = gen
+}
+
+// UnregisterGenerator removes the generator with the given name. Existing connections initialized with it
+// keep using it, new connections requesting it are served by the built-in handlers.
+func (s *DiscoveryServer) UnregisterGenerator(name string) {
+	s.generatorsMutex.Lock()
+	defer s.generatorsMutex.Unlock()
+	delete(s.Generators, name)
+}
+
+// generator returns the generator with the given name, or nil.
+func (s *DiscoveryServer) generator(name string) model.XdsResourceGenerator {
+	s.generatorsMutex.RLock()
+	defer s.generatorsMutex.RUnlock()
+	return s.Generators[name]
+}
+
 // shutdown shutsdown DiscoveryServer components.
 func (s *DiscoveryServer) Shutdown() {
+	if path := features.WarmStartStatePath; path != "" {
+		if err := s.saveWarmStartState(path); err != nil {
+			adsLog.Warnf("Warm start: failed to save connection state to %s: %v", path, err)
+		}
+	}
 	s.pushQueue.ShutDown()
 }
@@ -16,6 +16,7 @@ package xds
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
@@ -24,8 +25,10 @@ import (
 	"time"
 
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/test/util/retry"
@@ -448,6 +451,9 @@ func TestShouldRespond(t *testing.T) {
 			if response := s.Discovery.shouldRespond(tt.connection, metric, tt.request); response != tt.response {
 				t.Fatalf("Unexpected value for response, expected %v, got %v", tt.response, response)
 			}
+			if tt.name == "resources change" && tt.connection.ResourceChurn() != 1 {
+				t.Fatalf("expected the resource change to be counted, got %d", tt.connection.ResourceChurn())
+			}
 			if tt.name != "reconnect" && tt.response {
 				if tt.connection.proxy.WatchedResources[tt.request.TypeUrl].VersionAcked != tt.request.VersionInfo &&
 					tt.connection.proxy.WatchedResources[tt.request.TypeUrl].NonceAcked != tt.request.ResponseNonce {
@@ -457,3 +463,297 @@ func TestShouldRespond(t *testing.T) {
 		})
 	}
 }
+
+func TestIsPushQueueReady(t *testing.T) {
+	defaultThreshold := features.PushQueueReadinessThreshold
+	defer func() { features.PushQueueReadinessThreshold = defaultThreshold }()
+
+	s := &DiscoveryServer{pushQueue: NewPushQueue()}
+	for _, p := range createProxies(3) {
+		s.pushQueue.Enqueue(p, &model.PushRequest{})
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		ready     bool
+	}{
+		{"disabled", 0, true},
+		{"below threshold", 5, true},
+		{"at threshold", 3, true},
+		{"above threshold", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			features.PushQueueReadinessThreshold = tt.threshold
+			ready, err := s.IsPushQueueReady()
+			if ready != tt.ready {
+				t.Fatalf("expected ready=%v, got %v (%v)", tt.ready, ready, err)
+			}
+			if !ready && err == nil {
+				t.Fatalf("expected an error describing the backlog")
+			}
+		})
+	}
+}
+
+func TestStartPushBatching(t *testing.T) {
+	defer func(fleetSize, batchSize int, interval time.Duration) {
+		features.PushBatchFleetSize = fleetSize
+		features.PushBatchSize = batchSize
+		features.PushBatchInterval = interval
+	}(features.PushBatchFleetSize, features.PushBatchSize, features.PushBatchInterval)
+	features.PushBatchFleetSize = 2
+	features.PushBatchSize = 2
+	features.PushBatchInterval = time.Millisecond
+
+	s := &DiscoveryServer{
+		adsClients: map[string]*Connection{},
+		pushQueue:  NewPushQueue(),
+	}
+	for _, p := range createProxies(5) {
+		s.adsClients[p.ConID] = p
+	}
+
+	s.startPush(&model.PushRequest{Full: true})
+	retry.UntilSuccessOrFail(t, func() error {
+		if pending := s.pushQueue.Pending(); pending != 5 {
+			return fmt.Errorf("expected all 5 connections to be enqueued, got %d", pending)
+		}
+		return nil
+	}, retry.Timeout(time.Second), retry.Delay(time.Millisecond))
+}
+
+func TestStartPushBatchingCancelled(t *testing.T) {
+	defer func(fleetSize, batchSize int, interval time.Duration) {
+		features.PushBatchFleetSize = fleetSize
+		features.PushBatchSize = batchSize
+		features.PushBatchInterval = interval
+	}(features.PushBatchFleetSize, features.PushBatchSize, features.PushBatchInterval)
+	features.PushBatchFleetSize = 2
+	features.PushBatchSize = 2
+	features.PushBatchInterval = time.Hour
+
+	s := &DiscoveryServer{
+		adsClients: map[string]*Connection{},
+		pushQueue:  NewPushQueue(),
+	}
+	for _, p := range createProxies(5) {
+		s.adsClients[p.ConID] = p
+	}
+
+	// The first batch is enqueued right away, the caller does not wait for the next ones.
+	s.startPush(&model.PushRequest{Full: true})
+	if pending := s.pushQueue.Pending(); pending != 2 {
+		t.Fatalf("expected the first 2 connections to be enqueued, got %d", pending)
+	}
+	done := s.pushGeneration(false)
+	select {
+	case <-done:
+		t.Fatal("the push generation ended before a newer full push")
+	default:
+	}
+
+	// An incremental push does not end the generation of the full push.
+	s.startPush(&model.PushRequest{Full: false})
+	select {
+	case <-done:
+		t.Fatal("an incremental push must not cancel the batches of the full push")
+	default:
+	}
+
+	s.startPush(&model.PushRequest{Full: true})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected a newer full push to cancel the remaining batches")
+	}
+}
+
+// servicesFunc overrides the services returned by a service registry.
+type servicesFunc struct {
+	model.ServiceDiscovery
+	services func() ([]*model.Service, error)
+}
+
+func (s servicesFunc) Services() ([]*model.Service, error) {
+	return s.services()
+}
+
+func TestServeStalePushContext(t *testing.T) {
+	defer func(old bool) { features.ServeStalePushContext = old }(features.ServeStalePushContext)
+	features.ServeStalePushContext = true
+
+	f := NewFakeDiscoveryServer(t, FakeOptions{})
+	env := *f.Env()
+	registry := env.ServiceDiscovery
+	s := NewDiscoveryServer(&env, nil)
+	good, err := s.initPushContext(&model.PushRequest{Full: true}, nil, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var building, published *model.PushContext
+	env.ServiceDiscovery = servicesFunc{ServiceDiscovery: registry, services: func() ([]*model.Service, error) {
+		building = s.globalPushContext()
+		s.updateMutex.RLock()
+		published = s.Env.PushContext
+		s.updateMutex.RUnlock()
+		return nil, errors.New("registry unavailable")
+	}}
+	if _, err := s.initPushContext(&model.PushRequest{Full: true}, good, "failed"); err == nil {
+		t.Fatalf("expected the push context to fail to build")
+	}
+	if building != good || published != good {
+		t.Fatalf("expected the last good push context to be served and published while the new one is built")
+	}
+	if got := s.globalPushContext(); got != good {
+		t.Fatalf("expected the last good push context to be restored, got version %q", got.PushVersion)
+	}
+	// A connection initializing the global push context is served the last good config.
+	if err := s.globalPushContext().InitContext(s.Env, nil, nil); err != nil {
+		t.Fatalf("expected the last good push context to be initialized, got %v", err)
+	}
+
+	env.ServiceDiscovery = registry
+	next, err := s.initPushContext(&model.PushRequest{Full: true}, good, "next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.globalPushContext(); got != next {
+		t.Fatalf("expected the new push context once it is built")
+	}
+}
+
+func TestShouldRespondEmptyResourceNames(t *testing.T) {
+	defer func(old string) { features.EmptyResourceNames = old }(features.EmptyResourceNames)
+
+	metric := monitoring.NewSum("test_empty", "test reject metric")
+	for _, typeURL := range []string{v3.EndpointType, v3.RouteType} {
+		for _, mode := range []string{emptyResourceNamesUnsubscribe, emptyResourceNamesRetain} {
+			t.Run(v3.GetShortType(typeURL)+"/"+mode, func(t *testing.T) {
+				features.EmptyResourceNames = mode
+				con := &Connection{
+					proxy: &model.Proxy{
+						WatchedResources: map[string]*model.WatchedResource{
+							typeURL: {
+								VersionSent:   "v1",
+								NonceSent:     "nonce",
+								ResourceNames: []string{"resource1"},
+							},
+						},
+					},
+				}
+				s := NewFakeDiscoveryServer(t, FakeOptions{})
+				request := &discovery.DiscoveryRequest{TypeUrl: typeURL, VersionInfo: "v1", ResponseNonce: "nonce"}
+				if s.Discovery.shouldRespond(con, metric, request) {
+					t.Fatalf("expected no response when the resource names become empty")
+				}
+				names := con.proxy.WatchedResources[typeURL].ResourceNames
+				if mode == emptyResourceNamesRetain && !reflect.DeepEqual(names, []string{"resource1"}) {
+					t.Fatalf("expected the previous resource names to be retained, got %v", names)
+				}
+				if mode == emptyResourceNamesUnsubscribe && len(names) != 0 {
+					t.Fatalf("expected the proxy to be unsubscribed, got %v", names)
+				}
+				if con.proxy.WatchedResources[typeURL].NonceAcked != "nonce" {
+					t.Fatalf("expected the ACK to be recorded")
+				}
+			})
+		}
+	}
+}
+
+func TestShouldRespondEmptyWildcardResourceNames(t *testing.T) {
+	metric := monitoring.NewSum("test_wildcard", "test reject metric")
+	for _, typeURL := range []string{v3.ClusterType, v3.ListenerType} {
+		t.Run(v3.GetShortType(typeURL), func(t *testing.T) {
+			con := &Connection{
+				proxy: &model.Proxy{
+					WatchedResources: map[string]*model.WatchedResource{
+						typeURL: {
+							VersionSent:   "v1",
+							NonceSent:     "nonce",
+							ResourceNames: []string{"resource1"},
+						},
+					},
+				},
+			}
+			s := NewFakeDiscoveryServer(t, FakeOptions{})
+			request := &discovery.DiscoveryRequest{TypeUrl: typeURL, VersionInfo: "v1", ResponseNonce: "nonce"}
+			if !s.Discovery.shouldRespond(con, metric, request) {
+				t.Fatalf("expected a wildcard subscription to be responded to")
+			}
+		})
+	}
+}
+
+func TestShouldRespondLastNack(t *testing.T) {
+	metric := monitoring.NewSum("test_last_nack", "test reject metric")
+	con := &Connection{
+		proxy: &model.Proxy{
+			WatchedResources: map[string]*model.WatchedResource{
+				v3.ListenerType: {VersionSent: "v1", NonceSent: "nonce"},
+			},
+		},
+	}
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.Discovery.shouldRespond(con, metric, &discovery.DiscoveryRequest{
+		TypeUrl:       v3.ListenerType,
+		ResponseNonce: "nonce",
+		ErrorDetail:   &status.Status{Code: 3, Message: "invalid listener"},
+	})
+	nack := con.LastNack(v3.ListenerType)
+	if nack == nil || nack.Code != 3 || nack.Message != "invalid listener" {
+		t.Fatalf("expected the NACK to be recorded, got %+v", nack)
+	}
+	if nacks := con.LastNacks(); nacks["LDS"] == nil {
+		t.Fatalf("expected the NACK to be listed by type, got %v", nacks)
+	}
+
+	s.Discovery.shouldRespond(con, metric, &discovery.DiscoveryRequest{TypeUrl: v3.ListenerType, VersionInfo: "v1", ResponseNonce: "nonce"})
+	if nack := con.LastNack(v3.ListenerType); nack != nil {
+		t.Fatalf("expected the ACK to clear the NACK, got %+v", nack)
+	}
+}
+
+func TestShouldRespondExpiredNonceResync(t *testing.T) {
+	old := features.ExpiredNonceResyncThreshold
+	defer func() { features.ExpiredNonceResyncThreshold = old }()
+	features.ExpiredNonceResyncThreshold = 3
+
+	metric := monitoring.NewSum("test_expired_nonce", "test reject metric")
+	con := &Connection{
+		proxy: &model.Proxy{
+			WatchedResources: map[string]*model.WatchedResource{
+				v3.ClusterType: {VersionSent: "v2", NonceSent: "nonce-2"},
+			},
+		},
+	}
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	stale := &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "v1", ResponseNonce: "nonce-1"}
+	for i := 0; i < 2; i++ {
+		if s.Discovery.shouldRespond(con, metric, stale) {
+			t.Fatalf("expected expired nonce %d to be ignored", i)
+		}
+	}
+	if !s.Discovery.shouldRespond(con, metric, stale) {
+		t.Fatalf("expected a response after 3 consecutive expired nonces")
+	}
+	if w := con.proxy.WatchedResources[v3.ClusterType]; w.NonceSent != "" || w.ExpiredNonces != 0 {
+		t.Fatalf("expected the watched state to be reset, got %+v", w)
+	}
+}
+
+func TestRegisterGenerator(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	gen := &InternalGen{Server: s.Discovery}
+	s.Discovery.RegisterGenerator("custom", gen)
+	if got := s.Discovery.generator("custom"); got != gen {
+		t.Fatalf("expected the registered generator, got %v", got)
+	}
+	s.Discovery.UnregisterGenerator("custom")
+	if got := s.Discovery.generator("custom"); got != nil {
+		t.Fatalf("expected the generator to be removed, got %v", got)
+	}
+}
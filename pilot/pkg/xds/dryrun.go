@@ -0,0 +1,190 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// PushPlan describes what a push would send to a proxy.
+type PushPlan struct {
+	// NeedsPush is false if the push would be skipped for the proxy.
+	NeedsPush bool `json:"needsPush"`
+	// Responses has one entry for each response that would be sent, in order.
+	Responses []PushPlanResponse `json:"responses,omitempty"`
+}
+
+// PushPlanResponse describes a single response of a push plan.
+type PushPlanResponse struct {
+	TypeURL   string `json:"typeUrl"`
+	Resources int    `json:"resources"`
+	Size      int    `json:"size"`
+}
+
+// DryRunPush reports what the push request would send to the connection, without sending anything.
+// The push runs against a copy of the connection, so the state of the real connection, such as the
+// nonces and versions sent, is not modified. If the request has no push context, the current one is used.
+func (s *DiscoveryServer) DryRunPush(conID string, req *model.PushRequest) (PushPlan, error) {
+	plan := PushPlan{}
+	s.adsClientsMutex.RLock()
+	con := s.adsClients[conID]
+	s.adsClientsMutex.RUnlock()
+	if con == nil {
+		return plan, fmt.Errorf("connection %s not found", conID)
+	}
+	if req.Push == nil {
+		req.Push = s.globalPushContext()
+	}
+
+	shadow, err := s.dryRunConnection(con)
+	if err != nil {
+		return plan, err
+	}
+	plan.NeedsPush, err = s.dryRun(shadow, req)
+	if err != nil {
+		return plan, err
+	}
+	plan.Responses = shadow.captured
+	return plan, nil
+}
+
+// ConfigSnapshot generates the full current config of all types watched by the connection, as the
+// responses a full push would send. Nothing is sent to the connection, and its state is not modified.
+func (s *DiscoveryServer) ConfigSnapshot(conID string) ([]*discovery.DiscoveryResponse, error) {
+	s.adsClientsMutex.RLock()
+	con := s.adsClients[conID]
+	s.adsClientsMutex.RUnlock()
+	if con == nil {
+		return nil, fmt.Errorf("connection %s not found", conID)
+	}
+	shadow, err := s.dryRunConnection(con)
+	if err != nil {
+		return nil, err
+	}
+	var responses []*discovery.DiscoveryResponse
+	shadow.capture = func(res *discovery.DiscoveryResponse) {
+		responses = append(responses, res)
+	}
+	req := &model.PushRequest{Full: true, Push: s.globalPushContext(), Reason: []model.TriggerReason{model.DebugTrigger}}
+	if _, err := s.dryRun(shadow, req); err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// dryRun runs the push request against a connection returned by dryRunConnection. It returns false if
+// the push would be skipped for the proxy.
+func (s *DiscoveryServer) dryRun(shadow *Connection, req *model.PushRequest) (bool, error) {
+	pushEv := &Event{pushRequest: req, done: func() {}}
+	push := req.Push
+	version := pushVersion(push)
+
+	if !req.Full {
+		if !ProxyNeedsPush(shadow.proxy, pushEv) {
+			return false, nil
+		}
+		edsUpdatedServices := model.ConfigNamesOfKind(req.ConfigsUpdated, gvk.ServiceEntry)
+		if len(shadow.Clusters()) > 0 && len(edsUpdatedServices) > 0 {
+			if err := s.pushEds(push, shadow, version, edsUpdatedServices); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+
+	if err := s.updateProxy(shadow.proxy, push); err != nil {
+		return false, err
+	}
+	if !ProxyNeedsPush(shadow.proxy, pushEv) {
+		return false, nil
+	}
+
+	if shadow.proxy.XdsResourceGenerator != nil {
+		for _, w := range shadow.proxy.WatchedResources {
+			if err := s.pushGeneratorV2(shadow, push, version, w, req.ConfigsUpdated); err != nil {
+				return true, err
+			}
+		}
+	}
+	pushTypes := PushTypeFor(shadow.proxy, pushEv)
+	if shadow.Watching(v3.ClusterType) && pushTypes[CDS] {
+		if err := s.pushCds(shadow, push, version); err != nil {
+			return true, err
+		}
+	}
+	if len(shadow.Clusters()) > 0 && pushTypes[EDS] {
+		if err := s.pushEds(push, shadow, version, nil); err != nil {
+			return true, err
+		}
+	}
+	if shadow.Watching(v3.ListenerType) && pushTypes[LDS] {
+		if err := s.pushLds(shadow, push, version); err != nil {
+			return true, err
+		}
+	}
+	if len(shadow.Routes()) > 0 && pushTypes[RDS] {
+		if err := s.pushRoute(shadow, push, version); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// dryRunConnection returns a copy of the connection whose responses are captured instead of sent.
+// The proxy is initialized again from the node of the connection, with a copy of its watched resources.
+func (s *DiscoveryServer) dryRunConnection(con *Connection) (*Connection, error) {
+	if con.node == nil {
+		return nil, fmt.Errorf("connection %s is not initialized", con.ConID)
+	}
+	proxy, err := s.initProxy(con.node)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Metadata.Generator != "" {
+		proxy.XdsResourceGenerator = s.generator(proxy.Metadata.Generator)
+	}
+	proxy.WatchedResources = map[string]*model.WatchedResource{}
+	con.proxy.RLock()
+	for typeURL, w := range con.proxy.WatchedResources {
+		wc := *w
+		proxy.WatchedResources[typeURL] = &wc
+	}
+	con.proxy.RUnlock()
+
+	shadow := &Connection{
+		ConID:   con.ConID,
+		Connect: con.Connect,
+		proxy:   proxy,
+		node:    con.node,
+	}
+	shadow.capture = func(res *discovery.DiscoveryResponse) {
+		sz := 0
+		for _, r := range res.Resources {
+			sz += len(r.Value)
+		}
+		shadow.captured = append(shadow.captured, PushPlanResponse{
+			TypeURL:   res.TypeUrl,
+			Resources: len(res.Resources),
+			Size:      sz,
+		})
+	}
+	return shadow, nil
+}
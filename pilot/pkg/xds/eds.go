@@ -22,6 +22,7 @@ import (
 	"github.com/golang/protobuf/ptypes/any"
 
 	networkingapi "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	networking "istio.io/istio/pilot/pkg/networking/core/v1alpha3"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/loadbalancer"
@@ -281,6 +282,15 @@ func (s *DiscoveryServer) generateEndpoints(b EndpointBuilder) *endpoint.Cluster
 		l.Endpoints = EndpointsByNetworkFilter(b.push, b.network, l.Endpoints)
 	}
 
+	// If locality truncation is enabled, only send the endpoints the proxy is likely to route to, keeping
+	// enough for locality failover.
+	if features.EDSLocalityTruncation && b.locality.GetRegion() != "" {
+		original := countLbEndpoints(l.Endpoints)
+		l.Endpoints = EndpointsByLocalityFilter(b.locality, features.EDSLocalityFallbackEndpoints, l.Endpoints)
+		xdsEdsLocalityEndpointsOriginal.Record(float64(original))
+		xdsEdsLocalityEndpointsSent.Record(float64(countLbEndpoints(l.Endpoints)))
+	}
+
 	// If locality aware routing is enabled, prioritize endpoints or set their lb weight.
 	// Failover should only be enabled when there is an outlier detection, otherwise Envoy
 	// will never detect the hosts are unhealthy and redirect traffic.
@@ -294,6 +304,15 @@ func (s *DiscoveryServer) generateEndpoints(b EndpointBuilder) *endpoint.Cluster
 	return l
 }
 
+// countLbEndpoints returns the number of endpoints in all the localities.
+func countLbEndpoints(endpoints []*endpoint.LocalityLbEndpoints) int {
+	n := 0
+	for _, ep := range endpoints {
+		n += len(ep.LbEndpoints)
+	}
+	return n
+}
+
 // EdsGenerator implements the new Generate method for EDS, using the in-memory, optimized endpoint
 // storage in DiscoveryServer.
 type EdsGenerator struct {
@@ -330,6 +349,14 @@ func (eds *EdsGenerator) Generate(proxy *model.Proxy, push *model.PushContext, w
 // pushEds is pushing EDS updates for a single connection. Called the first time
 // a client connects, for incremental updates and for full periodic updates.
 func (s *DiscoveryServer) pushEds(push *model.PushContext, con *Connection, version string, edsUpdatedServices map[string]struct{}) error {
+	return s.pushEdsClusters(push, con, version, con.Clusters(), edsUpdatedServices)
+}
+
+// pushEdsClusters pushes the endpoints of the given clusters, which may be a subset of the clusters watched
+// by the connection. Unlike CDS, EDS responses do not need to include every watched resource: the proxy
+// keeps the assignments of the clusters not included.
+func (s *DiscoveryServer) pushEdsClusters(push *model.PushContext, con *Connection, version string, clusters []string,
+	edsUpdatedServices map[string]struct{}) error {
 	pushStart := time.Now()
 	defer func() { edsPushTime.Record(time.Since(pushStart).Seconds()) }()
 
@@ -341,15 +368,21 @@ func (s *DiscoveryServer) pushEds(push *model.PushContext, con *Connection, vers
 	regenerated := 0
 	// All clusters that this endpoint is watching. For 1.0 - it's typically all clusters in the mesh.
 	// For 1.1+Sidecar - it's the small set of explicitly imported clusters, using the isolated DestinationRules
-	for _, clusterName := range con.Clusters() {
+	for _, clusterName := range clusters {
+		if err := con.contextErr(); err != nil {
+			return err
+		}
 		if edsUpdatedServices != nil {
 			_, _, hostname, _ := model.ParseSubsetKey(clusterName)
 			if _, ok := edsUpdatedServices[string(hostname)]; !ok {
 				// Cluster was not updated, skip recomputing. This happens when we get an incremental update for a
-				// specific Hostname. On connect or for full push edsUpdatedServices will be empty.
+				// specific Hostname, or a full push that only updated endpoints. On connect or for other full
+				// pushes edsUpdatedServices will be nil.
+				xdsEdsClustersSkipped.Increment()
 				continue
 			}
 		}
+		xdsEdsClustersComputed.Increment()
 		builder := NewEndpointBuilder(clusterName, con.proxy, push)
 		if marshalledEndpoint, f := s.cache.Get(builder); f {
 			resources = append(resources, marshalledEndpoint)
@@ -374,6 +407,7 @@ func (s *DiscoveryServer) pushEds(push *model.PushContext, con *Connection, vers
 		}
 	}
 
+	version = con.nextVersion(v3.EndpointType, version)
 	response := endpointDiscoveryResponse(resources, version, push.Version)
 	err := con.send(response)
 	if err != nil {
@@ -381,13 +415,14 @@ func (s *DiscoveryServer) pushEds(push *model.PushContext, con *Connection, vers
 		return err
 	}
 	edsPushes.Increment()
+	con.recordEdsRemovals(empty)
 
 	if edsUpdatedServices == nil {
 		adsLog.Infof("EDS: PUSH for node:%s clusters:%d endpoints:%d empty:%v cached:%v/%v",
-			con.proxy.ID, len(con.Clusters()), endpoints, empty, cached, cached+regenerated)
+			con.proxy.ID, len(clusters), endpoints, empty, cached, cached+regenerated)
 	} else {
 		adsLog.Debugf("EDS: PUSH INC for node:%s clusters:%d endpoints:%d empty:%v cached:%v/%v",
-			con.proxy.ID, len(con.Clusters()), endpoints, empty, cached, cached+regenerated)
+			con.proxy.ID, len(clusters), endpoints, empty, cached, cached+regenerated)
 	}
 	return nil
 }
@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// edsCoalescer accumulates incremental EDS pushes to each connection over a short window, and enqueues
+// them as a single push. Each new push extends the window, but a push is never held back for longer than
+// maxDelay after the first one was coalesced. If PILOT_COALESCE_FULL_PUSHES is enabled, full pushes are
+// accumulated as well, and the merged push is full if any of them was.
+type edsCoalescer struct {
+	queue    *PushQueue
+	window   time.Duration
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	pending map[*Connection]*coalescedPush
+}
+
+type coalescedPush struct {
+	request *model.PushRequest
+	first   time.Time
+	timer   *time.Timer
+}
+
+func newEdsCoalescer(queue *PushQueue, window, maxDelay time.Duration) *edsCoalescer {
+	return &edsCoalescer{
+		queue:    queue,
+		window:   window,
+		maxDelay: maxDelay,
+		pending:  map[*Connection]*coalescedPush{},
+	}
+}
+
+// Enqueue adds an incremental push for the connection, merging it with any push already being coalesced.
+func (c *edsCoalescer) Enqueue(con *Connection, req *model.PushRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, f := c.pending[con]; f {
+		if p.request.Full || req.Full {
+			fullCoalescedPushes.Increment()
+		} else {
+			edsCoalescedPushes.Increment()
+		}
+		p.request = p.request.Merge(req)
+		if remaining := c.maxDelay - time.Since(p.first); remaining > c.window {
+			p.timer.Reset(c.window)
+		}
+		return
+	}
+	p := &coalescedPush{request: req, first: time.Now()}
+	p.timer = time.AfterFunc(c.window, func() { c.flush(con, p) })
+	c.pending[con] = p
+}
+
+// flush enqueues the coalesced push. It is a no-op if the push was already flushed, which may happen
+// if the timer was reset while firing.
+func (c *edsCoalescer) flush(con *Connection, p *coalescedPush) {
+	c.mu.Lock()
+	if c.pending[con] != p {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.pending, con)
+	req := p.request
+	c.mu.Unlock()
+	c.queue.Enqueue(con, req)
+}
@@ -0,0 +1,92 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+func TestEdsCoalescer(t *testing.T) {
+	queue := NewPushQueue()
+	c := newEdsCoalescer(queue, 50*time.Millisecond, time.Second)
+	con := &Connection{ConID: "proxy1"}
+
+	c.Enqueue(con, &model.PushRequest{ConfigsUpdated: map[model.ConfigKey]struct{}{
+		{Kind: gvk.ServiceEntry, Name: "a"}: {},
+	}})
+	c.Enqueue(con, &model.PushRequest{ConfigsUpdated: map[model.ConfigKey]struct{}{
+		{Kind: gvk.ServiceEntry, Name: "b"}: {},
+	}})
+	if pending := queue.Pending(); pending != 0 {
+		t.Fatalf("expected pushes to be held back, got %d pending", pending)
+	}
+
+	got, req, _ := queue.Dequeue()
+	if got != con {
+		t.Fatalf("expected %v, got %v", con, got)
+	}
+	if len(req.ConfigsUpdated) != 2 {
+		t.Fatalf("expected a single push with both changes, got %v", req.ConfigsUpdated)
+	}
+}
+
+func TestEdsCoalescerMaxDelay(t *testing.T) {
+	queue := NewPushQueue()
+	c := newEdsCoalescer(queue, 50*time.Millisecond, 100*time.Millisecond)
+	con := &Connection{ConID: "proxy1"}
+
+	// Keep pushing changes more often than the window. The push must still go out after the max delay.
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				c.Enqueue(con, &model.PushRequest{})
+			}
+		}
+	}()
+	defer close(done)
+	c.Enqueue(con, &model.PushRequest{})
+	if got := getWithTimeout(queue); got != con {
+		t.Fatalf("expected push to be enqueued, got %v", got)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("expected push within the max delay, took %v", elapsed)
+	}
+}
+
+func TestEdsCoalescerFullPush(t *testing.T) {
+	queue := NewPushQueue()
+	c := newEdsCoalescer(queue, 50*time.Millisecond, time.Second)
+	con := &Connection{ConID: "proxy1"}
+
+	c.Enqueue(con, &model.PushRequest{Reason: []model.TriggerReason{model.EndpointUpdate}})
+	c.Enqueue(con, &model.PushRequest{Full: true, Reason: []model.TriggerReason{model.ConfigUpdate}})
+
+	_, req, _ := queue.Dequeue()
+	if !req.Full {
+		t.Fatalf("expected the merged push to be full")
+	}
+	if len(req.Reason) != 2 {
+		t.Fatalf("expected the reasons of both pushes, got %v", req.Reason)
+	}
+}
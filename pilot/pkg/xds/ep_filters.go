@@ -17,6 +17,7 @@ package xds
 import (
 	"net"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/wrappers"
@@ -124,6 +125,77 @@ func EndpointsByNetworkFilter(push *model.PushContext, proxyNetwork string, endp
 	return filtered
 }
 
+// EndpointsByLocalityFilter truncates the endpoints sent to a proxy to the ones it is likely to route to. All
+// the endpoints in the zone of the proxy are kept, and at most fallback endpoints of each other zone of its
+// region, and of each other region, so locality failover can still reach every zone and region. The
+// endpoints of a zone or region are taken in turn from each of its localities, to spread the failover load.
+// If the zone of the proxy has no endpoints, all the endpoints are kept, since they all take its traffic.
+func EndpointsByLocalityFilter(proxyLocality *core.Locality, fallback int,
+	endpoints []*endpoint.LocalityLbEndpoints) []*endpoint.LocalityLbEndpoints {
+	if proxyLocality.GetRegion() == "" {
+		return endpoints
+	}
+	isLocal := func(ep *endpoint.LocalityLbEndpoints) bool {
+		return ep.Locality.GetRegion() == proxyLocality.GetRegion() && ep.Locality.GetZone() == proxyLocality.GetZone()
+	}
+	local := false
+	for _, ep := range endpoints {
+		if isLocal(ep) && len(ep.LbEndpoints) > 0 {
+			local = true
+			break
+		}
+	}
+	if !local {
+		return endpoints
+	}
+	if fallback < 1 {
+		fallback = 1
+	}
+
+	// groups has the zone or region each locality falls back to, empty for the localities of the proxy zone.
+	groups := make([]string, len(endpoints))
+	// remaining is the number of endpoints that can still be kept in each group.
+	remaining := map[string]int{}
+	kept := make([][]*endpoint.LbEndpoint, len(endpoints))
+	for i, ep := range endpoints {
+		switch {
+		case isLocal(ep):
+			kept[i] = ep.LbEndpoints
+			continue
+		case ep.Locality.GetRegion() == proxyLocality.GetRegion():
+			groups[i] = ep.Locality.GetRegion() + "/" + ep.Locality.GetZone()
+		default:
+			groups[i] = ep.Locality.GetRegion()
+		}
+		remaining[groups[i]] = fallback
+	}
+	for n := 0; ; n++ {
+		added := false
+		for i, ep := range endpoints {
+			if groups[i] == "" || n >= len(ep.LbEndpoints) || remaining[groups[i]] == 0 {
+				continue
+			}
+			kept[i] = append(kept[i], ep.LbEndpoints[n])
+			remaining[groups[i]]--
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+
+	filtered := make([]*endpoint.LocalityLbEndpoints, 0, len(endpoints))
+	for i, ep := range endpoints {
+		switch {
+		case len(kept[i]) == len(ep.LbEndpoints):
+			filtered = append(filtered, ep)
+		case len(kept[i]) > 0:
+			filtered = append(filtered, createLocalityLbEndpoints(ep, kept[i]))
+		}
+	}
+	return filtered
+}
+
 // TODO: remove this, filtering should be done before generating the config, and
 // network metadata should not be included in output. A node only receives endpoints
 // in the same network as itself - so passing an network meta, with exactly
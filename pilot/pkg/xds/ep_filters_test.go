@@ -690,3 +690,45 @@ func createLbEndpoints(lbEpsInfo []*LbEpInfo) []*endpoint.LbEndpoint {
 
 	return lbEndpoints
 }
+
+func TestEndpointsByLocalityFilter(t *testing.T) {
+	locality := func(region, zone, subzone string, addresses ...string) *endpoint.LocalityLbEndpoints {
+		lbEps := make([]*endpoint.LbEndpoint, 0, len(addresses))
+		for _, addr := range addresses {
+			lbEps = append(lbEps, &endpoint.LbEndpoint{
+				HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{
+					Address: util.BuildAddress(addr, 80),
+				}},
+				LoadBalancingWeight: &wrappers.UInt32Value{Value: 1},
+			})
+		}
+		return createLocalityLbEndpoints(&endpoint.LocalityLbEndpoints{
+			Locality: &core.Locality{Region: region, Zone: zone, SubZone: subzone},
+		}, lbEps)
+	}
+	sent := func(endpoints []*endpoint.LocalityLbEndpoints) map[string]int {
+		out := map[string]int{}
+		for _, ep := range endpoints {
+			out[util.LocalityToString(ep.Locality)] = len(ep.LbEndpoints)
+		}
+		return out
+	}
+	endpoints := []*endpoint.LocalityLbEndpoints{
+		locality("r1", "z1", "s1", "1.0.0.1", "1.0.0.2", "1.0.0.3"),
+		locality("r1", "z1", "s2", "1.0.1.1"),
+		locality("r1", "z2", "s1", "1.1.0.1", "1.1.0.2", "1.1.0.3"),
+		locality("r2", "z1", "s1", "2.0.0.1", "2.0.0.2"),
+		locality("r2", "z2", "s1", "2.1.0.1", "2.1.0.2"),
+	}
+
+	got := sent(EndpointsByLocalityFilter(&core.Locality{Region: "r1", Zone: "z1"}, 2, endpoints))
+	expected := map[string]int{"r1/z1/s1": 3, "r1/z1/s2": 1, "r1/z2/s1": 2, "r2/z1/s1": 1, "r2/z2/s1": 1}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// Without endpoints in the zone of the proxy, all the endpoints take its traffic.
+	if got := sent(EndpointsByLocalityFilter(&core.Locality{Region: "r3", Zone: "z1"}, 2, endpoints)); len(got) != len(endpoints) {
+		t.Fatalf("expected all the endpoints, got %v", got)
+	}
+}
@@ -29,8 +29,10 @@ var AllEventTypes = []EventType{
 // EventHandler allows for generic monitoring of xDS ACKS and disconnects, for the purpose of tracking
 // Config distribution through the mesh.
 type DistributionStatusCache interface {
-	// RegisterEvent notifies the implementer of an xDS ACK, and must be non-blocking
-	RegisterEvent(conID string, eventType EventType, nonce string)
+	// RegisterEvent notifies the implementer of an xDS ACK, and must be non-blocking.
+	// initial is true while the connection has not yet ACKed any config of the type, so the initial
+	// distribution of config to a proxy can be told apart from later updates.
+	RegisterEvent(conID string, eventType EventType, nonce string, initial bool)
 	RegisterDisconnect(s string, types []EventType)
 	QueryLastNonce(conID string, eventType EventType) (noncePrefix string)
 }
@@ -16,10 +16,13 @@ package xds
 
 import (
 	"context"
+	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"google.golang.org/grpc"
@@ -230,6 +233,132 @@ func (f *FakeDiscoveryServer) Connect(p *model.Proxy, watch []string, wait []str
 	return adscConn
 }
 
+// ReplayLastNonce may be used as the ResponseNonce or VersionInfo of a request passed to ReplayConnection.Send.
+// It is replaced by the nonce or version of the last response of the same type sent on the connection, so
+// captured request sequences can be replayed even though the nonces and versions generated differ.
+const ReplayLastNonce = "$last"
+
+// ReplayStream is a DiscoveryStream that records the responses sent to it. It allows requests to be fed
+// directly through the request processing path, without a gRPC connection.
+type ReplayStream struct {
+	grpc.ServerStream
+
+	mu        sync.Mutex
+	responses []*discovery.DiscoveryResponse
+}
+
+var _ DiscoveryStream = &ReplayStream{}
+
+func (r *ReplayStream) Send(res *discovery.DiscoveryResponse) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses = append(r.responses, res)
+	return nil
+}
+
+func (r *ReplayStream) Recv() (*discovery.DiscoveryRequest, error) {
+	return nil, io.EOF
+}
+
+func (r *ReplayStream) Context() context.Context {
+	return context.Background()
+}
+
+// Responses returns all responses sent on the stream.
+func (r *ReplayStream) Responses() []*discovery.DiscoveryResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*discovery.DiscoveryResponse{}, r.responses...)
+}
+
+// ReplayConnection is a synthetic connection, used to replay a sequence of requests against the server
+// and assert the responses, for example to lock down ACK and NACK handling.
+type ReplayConnection struct {
+	f      *FakeDiscoveryServer
+	con    *Connection
+	stream *ReplayStream
+	last   map[string]*discovery.DiscoveryResponse
+}
+
+// NewReplayConnection creates a synthetic connection for the proxy. It is removed when the test ends.
+func (f *FakeDiscoveryServer) NewReplayConnection(p *model.Proxy) *ReplayConnection {
+	f.t.Helper()
+	p = f.SetupProxy(p)
+	stream := &ReplayStream{}
+	con := newConnection("replay", stream)
+	node := &core.Node{
+		Id:       p.ServiceNode(),
+		Metadata: p.Metadata.ToStruct(),
+		Locality: p.Locality,
+	}
+	if err := f.Discovery.initConnection(node, con); err != nil {
+		f.t.Fatalf("failed to initialize connection: %v", err)
+	}
+	f.t.Cleanup(func() {
+		f.Discovery.removeCon(con)
+	})
+	return &ReplayConnection{f: f, con: con, stream: stream, last: map[string]*discovery.DiscoveryResponse{}}
+}
+
+// ID returns the ID of the connection.
+func (r *ReplayConnection) ID() string {
+	return r.con.ConID
+}
+
+// Send processes the request as if it was received on the connection, and returns the responses sent for it.
+func (r *ReplayConnection) Send(req *discovery.DiscoveryRequest) []*discovery.DiscoveryResponse {
+	r.f.t.Helper()
+	if last := r.last[req.TypeUrl]; last != nil {
+		if req.ResponseNonce == ReplayLastNonce {
+			req.ResponseNonce = last.Nonce
+		}
+		if req.VersionInfo == ReplayLastNonce {
+			req.VersionInfo = last.VersionInfo
+		}
+	}
+	sent := len(r.stream.Responses())
+	if err := r.f.Discovery.processRequest(req, r.con); err != nil {
+		r.f.t.Fatalf("failed to process request: %v", err)
+	}
+	responses := r.stream.Responses()[sent:]
+	for _, res := range responses {
+		r.last[res.TypeUrl] = res
+	}
+	return responses
+}
+
+// Replay sends each request in order, and returns the responses sent for each of them.
+func (r *ReplayConnection) Replay(reqs []*discovery.DiscoveryRequest) [][]*discovery.DiscoveryResponse {
+	r.f.t.Helper()
+	out := make([][]*discovery.DiscoveryResponse, 0, len(reqs))
+	for _, req := range reqs {
+		out = append(out, r.Send(req))
+	}
+	return out
+}
+
+// Push pushes to the connection as the push queue would, and returns the responses sent. The request defaults to a
+// full push of the current push context. This exercises the same push path as real connections, so generators can
+// be tested together with the ACK and NACK handling driven by Send.
+func (r *ReplayConnection) Push(req *model.PushRequest) []*discovery.DiscoveryResponse {
+	r.f.t.Helper()
+	if req == nil {
+		req = &model.PushRequest{Full: true}
+	}
+	if req.Push == nil {
+		req.Push = r.f.PushContext()
+	}
+	sent := len(r.stream.Responses())
+	if err := r.f.Discovery.pushConnection(r.con, &Event{pushRequest: req, done: func() {}}); err != nil {
+		r.f.t.Fatalf("failed to push: %v", err)
+	}
+	responses := r.stream.Responses()[sent:]
+	for _, res := range responses {
+		r.last[res.TypeUrl] = res
+	}
+	return responses
+}
+
 func (f *FakeDiscoveryServer) Endpoints(p *model.Proxy) []*endpoint.ClusterLoadAssignment {
 	loadAssignments := make([]*endpoint.ClusterLoadAssignment, 0)
 	c := f.Clusters(p)
@@ -244,7 +373,7 @@ func (f *FakeDiscoveryServer) refreshPushContext() {
 	_, err := f.Discovery.initPushContext(&model.PushRequest{
 		Full:   true,
 		Reason: []model.TriggerReason{model.GlobalUpdate},
-	}, nil)
+	}, nil, versionInfo())
 	if err != nil {
 		f.t.Fatal(err)
 	}
@@ -16,6 +16,8 @@ package xds
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
@@ -40,6 +42,9 @@ type IstioControlPlaneInstance struct {
 
 var (
 	controlPlane *corev3.ControlPlane
+
+	// errUnsupportedType is returned when no generator is able to handle the requested type.
+	errUnsupportedType = errors.New("unsupported type")
 )
 
 // ControlPlane identifies the instance and Istio version.
@@ -71,38 +76,38 @@ func (s *DiscoveryServer) handleCustomGenerator(con *Connection, req *discovery.
 	resp := &discovery.DiscoveryResponse{
 		ControlPlane: ControlPlane(),
 		TypeUrl:      req.TypeUrl,
-		VersionInfo:  push.Version, // TODO: we can now generate per-type version !
+		VersionInfo:  con.nextVersion(req.TypeUrl, push.Version),
 		Nonce:        nonce(push.Version),
 	}
-	if push.Version == "" { // Usually in tests.
-		resp.VersionInfo = resp.Nonce
-	}
 
 	// XdsResourceGenerator is the default generator for this connection. We want to allow
 	// some types to use custom generators - for example EDS.
 	g := con.proxy.XdsResourceGenerator
-	if cg, f := s.Generators[con.proxy.Metadata.Generator+"/"+req.TypeUrl]; f {
+	if cg := s.generator(con.proxy.Metadata.Generator + "/" + req.TypeUrl); cg != nil {
 		g = cg
 	}
-	if cg, f := s.Generators[req.TypeUrl]; f {
+	if cg := s.generator(req.TypeUrl); cg != nil {
 		g = cg
 	}
 	if g == nil {
-		g = s.Generators["api"] // default to MCS generators - any type supported by store
+		g = s.generator("api") // default to MCS generators - any type supported by store
 	}
 
 	if g == nil {
-		return nil
+		return fmt.Errorf("%w %s", errUnsupportedType, req.TypeUrl)
 	}
 
-	cl := g.Generate(con.proxy, push, con.Watched(req.TypeUrl), nil)
+	cl, err := con.generate(g, push, push.Version, con.Watched(req.TypeUrl), nil)
+	if err != nil {
+		return err
+	}
 	sz := 0
 	for _, rc := range cl {
 		resp.Resources = append(resp.Resources, rc)
 		sz += len(rc.Value)
 	}
 
-	err := con.send(resp)
+	err = con.send(resp)
 	if err != nil {
 		recordSendError("ADS", con.ConID, apiSendErrPushes, err)
 		return err
@@ -121,13 +126,16 @@ func (s *DiscoveryServer) handleCustomGenerator(con *Connection, req *discovery.
 // Will not be called if ProxyNeedsPush returns false - ie. if the update
 func (s *DiscoveryServer) pushGeneratorV2(con *Connection, push *model.PushContext,
 	currentVersion string, w *model.WatchedResource, updates model.XdsUpdates) error {
-	gen := s.Generators[w.TypeUrl]
+	gen := s.generator(w.TypeUrl)
 	if gen == nil {
 		return nil
 	}
 	// TODO: generators may send incremental changes if both sides agree on the protocol.
 	// This is specific to each generator type.
-	cl := gen.Generate(con.proxy, push, w, updates)
+	cl, err := con.generate(gen, push, currentVersion, w, updates)
+	if err != nil {
+		return err
+	}
 	if cl == nil {
 		return nil // No push needed.
 	}
@@ -139,12 +147,12 @@ func (s *DiscoveryServer) pushGeneratorV2(con *Connection, push *model.PushConte
 
 	resp := &discovery.DiscoveryResponse{
 		TypeUrl:     w.TypeUrl,
-		VersionInfo: currentVersion,
+		VersionInfo: con.nextVersion(w.TypeUrl, currentVersion),
 		Nonce:       nonce(push.Version),
 		Resources:   cl,
 	}
 
-	err := con.send(resp)
+	err = con.send(resp)
 	if err != nil {
 		recordSendError("ADS", con.ConID, apiSendErrPushes, err)
 		return err
@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// keepalive checks the connections at every interval, and pushes the current config to the ones that did
+// not get a response for longer than idle. Some intermediaries close gRPC streams without traffic, so a
+// proxy whose config does not change would otherwise be disconnected.
+func (s *DiscoveryServer) keepalive(stopCh <-chan struct{}, interval, idle time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-t.C:
+			if n := s.pushIdleConnections(now, idle); n > 0 {
+				adsLog.Debugf("ADS: keepalive push to %d idle connections", n)
+			}
+		}
+	}
+}
+
+// pushIdleConnections enqueues a full push to the connections idle for longer than idle at now, and
+// returns their number. The pushes go through the push queue like any other, so they are merged with
+// pending pushes, and skipped for paused connections.
+func (s *DiscoveryServer) pushIdleConnections(now time.Time, idle time.Duration) int {
+	s.adsClientsMutex.RLock()
+	all := make([]*Connection, 0, len(s.adsClients))
+	for _, con := range s.adsClients {
+		all = append(all, con)
+	}
+	s.adsClientsMutex.RUnlock()
+
+	// The proxy locks are taken after releasing adsClientsMutex, so a slow proxy does not block connects.
+	var cons []*Connection
+	for _, con := range all {
+		if now.Sub(con.lastSent()) > idle {
+			cons = append(cons, con)
+		}
+	}
+	if len(cons) == 0 {
+		return 0
+	}
+	push := s.globalPushContext()
+	for _, con := range cons {
+		s.pushQueue.Enqueue(con, &model.PushRequest{
+			Full:   true,
+			Push:   push,
+			Start:  now,
+			Reason: []model.TriggerReason{model.KeepaliveTrigger},
+		})
+	}
+	xdsKeepalivePushes.Increment()
+	return len(cons)
+}
+
+// lastSent returns the time the last response of any type was sent on the connection, or the time it was
+// established if nothing was sent yet.
+func (conn *Connection) lastSent() time.Time {
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	last := conn.Connect
+	for _, w := range conn.proxy.WatchedResources {
+		if w.LastSent.After(last) {
+			last = w.LastSent
+		}
+	}
+	return last
+}
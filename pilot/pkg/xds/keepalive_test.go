@@ -0,0 +1,48 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestPushIdleConnections(t *testing.T) {
+	now := time.Now()
+	s := &DiscoveryServer{Env: &model.Environment{}, adsClients: map[string]*Connection{}, pushQueue: NewPushQueue()}
+	for id, lastSent := range map[string]time.Time{"idle": now.Add(-time.Hour), "active": now.Add(-time.Second)} {
+		con := newConnection("", nil)
+		con.ConID = id
+		con.Connect = now.Add(-2 * time.Hour)
+		con.proxy = &model.Proxy{WatchedResources: map[string]*model.WatchedResource{
+			v3.ClusterType: {TypeUrl: v3.ClusterType, LastSent: lastSent},
+		}}
+		s.adsClients[id] = con
+	}
+
+	if n := s.pushIdleConnections(now, time.Minute); n != 1 {
+		t.Fatalf("expected 1 idle connection, got %d", n)
+	}
+	con, req, _ := s.pushQueue.Dequeue()
+	if con.ConID != "idle" || !req.Full || req.Reason[0] != model.KeepaliveTrigger {
+		t.Fatalf("expected a keepalive push to the idle connection, got %v %+v", con.ConID, req)
+	}
+	if n := s.pushQueue.Pending(); n != 0 {
+		t.Fatalf("expected no other push, got %d pending", n)
+	}
+}
@@ -29,6 +29,7 @@ func (s *DiscoveryServer) pushLds(con *Connection, push *model.PushContext, vers
 	pushStart := time.Now()
 	defer func() { ldsPushTime.Record(time.Since(pushStart).Seconds()) }()
 
+	version = con.nextVersion(v3.ListenerType, version)
 	rawListeners := s.ConfigGenerator.BuildListeners(con.proxy, push)
 	response := ldsDiscoveryResponse(rawListeners, version, push.Version)
 	err := con.send(response)
@@ -38,7 +39,7 @@ func (s *DiscoveryServer) pushLds(con *Connection, push *model.PushContext, vers
 	}
 	ldsPushes.Increment()
 
-	adsLog.Infof("LDS: PUSH for node:%s listeners:%d", con.proxy.ID, len(rawListeners))
+	adsLog.Infof("LDS: PUSH for node:%s listeners:%d", con.proxy.ID, len(response.Resources))
 	return nil
 }
 
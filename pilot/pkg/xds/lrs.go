@@ -0,0 +1,149 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	lrs "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"istio.io/istio/pilot/pkg/features"
+)
+
+// ClusterLoad is the load reported by a proxy for an upstream cluster, over the last reporting interval.
+type ClusterLoad struct {
+	Cluster string `json:"cluster"`
+	// RequestsPerSecond is the rate of requests issued to the cluster, and ErrorsPerSecond the rate of
+	// requests that failed.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	ErrorsPerSecond   float64 `json:"errorsPerSecond"`
+	// Dropped is the number of requests dropped by the proxy before reaching the cluster.
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Interval is the reporting interval the load was measured over, and Time when it was received.
+	Interval time.Duration `json:"interval"`
+	Time     time.Time     `json:"time"`
+}
+
+// LoadStatsListener is notified of the load reported by proxies over LRS, for example to feed locality
+// load balancing or outlier analysis.
+type LoadStatsListener interface {
+	OnLoadStats(con *Connection, load []ClusterLoad)
+}
+
+// StreamLoadStats implements the Load Reporting Service. Proxies report the load of each cluster at the
+// interval set in PILOT_LOAD_REPORTING_INTERVAL, and the latest report is kept on the ADS connection of
+// the proxy, matched by node ID.
+func (s *DiscoveryServer) StreamLoadStats(stream lrs.LoadReportingService_StreamLoadStatsServer) error {
+	ids, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	if ids == nil && features.UnauthenticatedXDSPolicy == unauthenticatedDeny {
+		return status.Error(codes.Unauthenticated, "unauthenticated XDS connections are not allowed")
+	}
+	nodeID := ""
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			if isExpectedGRPCError(err) {
+				return nil
+			}
+			return err
+		}
+		if nodeID == "" {
+			// Only the first request is required to have the node.
+			if req.Node == nil || req.Node.Id == "" {
+				return errors.New("missing node ID")
+			}
+			nodeID = req.Node.Id
+			if err := stream.Send(&lrs.LoadStatsResponse{
+				SendAllClusters:       true,
+				LoadReportingInterval: ptypes.DurationProto(features.LoadReportingInterval),
+			}); err != nil {
+				return err
+			}
+		}
+		if len(req.ClusterStats) == 0 {
+			continue
+		}
+		con := s.connectionForNode(nodeID)
+		if con == nil {
+			adsLog.Debugf("LRS: dropping load report from %s, no XDS connection", nodeID)
+			continue
+		}
+		load := clusterLoad(req.ClusterStats, time.Now())
+		con.proxy.Lock()
+		con.loadStats = load
+		con.proxy.Unlock()
+		if s.LoadStatsListener != nil {
+			s.LoadStatsListener.OnLoadStats(con, load)
+		}
+	}
+}
+
+// connectionForNode returns the most recent connection of the proxy with the node ID, or nil if it is
+// not connected.
+func (s *DiscoveryServer) connectionForNode(nodeID string) *Connection {
+	s.adsClientsMutex.RLock()
+	defer s.adsClientsMutex.RUnlock()
+	var latest *Connection
+	for _, con := range s.adsClients {
+		if con.proxy != nil && con.proxy.ID == nodeID && (latest == nil || con.Connect.After(latest.Connect)) {
+			latest = con
+		}
+	}
+	return latest
+}
+
+// clusterLoad aggregates the load of each cluster over its localities, sorted by cluster name.
+func clusterLoad(stats []*endpoint.ClusterStats, now time.Time) []ClusterLoad {
+	load := make([]ClusterLoad, 0, len(stats))
+	for _, cs := range stats {
+		interval, err := ptypes.Duration(cs.LoadReportInterval)
+		if err != nil || interval <= 0 {
+			continue
+		}
+		var issued, errs uint64
+		for _, ls := range cs.UpstreamLocalityStats {
+			issued += ls.TotalIssuedRequests
+			errs += ls.TotalErrorRequests
+		}
+		load = append(load, ClusterLoad{
+			Cluster:           cs.ClusterName,
+			RequestsPerSecond: float64(issued) / interval.Seconds(),
+			ErrorsPerSecond:   float64(errs) / interval.Seconds(),
+			Dropped:           cs.TotalDroppedRequests,
+			Interval:          interval,
+			Time:              now,
+		})
+	}
+	sort.Slice(load, func(i, j int) bool {
+		return load[i].Cluster < load[j].Cluster
+	})
+	return load
+}
+
+// LoadStats returns the load last reported by the proxy over LRS, by cluster.
+func (conn *Connection) LoadStats() []ClusterLoad {
+	conn.proxy.RLock()
+	defer conn.proxy.RUnlock()
+	return append([]ClusterLoad(nil), conn.loadStats...)
+}
@@ -0,0 +1,119 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	lrs "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+type fakeLoadStatsStream struct {
+	grpc.ServerStream
+	requests  []*lrs.LoadStatsRequest
+	responses []*lrs.LoadStatsResponse
+}
+
+func (f *fakeLoadStatsStream) Context() context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{}})
+}
+
+func (f *fakeLoadStatsStream) Send(res *lrs.LoadStatsResponse) error {
+	f.responses = append(f.responses, res)
+	return nil
+}
+
+func (f *fakeLoadStatsStream) Recv() (*lrs.LoadStatsRequest, error) {
+	if len(f.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := f.requests[0]
+	f.requests = f.requests[1:]
+	return req, nil
+}
+
+func clusterStats(name string, issued, errs uint64) *endpoint.ClusterStats {
+	return &endpoint.ClusterStats{
+		ClusterName:        name,
+		LoadReportInterval: ptypes.DurationProto(10 * time.Second),
+		UpstreamLocalityStats: []*endpoint.UpstreamLocalityStats{
+			{TotalIssuedRequests: issued / 2, TotalErrorRequests: errs},
+			{TotalIssuedRequests: issued / 2},
+		},
+	}
+}
+
+func TestClusterLoad(t *testing.T) {
+	now := time.Now()
+	got := clusterLoad([]*endpoint.ClusterStats{clusterStats("b", 100, 10), clusterStats("a", 20, 0)}, now)
+	expected := []ClusterLoad{
+		{Cluster: "a", RequestsPerSecond: 2, Interval: 10 * time.Second, Time: now},
+		{Cluster: "b", RequestsPerSecond: 10, ErrorsPerSecond: 1, Interval: 10 * time.Second, Time: now},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+type recordingLoadStatsListener struct {
+	load []ClusterLoad
+}
+
+func (r *recordingLoadStatsListener) OnLoadStats(_ *Connection, load []ClusterLoad) {
+	r.load = load
+}
+
+func TestStreamLoadStats(t *testing.T) {
+	listener := &recordingLoadStatsListener{}
+	s := &DiscoveryServer{adsClients: map[string]*Connection{}, LoadStatsListener: listener}
+	con := newConnection("", nil)
+	con.ConID = "sidecar-1"
+	con.proxy = &model.Proxy{ID: "sidecar", Metadata: &model.NodeMetadata{}}
+	s.addCon(con.ConID, con)
+
+	stream := &fakeLoadStatsStream{requests: []*lrs.LoadStatsRequest{
+		{Node: &core.Node{Id: "sidecar"}},
+		{ClusterStats: []*endpoint.ClusterStats{clusterStats("a", 20, 0)}},
+	}}
+	if err := s.StreamLoadStats(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.responses) != 1 || !stream.responses[0].SendAllClusters {
+		t.Fatalf("expected a single response requesting all clusters, got %v", stream.responses)
+	}
+	if load := con.LoadStats(); len(load) != 1 || load[0].Cluster != "a" {
+		t.Fatalf("expected the load to be stored on the connection, got %+v", load)
+	}
+	if len(listener.load) != 1 {
+		t.Fatalf("expected the listener to be notified, got %+v", listener.load)
+	}
+
+	stream = &fakeLoadStatsStream{requests: []*lrs.LoadStatsRequest{{}}}
+	if err := s.StreamLoadStats(stream); err == nil {
+		t.Fatalf("expected an error without a node ID")
+	}
+}
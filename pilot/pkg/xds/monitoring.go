@@ -14,11 +14,15 @@
 package xds
 
 import (
+	"strconv"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc/codes"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/mcp/status"
 	"istio.io/pkg/monitoring"
 )
@@ -27,7 +31,16 @@ var (
 	errTag     = monitoring.MustCreateLabel("err")
 	nodeTag    = monitoring.MustCreateLabel("node")
 	typeTag    = monitoring.MustCreateLabel("type")
+	reasonTag  = monitoring.MustCreateLabel("reason")
+	phaseTag   = monitoring.MustCreateLabel("phase")
 	versionTag = monitoring.MustCreateLabel("version")
+	fullTag    = monitoring.MustCreateLabel("full")
+	sizeTag    = monitoring.MustCreateLabel("size")
+	ageTag     = monitoring.MustCreateLabel("age")
+	pendingTag = monitoring.MustCreateLabel("pending")
+	tenantTag  = monitoring.MustCreateLabel("tenant")
+	stageTag   = monitoring.MustCreateLabel("stage")
+	policyTag  = monitoring.MustCreateLabel("policy")
 
 	cdsReject = monitoring.NewGauge(
 		"pilot_xds_cds_reject",
@@ -81,6 +94,7 @@ var (
 	xdsResponseWriteTimeouts = monitoring.NewSum(
 		"pilot_xds_write_timeout",
 		"Pilot XDS response write timeouts.",
+		monitoring.WithLabels(sizeTag),
 	)
 
 	// Covers xds_builderr and xds_senderr for xds in {lds, rds, cds, eds}.
@@ -114,6 +128,36 @@ var (
 	ldsPushTime = pushTime.With(typeTag.Value("lds"))
 	rdsPushTime = pushTime.With(typeTag.Value("rds"))
 
+	connectionSetupTime = monitoring.NewDistribution(
+		"pilot_xds_connection_setup_time",
+		"Time in seconds spent in each phase of establishing an XDS connection.",
+		[]float64{.001, .01, .1, .5, 1, 3, 5, 10, 30},
+		monitoring.WithLabels(phaseTag),
+	)
+
+	firstTypePushTime = monitoring.NewDistribution(
+		"pilot_xds_first_push_time",
+		"Time in seconds from the connection of a proxy to the first response of each type sent to it.",
+		[]float64{.001, .01, .1, .5, 1, 3, 5, 10, 30},
+		monitoring.WithLabels(typeTag),
+	)
+
+	authenticateSetupTime = connectionSetupTime.With(phaseTag.Value("authenticate"))
+	initContextSetupTime  = connectionSetupTime.With(phaseTag.Value("init_context"))
+	initProxySetupTime    = connectionSetupTime.With(phaseTag.Value("init_proxy"))
+	firstPushSetupTime    = connectionSetupTime.With(phaseTag.Value("first_push"))
+
+	configSizeBytes = monitoring.NewDistribution(
+		"pilot_xds_config_size_bytes",
+		"Distribution of configuration sizes pushed to clients",
+		// Important boundaries: 10K, 1M, 4M, 10M, 40M
+		// 4M default limit for gRPC, 10M config will start to strain system,
+		// 40M is likely upper-bound on config sizes supported.
+		[]float64{1, 10000, 1000000, 4000000, 10000000, 40000000},
+		monitoring.WithLabels(typeTag),
+		monitoring.WithUnit(monitoring.Bytes),
+	)
+
 	// only supported dimension is millis, unfortunately. default to unitdimensionless.
 	proxiesQueueTime = monitoring.NewDistribution(
 		"pilot_proxy_queue_time",
@@ -128,6 +172,32 @@ var (
 	)
 
 	// only supported dimension is millis, unfortunately. default to unitdimensionless.
+	pushQueueWaitTime = monitoring.NewDistribution(
+		"pilot_xds_push_queue_wait_time",
+		"Time in seconds a connection waits in the push queue, from being enqueued until a worker picks it up.",
+		[]float64{.01, .1, 1, 3, 5, 10, 20, 30},
+	)
+
+	edsRemovals = monitoring.NewDistribution(
+		"pilot_xds_eds_removals",
+		"Number of clusters sent with an empty assignment, removing all their endpoints, in a single EDS push.",
+		[]float64{0, 1, 10, 100, 1000},
+	)
+
+	typePushTime = monitoring.NewDistribution(
+		"pilot_xds_type_push_time",
+		"Time in seconds to generate and send a type to a connection, labeled by type and whether the push was full.",
+		[]float64{.001, .01, .1, .5, 1, 3, 5, 10, 30},
+		monitoring.WithLabels(typeTag, fullTag),
+	)
+
+	pushTypesPerConnection = monitoring.NewDistribution(
+		"pilot_xds_push_types",
+		"Number of xDS types sent to a connection in a single push, labeled by whether the push was full.",
+		[]float64{0, 1, 2, 3, 4, 5},
+		monitoring.WithLabels(fullTag),
+	)
+
 	proxiesConvergeDelay = monitoring.NewDistribution(
 		"pilot_proxy_convergence_time",
 		"Delay in seconds between config change and a proxy receiving all required configuration.",
@@ -139,6 +209,270 @@ var (
 		"Number of errors (timeouts) initiating push context.",
 	)
 
+	xdsOverlappingPushes = monitoring.NewSum(
+		"pilot_xds_overlapping_pushes",
+		"Total number of pushes deferred because the connection already had the maximum number of pushes in flight.",
+	)
+
+	xdsConfigGrowth = monitoring.NewSum(
+		"pilot_xds_config_growth",
+		"Total number of responses whose size grew by more than the configured threshold since the previous response.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	initContextErrors = monitoring.NewSum(
+		"pilot_xds_init_context_errors",
+		"Total number of connections rejected because the push context could not be initialized, by reason.",
+		monitoring.WithLabels(reasonTag),
+	)
+
+	syncedProxies = monitoring.NewGauge(
+		"pilot_xds_synced_proxies_percent",
+		"Percentage of connected proxies that have ACKed a response for every type they watch.",
+	)
+
+	xdsConnectionAges = monitoring.NewGauge(
+		"pilot_xds_connection_ages",
+		"Number of connected proxies, by how long they have been connected.",
+		monitoring.WithLabels(ageTag),
+	)
+
+	xdsConnectionPushes = monitoring.NewGauge(
+		"pilot_xds_connection_pushes",
+		"Total number of pushes sent on the current connections.",
+	)
+
+	xdsPendingPushes = monitoring.NewGauge(
+		"pilot_xds_connection_pending_pushes",
+		"Number of connected proxies, by how many pushes are enqueued for them and not completed yet.",
+		monitoring.WithLabels(pendingTag),
+	)
+
+	xdsNackRate = monitoring.NewGauge(
+		"pilot_xds_nack_rate",
+		"NACKs per second over the PILOT_NACK_RATE_WINDOW rolling window, by type and proxy version.",
+		monitoring.WithLabels(typeTag, versionTag),
+	)
+
+	xdsRemovedConnectionPushes = monitoring.NewSum(
+		"pilot_xds_removed_connection_pushes",
+		"Total number of pushes skipped because the connection was removed after the push was enqueued.",
+	)
+
+	xdsRejectedConnections = monitoring.NewSum(
+		"pilot_xds_rejected_connections",
+		"Total number of XDS connections rejected because PILOT_MAX_XDS_CONNECTIONS were open.",
+	)
+
+	xdsNotReadyRejections = monitoring.NewSum(
+		"pilot_xds_not_ready_rejections",
+		"Total number of XDS connections rejected because the server was not ready.",
+	)
+
+	xdsRateLimitedConnections = monitoring.NewSum(
+		"pilot_xds_rate_limited_connections",
+		"Total number of XDS connections closed because they exceeded PILOT_XDS_REQUEST_QPS.",
+	)
+
+	xdsPushFailures = monitoring.NewSum(
+		"pilot_xds_push_failures",
+		"Total number of connections closed because a push failed, by the type that failed.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsEdsClustersComputed = monitoring.NewSum(
+		"pilot_xds_eds_clusters_computed",
+		"Total number of clusters whose endpoints were included in EDS pushes.",
+	)
+
+	xdsEdsClustersSkipped = monitoring.NewSum(
+		"pilot_xds_eds_clusters_skipped",
+		"Total number of clusters left out of EDS pushes because their service was not updated.",
+	)
+
+	xdsTenantConnections = monitoring.NewGauge(
+		"pilot_xds_tenant_connections",
+		"Number of XDS connections, by tenant, as identified by PILOT_XDS_TENANT_LABELS.",
+		monitoring.WithLabels(tenantTag),
+	)
+
+	xdsTenantResponses = monitoring.NewSum(
+		"pilot_xds_tenant_responses",
+		"Total number of XDS responses sent, by tenant, as identified by PILOT_XDS_TENANT_LABELS.",
+		monitoring.WithLabels(tenantTag),
+	)
+
+	xdsTenantBytesSent = monitoring.NewSum(
+		"pilot_xds_tenant_bytes_sent",
+		"Total size in bytes of the XDS resources sent, by tenant, as identified by PILOT_XDS_TENANT_LABELS.",
+		monitoring.WithLabels(tenantTag),
+	)
+
+	xdsMalformedNodes = monitoring.NewSum(
+		"pilot_xds_malformed_nodes",
+		"Total number of XDS connections rejected because their node could not be parsed, by reason.",
+		monitoring.WithLabels(reasonTag),
+	)
+
+	xdsDeltaUnchangedResources = monitoring.NewSum(
+		"pilot_xds_delta_unchanged_resources",
+		"Total number of resources not sent to delta clients because they already have the same version, "+
+			"including the versions reported on reconnect, by type.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsDuplicatePushesSuppressed = monitoring.NewSum(
+		"pilot_xds_duplicate_pushes_suppressed",
+		"Total number of pushes not sent to a stale connection of a proxy that has reconnected.",
+	)
+
+	pushQueueHighWatermark = monitoring.NewGauge(
+		"pilot_push_queue_high_watermark",
+		"Number of queued connections above which full pushes are shed, from PILOT_PUSH_QUEUE_HIGH_WATERMARK.",
+	)
+
+	pushQueueShedPushes = monitoring.NewSum(
+		"pilot_push_queue_shed_pushes",
+		"Total number of full pushes to connections being pushed, deferred until the push queue drops below "+
+			"the high watermark.",
+	)
+
+	xdsEdsLocalityEndpointsOriginal = monitoring.NewSum(
+		"pilot_xds_eds_locality_endpoints_original",
+		"Total number of endpoints of the cluster load assignments generated with PILOT_EDS_LOCALITY_TRUNCATION, "+
+			"before truncation.",
+	)
+
+	xdsEdsLocalityEndpointsSent = monitoring.NewSum(
+		"pilot_xds_eds_locality_endpoints_sent",
+		"Total number of endpoints of the cluster load assignments generated with PILOT_EDS_LOCALITY_TRUNCATION, "+
+			"after truncation.",
+	)
+
+	xdsCompressionSends = monitoring.NewSum(
+		"pilot_xds_compression_sends",
+		"Total number of compressed responses. The other responses, counted in pilot_xds_pushes, are sent "+
+			"uncompressed.",
+	)
+
+	xdsCompressionBytes = monitoring.NewSum(
+		"pilot_xds_compression_bytes",
+		"Total size of the compressed responses, before (uncompressed stage) and after (compressed stage) compression.",
+		monitoring.WithLabels(stageTag),
+	)
+
+	xdsShapeCacheHits = monitoring.NewSum(
+		"pilot_xds_shape_cache_hits",
+		"Total number of pushes served from resources generated for a proxy of the same shape, by type.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsShapeCacheMisses = monitoring.NewSum(
+		"pilot_xds_shape_cache_misses",
+		"Total number of pushes that generated resources not cached for the shape of the proxy, by type.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsOversizedResponses = monitoring.NewSum(
+		"pilot_xds_oversized_responses",
+		"Total number of responses not sent because they exceeded PILOT_XDS_MAX_RESPONSE_BYTES, by type.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsNonceResyncs = monitoring.NewSum(
+		"pilot_xds_nonce_resyncs",
+		"Total number of types reset after PILOT_EXPIRED_NONCE_RESYNC_THRESHOLD consecutive expired nonces, by type.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsTTLHeartbeats = monitoring.NewSum(
+		"pilot_xds_ttl_heartbeats",
+		"Total number of heartbeats sent to refresh the TTL of resources, by type.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsKeepalivePushes = monitoring.NewSum(
+		"pilot_xds_keepalive_pushes",
+		"Total number of pushes enqueued to keep idle connections alive.",
+	)
+
+	xdsSupersededPushes = monitoring.NewSum(
+		"pilot_xds_superseded_pushes",
+		"Total number of full pushes stopped because a newer full push to the same proxy was enqueued.",
+	)
+
+	xdsAckWaitTimeouts = monitoring.NewSum(
+		"pilot_xds_ack_wait_timeouts",
+		"Total number of pushes that timed out waiting for the previous response of the type to be ACKed.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsPushCircuitSkipped = monitoring.NewSum(
+		"pilot_xds_push_circuit_skipped",
+		"Total number of pushes skipped because the push circuit breaker of the connection was open.",
+	)
+
+	xdsGenerationErrors = monitoring.NewSum(
+		"pilot_xds_generation_errors",
+		"Total number of failures to generate config of a type for a proxy, when isolated from other types.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	edsCoalescedPushes = monitoring.NewSum(
+		"pilot_xds_eds_coalesced_pushes",
+		"Total number of incremental EDS pushes merged into a pending push to the same proxy.",
+	)
+
+	fullCoalescedPushes = monitoring.NewSum(
+		"pilot_xds_full_coalesced_pushes",
+		"Total number of pushes merged into a pending push to the same proxy, where either push was full.",
+	)
+
+	xdsThrottledReconnects = monitoring.NewSum(
+		"pilot_xds_throttled_reconnects",
+		"Total number of reconnecting proxies that had to wait before triggering a full config generation.",
+	)
+
+	invalidResourceNames = monitoring.NewSum(
+		"pilot_xds_invalid_resource_names",
+		"Total number of resource names requested by proxies that were dropped as invalid.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsUnsupportedTypeRequests = monitoring.NewSum(
+		"pilot_xds_unsupported_type_requests",
+		"Total number of XDS requests for a type URL that no generator supports.",
+	)
+
+	xdsUnauthenticatedConnections = monitoring.NewSum(
+		"pilot_xds_unauthenticated_connections",
+		"Total number of XDS connections without an authenticated identity, labeled by the policy handling them.",
+		monitoring.WithLabels(policyTag),
+	)
+
+	xdsUnauthenticatedRejections = monitoring.NewSum(
+		"pilot_xds_unauthenticated_rejections",
+		"Total number of XDS connections rejected because they have no authenticated identity, "+
+			"with PILOT_UNAUTHENTICATED_XDS_POLICY=deny.",
+	)
+
+	xdsResourceChurn = monitoring.NewSum(
+		"pilot_xds_resource_churn",
+		"Total number of requests changing the resource names a proxy subscribes to, after the initial request.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	xdsWarmupThrottledConnections = monitoring.NewSum(
+		"pilot_xds_warmup_throttled_connections",
+		"Total number of new connections delayed while Istiod is warming up.",
+	)
+
+	xdsUnknownGenerators = monitoring.NewSum(
+		"pilot_xds_unknown_generators",
+		"Total number of connections requesting a generator that is not registered. Depending on "+
+			"PILOT_UNKNOWN_GENERATOR_POLICY, they are rejected or served by the built-in handlers.",
+	)
+
 	totalXDSInternalErrors = monitoring.NewSum(
 		"pilot_total_xds_internal_errors",
 		"Total number of internal XDS errors in pilot.",
@@ -180,6 +514,31 @@ func recordSendError(xdsType string, conID string, metric monitoring.Metric, err
 	}
 }
 
+func recordConfigGrowth(typeURL string, conID string, previous, current int) {
+	threshold := features.XDSConfigGrowthThreshold
+	if threshold <= 0 || previous <= 0 {
+		return
+	}
+	if ratio := float64(current) / float64(previous); ratio > threshold {
+		adsLog.Warnf("%s: config for %s grew %.1fx, from %d to %d bytes", v3.GetShortType(typeURL), conID, ratio, previous, current)
+		xdsConfigGrowth.With(typeTag.Value(v3.GetMetricType(typeURL))).Increment()
+	}
+}
+
+func recordPushTypes(full bool, types int) {
+	pushTypesPerConnection.With(fullTag.Value(strconv.FormatBool(full))).Record(float64(types))
+}
+
+// recordTypePushTime records the duration of the push of a type to a connection, started at start.
+func recordTypePushTime(typeURL string, full bool, start time.Time) {
+	typePushTime.With(typeTag.Value(v3.GetShortType(typeURL)), fullTag.Value(strconv.FormatBool(full))).
+		Record(time.Since(start).Seconds())
+}
+
+func recordConfigSize(typeURL string, size int) {
+	configSizeBytes.With(typeTag.Value(v3.GetMetricType(typeURL))).Record(float64(size))
+}
+
 func incrementXDSRejects(metric monitoring.Metric, node, errCode string) {
 	if metric != nil {
 		metric.With(nodeTag.Value(node), errTag.Value(errCode)).Increment()
@@ -200,10 +559,64 @@ func init() {
 		xdsResponseWriteTimeouts,
 		pushes,
 		pushTime,
+		connectionSetupTime,
+		configSizeBytes,
 		proxiesConvergeDelay,
 		proxiesQueueTime,
+		pushQueueWaitTime,
+		pushTypesPerConnection,
+		typePushTime,
+		edsRemovals,
 		pushContextErrors,
 		totalXDSInternalErrors,
+		xdsUnsupportedTypeRequests,
+		xdsUnknownGenerators,
+		xdsWarmupThrottledConnections,
+		xdsResourceChurn,
+		xdsUnauthenticatedConnections,
+		xdsUnauthenticatedRejections,
+		invalidResourceNames,
+		xdsOverlappingPushes,
+		xdsConfigGrowth,
+		initContextErrors,
+		xdsThrottledReconnects,
+		edsCoalescedPushes,
+		fullCoalescedPushes,
+		xdsGenerationErrors,
+		xdsPushCircuitSkipped,
+		syncedProxies,
+		xdsConnectionAges,
+		xdsConnectionPushes,
+		xdsNackRate,
+		xdsRemovedConnectionPushes,
+		xdsAckWaitTimeouts,
+		xdsSupersededPushes,
+		xdsRejectedConnections,
+		xdsNotReadyRejections,
+		xdsOversizedResponses,
+		xdsNonceResyncs,
+		xdsTTLHeartbeats,
+		xdsKeepalivePushes,
+		xdsPendingPushes,
+		xdsRateLimitedConnections,
+		xdsPushFailures,
+		xdsCompressionSends,
+		xdsCompressionBytes,
+		xdsShapeCacheHits,
+		xdsShapeCacheMisses,
+		xdsEdsClustersComputed,
+		xdsEdsClustersSkipped,
+		xdsTenantConnections,
+		xdsTenantResponses,
+		xdsTenantBytesSent,
+		xdsMalformedNodes,
+		xdsDeltaUnchangedResources,
+		xdsDuplicatePushesSuppressed,
+		pushQueueHighWatermark,
+		pushQueueShedPushes,
+		firstTypePushTime,
+		xdsEdsLocalityEndpointsOriginal,
+		xdsEdsLocalityEndpointsSent,
 		inboundUpdates,
 		pushTriggers,
 	)
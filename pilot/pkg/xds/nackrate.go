@@ -0,0 +1,93 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"sync"
+	"time"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// nackRateKey identifies the NACKs of a type by proxies of an Istio version.
+type nackRateKey struct {
+	typeURL string
+	version string
+}
+
+// nackRateTracker maintains the rate of NACKs over a rolling window, by type and proxy version, so
+// alerts can fire on a spike of NACKs, for example during a rollout, and localize the rejecting cohort.
+type nackRateTracker struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// buckets counts the NACKs of each key, by the Unix second they were received in.
+	buckets map[nackRateKey]map[int64]int
+}
+
+func newNackRateTracker(window time.Duration) *nackRateTracker {
+	return &nackRateTracker{
+		window:  window,
+		buckets: map[nackRateKey]map[int64]int{},
+	}
+}
+
+// Record counts a NACK of the type by a proxy of the version.
+func (t *nackRateTracker) Record(typeURL, version string, now time.Time) {
+	if t == nil {
+		return
+	}
+	key := nackRateKey{typeURL: typeURL, version: version}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets[key] == nil {
+		t.buckets[key] = map[int64]int{}
+	}
+	t.buckets[key][now.Unix()]++
+}
+
+// Rates returns the NACKs per second of each key over the window ending at now. Keys without NACKs
+// in the window are returned once with a rate of 0, so their gauge is reset, and then forgotten.
+func (t *nackRateTracker) Rates(now time.Time) map[nackRateKey]float64 {
+	if t == nil {
+		return nil
+	}
+	oldest := now.Add(-t.window).Unix()
+	rates := map[nackRateKey]float64{}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, buckets := range t.buckets {
+		count := 0
+		for sec, n := range buckets {
+			if sec <= oldest {
+				delete(buckets, sec)
+				continue
+			}
+			count += n
+		}
+		if count == 0 {
+			delete(t.buckets, key)
+		}
+		rates[key] = float64(count) / t.window.Seconds()
+	}
+	return rates
+}
+
+// recordNackRates updates the NACK rate gauges.
+func (t *nackRateTracker) recordNackRates(now time.Time) {
+	for key, rate := range t.Rates(now) {
+		xdsNackRate.With(typeTag.Value(v3.GetMetricType(key.typeURL)), versionTag.Value(key.version)).Record(rate)
+	}
+}
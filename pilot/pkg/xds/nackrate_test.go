@@ -0,0 +1,54 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+	"time"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestNackRateTracker(t *testing.T) {
+	tracker := newNackRateTracker(10 * time.Second)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 20; i++ {
+		tracker.Record(v3.ClusterType, "1.8.0", now.Add(-time.Duration(i%5)*time.Second))
+	}
+	tracker.Record(v3.ListenerType, "1.7.0", now.Add(-time.Minute))
+
+	rates := tracker.Rates(now)
+	cds := nackRateKey{typeURL: v3.ClusterType, version: "1.8.0"}
+	lds := nackRateKey{typeURL: v3.ListenerType, version: "1.7.0"}
+	if rates[cds] != 2 {
+		t.Fatalf("expected 2 NACKs per second, got %v", rates[cds])
+	}
+	if rate, f := rates[lds]; !f || rate != 0 {
+		t.Fatalf("expected a rate of 0 for NACKs outside the window, got %v", rates)
+	}
+
+	// Once reported as 0, the key is forgotten.
+	rates = tracker.Rates(now)
+	if _, f := rates[lds]; f {
+		t.Fatalf("expected the expired key to be forgotten, got %v", rates)
+	}
+
+	// A nil tracker, when the rate is disabled, is a no-op.
+	var disabled *nackRateTracker
+	disabled.Record(v3.ClusterType, "1.8.0", now)
+	if rates := disabled.Rates(now); rates != nil {
+		t.Fatalf("expected no rates, got %v", rates)
+	}
+}
@@ -16,7 +16,10 @@ package xds
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 )
 
@@ -30,20 +33,100 @@ type PushQueue struct {
 	// queue maintains ordering of the queue
 	queue []*Connection
 
+	// incrementalQueue maintains ordering of the incremental pushes, if priority is set. Otherwise all
+	// pushes are in queue.
+	incrementalQueue []*Connection
+
 	// processing stores all connections that have been Dequeue(), but not MarkDone().
 	// The value stored will be initially be nil, but may be populated if the connection is Enqueue().
 	// If model.PushRequest is not nil, it will be Enqueued again once MarkDone has been called.
 	processing map[*Connection]*model.PushRequest
 
+	// enqueued stores the time each pending connection was first enqueued, to measure the time it
+	// spends waiting in the queue. Merged requests keep the earliest time.
+	enqueued map[*Connection]time.Time
+
 	shuttingDown bool
+
+	// priority is set to dequeue full pushes ahead of incremental pushes. To avoid starving incremental
+	// pushes, one is dequeued after fairness full pushes were dequeued while it was waiting.
+	priority   bool
+	fairness   int
+	fullStreak int
+
+	// watermark is the number of queued connections above which full pushes are shed. shedding is set
+	// while the queue is above the watermark, and recomputed on Enqueue and Dequeue. 0 disables shedding.
+	watermark int
+	shedding  bool
+
+	// shed stores the full pushes enqueued while shedding for connections being pushed. Rather than
+	// pushing them again with each intermediate version once done, a single full push with the latest
+	// push context is enqueued when the queue drops below the watermark.
+	shed map[*Connection]*model.PushRequest
 }
 
 func NewPushQueue() *PushQueue {
-	return &PushQueue{
+	p := &PushQueue{
 		pending:    make(map[*Connection]*model.PushRequest),
 		processing: make(map[*Connection]*model.PushRequest),
+		enqueued:   make(map[*Connection]time.Time),
+		shed:       make(map[*Connection]*model.PushRequest),
 		cond:       sync.NewCond(&sync.Mutex{}),
 	}
+	p.setPriority(features.PushQueuePriority, features.PushQueueFairness)
+	p.watermark = features.PushQueueHighWatermark
+	if p.watermark > 0 {
+		pushQueueHighWatermark.Record(float64(p.watermark))
+	}
+	return p
+}
+
+func (p *PushQueue) setPriority(priority bool, fairness int) {
+	p.priority = priority
+	if fairness < 1 {
+		fairness = 1
+	}
+	p.fairness = fairness
+}
+
+// push adds the connection at the end of the queue matching its request.
+func (p *PushQueue) push(con *Connection, request *model.PushRequest) {
+	if p.priority && !request.Full {
+		p.incrementalQueue = append(p.incrementalQueue, con)
+	} else {
+		p.queue = append(p.queue, con)
+	}
+}
+
+// pop removes the next connection to push. Full pushes are taken first if priority is set, unless an
+// incremental push has waited for fairness full pushes already.
+func (p *PushQueue) pop() *Connection {
+	var con *Connection
+	if len(p.incrementalQueue) > 0 && (len(p.queue) == 0 || p.fullStreak >= p.fairness) {
+		con, p.incrementalQueue = p.incrementalQueue[0], p.incrementalQueue[1:]
+		p.fullStreak = 0
+		return con
+	}
+	con, p.queue = p.queue[0], p.queue[1:]
+	if len(p.incrementalQueue) > 0 {
+		p.fullStreak++
+	}
+	return con
+}
+
+// promote moves a connection whose pending push became full to the queue of full pushes.
+func (p *PushQueue) promote(con *Connection) {
+	for i, c := range p.incrementalQueue {
+		if c == con {
+			p.incrementalQueue = append(p.incrementalQueue[:i], p.incrementalQueue[i+1:]...)
+			p.queue = append(p.queue, con)
+			return
+		}
+	}
+}
+
+func (p *PushQueue) len() int {
+	return len(p.queue) + len(p.incrementalQueue)
 }
 
 // Enqueue will mark a proxy as pending a push. If it is already pending, pushInfo will be merged.
@@ -56,45 +139,112 @@ func (p *PushQueue) Enqueue(con *Connection, pushRequest *model.PushRequest) {
 		return
 	}
 
+	if _, f := p.enqueued[con]; !f {
+		p.enqueued[con] = time.Now()
+	}
+	atomic.AddInt32(&con.pendingPushes, 1)
+	p.updateShedding()
+
 	// If its already in progress, merge the info and return
 	if request, f := p.processing[con]; f {
+		if p.shedding && pushRequest.Full {
+			// Defer the push until the queue drops below the watermark, so the connection is not pushed
+			// again for each intermediate version in the meantime.
+			p.shed[con] = p.shed[con].Merge(pushRequest)
+			pushQueueShedPushes.Increment()
+			return
+		}
 		p.processing[con] = request.Merge(pushRequest)
 		return
 	}
 
 	if request, f := p.pending[con]; f {
-		p.pending[con] = request.Merge(pushRequest)
+		merged := request.Merge(pushRequest)
+		p.pending[con] = merged
+		if p.priority && merged.Full && !request.Full {
+			p.promote(con)
+		}
 		return
 	}
 
 	p.pending[con] = pushRequest
-	p.queue = append(p.queue, con)
+	p.push(con, pushRequest)
 	// Signal waiters on Dequeue that a new item is available
 	p.cond.Signal()
 }
 
+// updateShedding recomputes whether the queue is above the watermark. Once it drops below, the shed pushes
+// are enqueued. Must be called with the lock held.
+func (p *PushQueue) updateShedding() {
+	if p.watermark <= 0 {
+		return
+	}
+	saturated := p.len() >= p.watermark
+	if saturated == p.shedding {
+		return
+	}
+	p.shedding = saturated
+	if saturated {
+		adsLog.Warnf("Push queue has %d connections, above the high watermark of %d, shedding full pushes",
+			p.len(), p.watermark)
+		return
+	}
+	adsLog.Infof("Push queue is below the high watermark of %d, no longer shedding full pushes, %d connections to push",
+		p.watermark, len(p.shed))
+	for con, request := range p.shed {
+		delete(p.shed, con)
+		if queued, f := p.processing[con]; f {
+			p.processing[con] = queued.Merge(request)
+			continue
+		}
+		if queued, f := p.pending[con]; f {
+			p.pending[con] = queued.Merge(request)
+			if p.priority && !queued.Full {
+				p.promote(con)
+			}
+			continue
+		}
+		if _, f := p.enqueued[con]; !f {
+			p.enqueued[con] = time.Now()
+		}
+		p.pending[con] = request
+		p.push(con, request)
+		p.cond.Signal()
+	}
+}
+
 // Remove a proxy from the queue. If there are no proxies ready to be removed, this will block
 func (p *PushQueue) Dequeue() (con *Connection, request *model.PushRequest, shutdown bool) {
 	p.cond.L.Lock()
 	defer p.cond.L.Unlock()
 
 	// Block until there is one to remove. Enqueue will signal when one is added.
-	for len(p.queue) == 0 && !p.shuttingDown {
+	for p.len() == 0 && !p.shuttingDown {
 		p.cond.Wait()
 	}
 
-	if len(p.queue) == 0 {
+	if p.len() == 0 {
 		// We must be shutting down.
 		return nil, nil, true
 	}
 
-	con, p.queue = p.queue[0], p.queue[1:]
+	con = p.pop()
 
 	request = p.pending[con]
 	delete(p.pending, con)
 
 	// Mark the connection as in progress
 	p.processing[con] = nil
+	// The push covers all the pushes enqueued so far, they are no longer pending once it is done.
+	con.dequeuedPushes = atomic.LoadInt32(&con.pendingPushes)
+
+	if t, f := p.enqueued[con]; f {
+		delete(p.enqueued, con)
+		wait := time.Since(t)
+		atomic.StoreInt64(&con.queueWait, int64(wait))
+		pushQueueWaitTime.Record(wait.Seconds())
+	}
+	p.updateShedding()
 
 	return con, request, false
 }
@@ -104,21 +254,44 @@ func (p *PushQueue) MarkDone(con *Connection) {
 	defer p.cond.L.Unlock()
 	request := p.processing[con]
 	delete(p.processing, con)
+	atomic.AddInt32(&con.pendingPushes, -con.dequeuedPushes)
+	con.dequeuedPushes = 0
 
 	// If the info is present, that means Enqueue was called while connection was not yet marked done.
 	// This means we need to add it back to the queue.
 	if request != nil {
 		p.pending[con] = request
-		p.queue = append(p.queue, con)
+		p.push(con, request)
 		p.cond.Signal()
 	}
 }
 
+// Supersede returns true if a full push was enqueued for the connection while the given push is being
+// processed. In that case the given push is merged into the newer one, so nothing it carried is lost,
+// and the caller should stop the given push: the newer one runs once it is marked done.
+func (p *PushQueue) Supersede(con *Connection, pushRequest *model.PushRequest) bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	newer := p.processing[con]
+	if newer == nil || !newer.Full {
+		return false
+	}
+	p.processing[con] = pushRequest.Merge(newer)
+	return true
+}
+
+// Forget drops the pushes deferred for a connection while shedding, once it is removed.
+func (p *PushQueue) Forget(con *Connection) {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	delete(p.shed, con)
+}
+
 // Get number of pending proxies
 func (p *PushQueue) Pending() int {
 	p.cond.L.Lock()
 	defer p.cond.L.Unlock()
-	return len(p.queue)
+	return p.len()
 }
 
 // ShutDown will cause queue to ignore all new items added to it. As soon as the
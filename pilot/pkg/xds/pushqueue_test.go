@@ -291,3 +291,167 @@ func TestProxyQueue(t *testing.T) {
 		}
 	})
 }
+
+func TestProxyQueueWait(t *testing.T) {
+	p := NewPushQueue()
+	con := &Connection{ConID: "proxy1"}
+	p.Enqueue(con, &model.PushRequest{})
+	time.Sleep(10 * time.Millisecond)
+	// Merging a request keeps the original enqueue time.
+	p.Enqueue(con, &model.PushRequest{})
+
+	if got := getWithTimeout(p); got != con {
+		t.Fatalf("expected %v, got %v", con, got)
+	}
+	if wait := con.QueueWait(); wait < 10*time.Millisecond {
+		t.Fatalf("expected queue wait of at least 10ms, got %v", wait)
+	}
+	p.MarkDone(con)
+}
+
+func TestProxyQueueSupersede(t *testing.T) {
+	p := NewPushQueue()
+	con := &Connection{ConID: "proxy1"}
+	current := &model.PushRequest{Full: true, Reason: []model.TriggerReason{model.ConfigUpdate}}
+	p.Enqueue(con, current)
+	_, req, _ := p.Dequeue()
+
+	if p.Supersede(con, req) {
+		t.Fatalf("expected no newer push")
+	}
+	p.Enqueue(con, &model.PushRequest{Reason: []model.TriggerReason{model.EndpointUpdate}})
+	if p.Supersede(con, req) {
+		t.Fatalf("expected an incremental push not to supersede a full push")
+	}
+	p.Enqueue(con, &model.PushRequest{Full: true, Reason: []model.TriggerReason{model.ProxyUpdate}})
+	if !p.Supersede(con, req) {
+		t.Fatalf("expected the newer full push to supersede the current one")
+	}
+	p.MarkDone(con)
+
+	_, merged, _ := p.Dequeue()
+	expected := []model.TriggerReason{model.ConfigUpdate, model.EndpointUpdate, model.ProxyUpdate}
+	if !merged.Full || !reflect.DeepEqual(merged.Reason, expected) {
+		t.Fatalf("expected the superseded push to be merged, got full=%v reasons %v", merged.Full, merged.Reason)
+	}
+}
+
+func TestProxyQueuePriority(t *testing.T) {
+	p := NewPushQueue()
+	p.setPriority(true, 2)
+	eds1 := &Connection{ConID: "eds1"}
+	eds2 := &Connection{ConID: "eds2"}
+	full := make([]*Connection, 0, 3)
+	p.Enqueue(eds1, &model.PushRequest{})
+	p.Enqueue(eds2, &model.PushRequest{})
+	for i := 0; i < 3; i++ {
+		con := &Connection{ConID: fmt.Sprintf("full%d", i)}
+		full = append(full, con)
+		p.Enqueue(con, &model.PushRequest{Full: true})
+	}
+	// An incremental push that becomes full is moved with the full pushes.
+	p.Enqueue(eds2, &model.PushRequest{Full: true})
+
+	// Full pushes go first, but an incremental push waits for at most 2 of them.
+	for _, expected := range []*Connection{full[0], full[1], eds1, full[2], eds2} {
+		ExpectDequeue(t, p, expected)
+	}
+	if p.Pending() != 0 {
+		t.Fatalf("expected an empty queue, got %d pending", p.Pending())
+	}
+}
+
+func TestProxyQueuePendingPushes(t *testing.T) {
+	p := NewPushQueue()
+	con := &Connection{ConID: "proxy1"}
+
+	p.Enqueue(con, &model.PushRequest{})
+	p.Enqueue(con, &model.PushRequest{})
+	if got := con.PendingPushes(); got != 2 {
+		t.Fatalf("expected 2 pending pushes, got %d", got)
+	}
+	got, _, _ := p.Dequeue()
+	// Enqueued while the merged push is processed, it is pushed again after it.
+	p.Enqueue(con, &model.PushRequest{})
+	if pending := got.PendingPushes(); pending != 3 {
+		t.Fatalf("expected 3 pending pushes while processing, got %d", pending)
+	}
+	p.MarkDone(got)
+	if pending := con.PendingPushes(); pending != 1 {
+		t.Fatalf("expected 1 pending push after the first is done, got %d", pending)
+	}
+	p.Dequeue()
+	p.MarkDone(con)
+	if pending := con.PendingPushes(); pending != 0 {
+		t.Fatalf("expected no pending pushes, got %d", pending)
+	}
+
+	for pending, expected := range map[int]string{0: "0", 1: "1", 5: "2-10", 11: ">10"} {
+		if got := pendingPushesBucket(pending); got != expected {
+			t.Errorf("pendingPushesBucket(%d): expected %q, got %q", pending, expected, got)
+		}
+	}
+}
+
+func TestProxyQueueShedding(t *testing.T) {
+	p := NewPushQueue()
+	p.watermark = 2
+	proxies := []*Connection{{ConID: "proxy1"}, {ConID: "proxy2"}, {ConID: "proxy3"}}
+	push := func(con *Connection, reason model.TriggerReason) {
+		p.Enqueue(con, &model.PushRequest{Full: true, Reason: []model.TriggerReason{reason}})
+	}
+
+	push(proxies[0], model.ServiceUpdate)
+	push(proxies[1], model.ServiceUpdate)
+	push(proxies[2], model.ServiceUpdate)
+	if !p.shedding {
+		t.Fatalf("expected the queue to shed pushes above the watermark")
+	}
+	// Pushes to queued connections are merged as usual, keeping all the reasons.
+	push(proxies[2], model.ConfigUpdate)
+	if got := p.pending[proxies[2]].Reason; len(got) != 2 {
+		t.Fatalf("expected the reasons to be merged, got %v", got)
+	}
+
+	// Full pushes for a connection being pushed are deferred, rather than pushed again once it is done.
+	ExpectDequeue(t, p, proxies[0])
+	push(proxies[0], model.ServiceUpdate)
+	push(proxies[0], model.ConfigUpdate)
+	p.MarkDone(proxies[0])
+	if _, f := p.pending[proxies[0]]; f {
+		t.Fatalf("expected the push to be deferred while shedding")
+	}
+
+	// Once the queue drops below the watermark, a single push merging the deferred ones is enqueued.
+	ExpectDequeue(t, p, proxies[1])
+	if p.shedding {
+		t.Fatalf("expected the queue to stop shedding below the watermark")
+	}
+	want := []model.TriggerReason{model.ServiceUpdate, model.ConfigUpdate}
+	if got := p.pending[proxies[0]]; got == nil || !reflect.DeepEqual(got.Reason, want) {
+		t.Fatalf("expected the deferred pushes to be enqueued with reasons %v, got %v", want, got)
+	}
+	ExpectDequeue(t, p, proxies[2])
+	ExpectDequeue(t, p, proxies[0])
+	ExpectTimeout(t, p)
+}
+
+func TestProxyQueueForget(t *testing.T) {
+	p := NewPushQueue()
+	p.watermark = 1
+	removed, other := &Connection{ConID: "removed"}, &Connection{ConID: "other"}
+
+	p.Enqueue(removed, &model.PushRequest{Full: true})
+	ExpectDequeue(t, p, removed)
+	p.Enqueue(other, &model.PushRequest{Full: true})
+	p.Enqueue(removed, &model.PushRequest{Full: true})
+	if _, f := p.shed[removed]; !f {
+		t.Fatalf("expected the push to be deferred while shedding")
+	}
+
+	// The push deferred for a removed connection is dropped, not enqueued below the watermark.
+	p.Forget(removed)
+	p.MarkDone(removed)
+	ExpectDequeue(t, p, other)
+	ExpectTimeout(t, p)
+}
@@ -30,6 +30,7 @@ func (s *DiscoveryServer) pushRoute(con *Connection, push *model.PushContext, ve
 	defer func() { rdsPushTime.Record(time.Since(pushStart).Seconds()) }()
 
 	rawRoutes := s.ConfigGenerator.BuildHTTPRoutes(con.proxy, push, con.Routes())
+	version = con.nextVersion(v3.RouteType, version)
 	response := routeDiscoveryResponse(rawRoutes, version, push.Version)
 	err := con.send(response)
 	if err != nil {
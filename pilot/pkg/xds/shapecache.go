@@ -0,0 +1,154 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// maxShapeCacheEntries bounds the number of proxy shapes cached for a push context.
+const maxShapeCacheEntries = 1000
+
+// proxyShapeCache caches the CDS resources generated for a proxy, to send them to the proxies of the same
+// shape: the proxies for which the generation has the same inputs, for example the replicas of a deployment.
+// Entries are only valid for the push context they were generated from. Rather than tracking the configs
+// each entry depends on, the cache is reset when the push context changes.
+//
+// LDS is not cached: the inbound listeners are bound to the addresses of the proxy, so the listeners of two
+// replicas always differ.
+type proxyShapeCache struct {
+	mu          sync.Mutex
+	pushVersion string
+	entries     map[string][]*any.Any
+}
+
+func newProxyShapeCache() *proxyShapeCache {
+	return &proxyShapeCache{entries: map[string][]*any.Any{}}
+}
+
+// get returns the resources cached for the key by the given push, if any. The returned slice is a copy,
+// since responses are sorted in place, but the resources are shared and must not be modified.
+func (c *proxyShapeCache) get(pushVersion, key string) ([]*any.Any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pushVersion != pushVersion {
+		return nil, false
+	}
+	resources, f := c.entries[key]
+	if !f {
+		return nil, false
+	}
+	return append([]*any.Any(nil), resources...), true
+}
+
+// add caches the resources generated by the given push for the key.
+func (c *proxyShapeCache) add(pushVersion, key string, resources []*any.Any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pushVersion != pushVersion {
+		c.pushVersion = pushVersion
+		c.entries = map[string][]*any.Any{}
+	}
+	if len(c.entries) >= maxShapeCacheEntries {
+		return
+	}
+	c.entries[key] = append([]*any.Any(nil), resources...)
+}
+
+// instanceMetadata are the node metadata fields that differ between the replicas of a workload, but do not
+// change the generated CDS.
+var instanceMetadata = map[string]struct{}{
+	"NAME":         {},
+	"INSTANCE_IPS": {},
+}
+
+// proxyShapeKey returns the key of the resources of the given type generated for the proxy. Proxies with
+// the same key get the same resources from the same push context. Inputs are only left out of the key if
+// they do not change the generated resources: a missing input would send the config of another proxy.
+func proxyShapeKey(typeURL string, proxy *model.Proxy) string {
+	shape := map[string]interface{}{
+		"type":      typeURL,
+		"proxyType": proxy.Type,
+		"namespace": proxy.ConfigNamespace,
+		"dnsDomain": proxy.DNSDomain,
+		"locality":  util.LocalityToString(proxy.Locality),
+		"ipv4":      proxy.SupportsIPv4(),
+		"ipv6":      proxy.SupportsIPv6(),
+	}
+	if proxy.Metadata != nil {
+		if proxy.Metadata.Raw != nil {
+			metadata := make(map[string]interface{}, len(proxy.Metadata.Raw))
+			for k, v := range proxy.Metadata.Raw {
+				if _, f := instanceMetadata[k]; !f {
+					metadata[k] = v
+				}
+			}
+			shape["metadata"] = metadata
+		} else {
+			metadata := *proxy.Metadata
+			metadata.InstanceIPs = nil
+			shape["metadata"] = metadata
+		}
+	}
+	instances := make([]string, 0, len(proxy.ServiceInstances))
+	for _, si := range proxy.ServiceInstances {
+		if si.Service == nil || si.ServicePort == nil || si.Endpoint == nil {
+			continue
+		}
+		instances = append(instances,
+			fmt.Sprintf("%s/%s/%d/%d", si.Service.Hostname, si.ServicePort.Name, si.ServicePort.Port, si.Endpoint.EndpointPort))
+	}
+	sort.Strings(instances)
+	shape["instances"] = instances
+
+	// Maps are marshaled with sorted keys, so the same shape always has the same key.
+	b, err := json.Marshal(shape)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedShapeResources returns the resources of the type generated for a proxy of the same shape from the
+// same push, and the key to cache them under on a miss. The key is empty if the resources can't be cached,
+// which is always the case for other types than CDS.
+func (s *DiscoveryServer) cachedShapeResources(typeURL string, con *Connection, push *model.PushContext) ([]*any.Any, string) {
+	if s.shapeCache == nil || typeURL != v3.ClusterType || con.proxy.XdsResourceGenerator != nil {
+		return nil, ""
+	}
+	key := proxyShapeKey(typeURL, con.proxy)
+	if key == "" {
+		return nil, ""
+	}
+	resources, f := s.shapeCache.get(pushVersion(push), key)
+	metric := xdsShapeCacheMisses
+	if f {
+		metric = xdsShapeCacheHits
+	}
+	metric.With(typeTag.Value(v3.GetMetricType(typeURL))).Increment()
+	return resources, key
+}
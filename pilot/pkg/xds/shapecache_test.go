@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestProxyShapeKey(t *testing.T) {
+	proxy := func(name, namespace, ip string) *model.Proxy {
+		return &model.Proxy{
+			Type:            model.SidecarProxy,
+			ConfigNamespace: namespace,
+			IPAddresses:     []string{ip},
+			Metadata: &model.NodeMetadata{Raw: map[string]interface{}{
+				"NAME":         name,
+				"NAMESPACE":    namespace,
+				"INSTANCE_IPS": ip,
+			}},
+		}
+	}
+
+	a := proxy("a", "default", "10.0.0.1")
+	b := proxy("b", "default", "10.0.0.2")
+	if proxyShapeKey(v3.ClusterType, a) != proxyShapeKey(v3.ClusterType, b) {
+		t.Errorf("expected replicas to share CDS")
+	}
+	if proxyShapeKey(v3.ClusterType, a) == proxyShapeKey(v3.ClusterType, proxy("a", "other", "10.0.0.1")) {
+		t.Errorf("expected namespaces not to share CDS")
+	}
+}
+
+func TestProxyShapeCache(t *testing.T) {
+	c := newProxyShapeCache()
+	resources := []*any.Any{{TypeUrl: v3.ClusterType}}
+	c.add("1", "key", resources)
+
+	got, f := c.get("1", "key")
+	if !f || len(got) != 1 || got[0] != resources[0] {
+		t.Fatalf("expected cached resources, got %v", got)
+	}
+	got[0] = nil
+	if got, _ := c.get("1", "key"); got[0] == nil {
+		t.Errorf("expected get to return a copy")
+	}
+	if _, f := c.get("2", "key"); f {
+		t.Errorf("expected no resources for another push")
+	}
+
+	c.add("2", "other", resources)
+	if _, f := c.get("1", "key"); f {
+		t.Errorf("expected a new push to reset the cache")
+	}
+	if _, f := c.get("2", "other"); !f {
+		t.Errorf("expected cached resources for the new push")
+	}
+}
+
+func TestProxyShapeCacheOnlyCDS(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.Discovery.shapeCache = newProxyShapeCache()
+	a := s.NewReplayConnection(&model.Proxy{IPAddresses: []string{"10.0.0.1"}})
+	b := s.NewReplayConnection(&model.Proxy{IPAddresses: []string{"10.0.0.2"}})
+
+	if res := a.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}); len(res) != 1 {
+		t.Fatalf("expected a cluster response, got %v", res)
+	}
+	if _, key := s.Discovery.cachedShapeResources(v3.ListenerType, a.con, s.PushContext()); key != "" {
+		t.Fatalf("expected listeners not to be cached")
+	}
+	cached, _ := s.Discovery.cachedShapeResources(v3.ClusterType, b.con, s.PushContext())
+	if cached == nil {
+		t.Fatalf("expected the clusters of a replica to be cached")
+	}
+
+	// The listeners of each replica are bound to its own address.
+	for _, con := range []*ReplayConnection{a, b} {
+		res := con.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ListenerType})
+		if len(res) != 1 {
+			t.Fatalf("expected a listener response, got %v", res)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// TenantUsage is the XDS load attributed to a tenant.
+type TenantUsage struct {
+	// Connections is the number of connections of the tenant.
+	Connections int64 `json:"connections"`
+	// Responses is the number of responses sent to the tenant.
+	Responses int64 `json:"responses"`
+	// BytesSent is the size of the resources sent to the tenant.
+	BytesSent int64 `json:"bytesSent"`
+}
+
+// tenantUsage accumulates the usage of a tenant. Counters are accessed atomically.
+type tenantUsage struct {
+	name  string
+	usage TenantUsage
+}
+
+// sent records a response of the given size sent to the tenant.
+func (u *tenantUsage) sent(size int) {
+	atomic.AddInt64(&u.usage.Responses, 1)
+	atomic.AddInt64(&u.usage.BytesSent, int64(size))
+	xdsTenantResponses.With(tenantTag.Value(u.name)).Increment()
+	xdsTenantBytesSent.With(tenantTag.Value(u.name)).Record(float64(size))
+}
+
+// tenantStats attributes the XDS load to tenants, identified by the values of the node labels in
+// PILOT_XDS_TENANT_LABELS. Only these labels are used, to bound the number of tenants.
+type tenantStats struct {
+	keys []string
+
+	mu      sync.Mutex
+	tenants map[string]*tenantUsage
+}
+
+// newTenantStats returns the stats of the tenants identified by the given comma separated label keys, or
+// nil if there are none.
+func newTenantStats(labels string) *tenantStats {
+	var keys []string
+	for _, k := range strings.Split(labels, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return &tenantStats{keys: keys, tenants: map[string]*tenantUsage{}}
+}
+
+// tenantOf returns the tenant of a proxy, formatted as the tenant label keys and values.
+func (t *tenantStats) tenantOf(proxy *model.Proxy) string {
+	var labels map[string]string
+	if proxy.Metadata != nil {
+		labels = proxy.Metadata.Labels
+	}
+	parts := make([]string, 0, len(t.keys))
+	for _, k := range t.keys {
+		parts = append(parts, k+"="+labels[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// connect records a connection of the tenant, and returns the usage to record its responses in.
+func (t *tenantStats) connect(tenant string) *tenantUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.tenants[tenant]
+	if u == nil {
+		u = &tenantUsage{name: tenant}
+		t.tenants[tenant] = u
+	}
+	connections := atomic.AddInt64(&u.usage.Connections, 1)
+	xdsTenantConnections.With(tenantTag.Value(tenant)).Record(float64(connections))
+	return u
+}
+
+// disconnect records the end of a connection of the tenant.
+func (t *tenantStats) disconnect(u *tenantUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	connections := atomic.AddInt64(&u.usage.Connections, -1)
+	xdsTenantConnections.With(tenantTag.Value(u.name)).Record(float64(connections))
+}
+
+// TenantsSnapshot returns the XDS load of each tenant, by tenant, or nil if PILOT_XDS_TENANT_LABELS is not
+// set. The responses and bytes sent include the connections that were closed.
+func (s *DiscoveryServer) TenantsSnapshot() map[string]TenantUsage {
+	if s.tenants == nil {
+		return nil
+	}
+	s.tenants.mu.Lock()
+	defer s.tenants.mu.Unlock()
+	out := make(map[string]TenantUsage, len(s.tenants.tenants))
+	for name, u := range s.tenants.tenants {
+		out[name] = TenantUsage{
+			Connections: atomic.LoadInt64(&u.usage.Connections),
+			Responses:   atomic.LoadInt64(&u.usage.Responses),
+			BytesSent:   atomic.LoadInt64(&u.usage.BytesSent),
+		}
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestTenantStats(t *testing.T) {
+	if newTenantStats(" , ") != nil {
+		t.Fatalf("expected no stats without tenant labels")
+	}
+	stats := newTenantStats("team, tenant")
+	proxy := &model.Proxy{Metadata: &model.NodeMetadata{Labels: map[string]string{
+		"tenant": "a",
+		"team":   "x",
+		"app":    "foo",
+	}}}
+	tenant := stats.tenantOf(proxy)
+	if tenant != "team=x,tenant=a" {
+		t.Fatalf("expected tenant from the tenant labels only, got %q", tenant)
+	}
+
+	s := &DiscoveryServer{tenants: stats}
+	first := stats.connect(tenant)
+	second := stats.connect(tenant)
+	first.sent(100)
+	second.sent(50)
+	stats.disconnect(first)
+
+	expected := map[string]TenantUsage{tenant: {Connections: 1, Responses: 2, BytesSent: 150}}
+	if got := s.TenantsSnapshot(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// TTLResource is a generated resource, with the TTL after which the proxy removes it unless it is refreshed.
+type TTLResource struct {
+	Name     string
+	Resource *any.Any
+	// TTL is 0 for resources that do not expire.
+	TTL time.Duration
+}
+
+// TTLGenerator is implemented by generators attaching a TTL to individual resources, so transient resources
+// expire on the proxy if the control plane stops refreshing them, for example when it is gone. The resources
+// with a TTL are sent in a discovery.Resource envelope, and refreshed by heartbeats until the next push.
+type TTLGenerator interface {
+	model.XdsResourceGenerator
+
+	// GenerateWithTTL generates the resources like Generate, with their TTL.
+	GenerateWithTTL(proxy *model.Proxy, push *model.PushContext, w *model.WatchedResource,
+		updates model.XdsUpdates) []TTLResource
+}
+
+// ttlResponse is the last response of a type with at least one resource with a TTL.
+type ttlResponse struct {
+	// version and noncePrefix are the push version and config version of the response.
+	version     string
+	noncePrefix string
+	resources   []TTLResource
+	// interval is the heartbeat interval, half of the shortest TTL.
+	interval time.Duration
+}
+
+// ttlHeartbeats tracks the resources with a TTL sent on a connection. It is only accessed from the
+// connection goroutine, like the pushes.
+type ttlHeartbeats struct {
+	responses map[string]*ttlResponse
+	timer     *time.Timer
+}
+
+// C returns the channel signaled when the heartbeats are due, or nil if no resource has a TTL.
+func (h *ttlHeartbeats) C() <-chan time.Time {
+	if h.timer == nil {
+		return nil
+	}
+	return h.timer.C
+}
+
+// record sets the resources last sent for the type, and reschedules the heartbeats.
+func (h *ttlHeartbeats) record(typeURL, version, noncePrefix string, resources []TTLResource) {
+	var interval time.Duration
+	for _, r := range resources {
+		if r.TTL > 0 && (interval == 0 || r.TTL/2 < interval) {
+			interval = r.TTL / 2
+		}
+	}
+	if interval == 0 {
+		if _, f := h.responses[typeURL]; !f {
+			return
+		}
+		delete(h.responses, typeURL)
+	} else {
+		if h.responses == nil {
+			h.responses = map[string]*ttlResponse{}
+		}
+		h.responses[typeURL] = &ttlResponse{
+			version:     version,
+			noncePrefix: noncePrefix,
+			resources:   resources,
+			interval:    interval,
+		}
+	}
+	h.schedule()
+}
+
+// schedule arms the timer for the shortest heartbeat interval of all types.
+func (h *ttlHeartbeats) schedule() {
+	h.stop()
+	var interval time.Duration
+	for _, r := range h.responses {
+		if interval == 0 || r.interval < interval {
+			interval = r.interval
+		}
+	}
+	if interval > 0 {
+		h.timer = time.NewTimer(interval)
+	}
+}
+
+func (h *ttlHeartbeats) stop() {
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+}
+
+// generate generates the resources of the watched type with gen. The resources with a TTL, from a
+// TTLGenerator, are wrapped in a discovery.Resource envelope, and recorded for the heartbeats.
+// The delta adapter does not support the envelope, so delta connections get the resources without TTL.
+func (conn *Connection) generate(gen model.XdsResourceGenerator, push *model.PushContext, version string,
+	w *model.WatchedResource, updates model.XdsUpdates) (model.Resources, error) {
+	tg, ok := gen.(TTLGenerator)
+	if !ok || conn.Delta() {
+		return gen.Generate(conn.proxy, push, w, updates), nil
+	}
+	resources := tg.GenerateWithTTL(conn.proxy, push, w, updates)
+	if resources == nil {
+		return nil, nil
+	}
+	cl := make(model.Resources, 0, len(resources))
+	for _, r := range resources {
+		a, err := ttlEnvelope(r, true)
+		if err != nil {
+			return nil, err
+		}
+		cl = append(cl, a)
+	}
+	conn.heartbeats.record(w.TypeUrl, version, push.Version, resources)
+	return cl, nil
+}
+
+// sendHeartbeats resends the last response of each type with a TTL, with the resources with a TTL replaced
+// by envelopes without body, which refresh their TTL on the proxy without changing them.
+func (s *DiscoveryServer) sendHeartbeats(con *Connection) error {
+	for typeURL, r := range con.heartbeats.responses {
+		resp := &discovery.DiscoveryResponse{
+			TypeUrl:     typeURL,
+			VersionInfo: con.nextVersion(typeURL, r.version),
+			Nonce:       nonce(r.noncePrefix),
+		}
+		for _, res := range r.resources {
+			a, err := ttlEnvelope(res, false)
+			if err != nil {
+				return &pushError{typeURL: typeURL, err: err}
+			}
+			resp.Resources = append(resp.Resources, a)
+		}
+		if err := con.send(resp); err != nil {
+			recordSendError("ADS", con.ConID, apiSendErrPushes, err)
+			return &pushError{typeURL: typeURL, err: err}
+		}
+		xdsTTLHeartbeats.With(typeTag.Value(v3.GetMetricType(typeURL))).Increment()
+	}
+	con.heartbeats.schedule()
+	return nil
+}
+
+// ttlEnvelope returns the resource wrapped in a discovery.Resource with its TTL, or the resource itself if
+// it does not expire. Heartbeat envelopes, without body, only refresh the TTL of the resource on the proxy.
+func ttlEnvelope(r TTLResource, withBody bool) (*any.Any, error) {
+	if r.TTL <= 0 {
+		return r.Resource, nil
+	}
+	envelope := &discovery.Resource{Name: r.Name, Ttl: ptypes.DurationProto(r.TTL)}
+	if withBody {
+		envelope.Resource = r.Resource
+	}
+	return ptypes.MarshalAny(envelope)
+}
@@ -0,0 +1,119 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+const ttlTestType = "type.googleapis.com/istio.test.TTL"
+
+type ttlGenerator struct {
+	resources []TTLResource
+}
+
+func (g *ttlGenerator) Generate(*model.Proxy, *model.PushContext, *model.WatchedResource, model.XdsUpdates) model.Resources {
+	cl := model.Resources{}
+	for _, r := range g.resources {
+		cl = append(cl, r.Resource)
+	}
+	return cl
+}
+
+func (g *ttlGenerator) GenerateWithTTL(*model.Proxy, *model.PushContext, *model.WatchedResource, model.XdsUpdates) []TTLResource {
+	return g.resources
+}
+
+// decodeEnvelope returns the envelope and its TTL.
+func decodeEnvelope(t *testing.T, a *any.Any) (*discovery.Resource, time.Duration) {
+	t.Helper()
+	r := &discovery.Resource{}
+	if err := ptypes.UnmarshalAny(a, r); err != nil {
+		t.Fatal(err)
+	}
+	ttl, err := ptypes.Duration(r.Ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, ttl
+}
+
+func TestResourceTTL(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	transient := &any.Any{TypeUrl: ttlTestType, Value: []byte("transient")}
+	static := &any.Any{TypeUrl: ttlTestType, Value: []byte("static")}
+	s.Discovery.RegisterGenerator(ttlTestType, &ttlGenerator{resources: []TTLResource{
+		{Name: "transient", Resource: transient, TTL: 10 * time.Second},
+		{Name: "static", Resource: static},
+	}})
+	conn := s.NewReplayConnection(nil)
+
+	res := conn.Send(&discovery.DiscoveryRequest{TypeUrl: ttlTestType})
+	if len(res) != 1 || len(res[0].Resources) != 2 {
+		t.Fatalf("expected one response with 2 resources, got %v", res)
+	}
+	envelope, ttl := decodeEnvelope(t, res[0].Resources[0])
+	if envelope.Name != "transient" || ttl != 10*time.Second || !proto.Equal(envelope.Resource, transient) {
+		t.Fatalf("unexpected envelope %v with ttl %v", envelope, ttl)
+	}
+	if !proto.Equal(res[0].Resources[1], static) {
+		t.Fatalf("resources without TTL must not be wrapped, got %v", res[0].Resources[1])
+	}
+	if conn.con.heartbeats.C() == nil {
+		t.Fatal("expected the heartbeats to be scheduled")
+	}
+	defer conn.con.heartbeats.stop()
+	if got := conn.con.heartbeats.responses[ttlTestType].interval; got != 5*time.Second {
+		t.Fatalf("expected heartbeats at half the TTL, got %v", got)
+	}
+
+	sent := len(conn.stream.Responses())
+	if err := s.Discovery.sendHeartbeats(conn.con); err != nil {
+		t.Fatal(err)
+	}
+	heartbeats := conn.stream.Responses()[sent:]
+	if len(heartbeats) != 1 || len(heartbeats[0].Resources) != 2 {
+		t.Fatalf("expected one heartbeat with 2 resources, got %v", heartbeats)
+	}
+	envelope, ttl = decodeEnvelope(t, heartbeats[0].Resources[0])
+	if envelope.Name != "transient" || ttl != 10*time.Second || envelope.Resource != nil {
+		t.Fatalf("expected a heartbeat envelope without body, got %v with ttl %v", envelope, ttl)
+	}
+	if !proto.Equal(heartbeats[0].Resources[1], static) {
+		t.Fatalf("the heartbeat must keep the resources without TTL, got %v", heartbeats[0].Resources[1])
+	}
+}
+
+func TestResourceTTLNoExpiry(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.Discovery.RegisterGenerator(ttlTestType, &ttlGenerator{resources: []TTLResource{
+		{Name: "static", Resource: &any.Any{TypeUrl: ttlTestType, Value: []byte("static")}},
+	}})
+	conn := s.NewReplayConnection(nil)
+	if res := conn.Send(&discovery.DiscoveryRequest{TypeUrl: ttlTestType}); len(res) != 1 {
+		t.Fatalf("expected one response, got %v", res)
+	}
+	if conn.con.heartbeats.C() != nil {
+		t.Fatal("no heartbeats are needed for resources without TTL")
+	}
+}
@@ -15,7 +15,17 @@
 package xds
 
 import (
+	"sort"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
 	networkingapi "istio.io/api/networking/v1alpha3"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/config/labels"
 )
 
@@ -41,3 +51,102 @@ func getSubSetLabels(dr *networkingapi.DestinationRule, subsetName string) label
 
 	return nil
 }
+
+// resourceNames returns the names of up to limit resources. Resources of other types than
+// CDS, LDS, RDS and EDS, or that can't be unmarshalled, are skipped.
+// This unmarshals the resources, so it should only be used for debugging.
+func resourceNames(resources []*any.Any, limit int) []string {
+	names := make([]string, 0, len(resources))
+	for _, r := range resources {
+		if len(names) >= limit {
+			break
+		}
+		if name := resourceName(r); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// maxResourceNameLength is the longest resource name accepted from a proxy. It leaves ample room for
+// cluster names, which embed a hostname of up to 253 characters.
+const maxResourceNameLength = 1024
+
+// validResourceName returns whether a requested resource name is acceptable. Names must be reasonably
+// short and only contain printable ASCII, so a malicious proxy cannot inject content into logs and
+// debug output.
+func validResourceName(name string) bool {
+	if len(name) == 0 || len(name) > maxResourceNameLength {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeResourceNames drops invalid resource names requested by the proxy, before they are stored.
+func sanitizeResourceNames(con *Connection, typeURL string, names []string) []string {
+	for i, name := range names {
+		if validResourceName(name) {
+			continue
+		}
+		// Found an invalid name, copy the valid ones so the request is not modified in place.
+		out := make([]string, i, len(names))
+		copy(out, names[:i])
+		for _, name := range names[i:] {
+			if validResourceName(name) {
+				out = append(out, name)
+				continue
+			}
+			invalidResourceNames.With(typeTag.Value(v3.GetMetricType(typeURL))).Increment()
+			if len(name) > 64 {
+				name = name[:64]
+			}
+			adsLog.Warnf("ADS:%s: %s requested invalid resource name %q", v3.GetShortType(typeURL), con.ConID, name)
+		}
+		return out
+	}
+	return names
+}
+
+// resourceName returns the name of a Cluster, Listener, RouteConfiguration or ClusterLoadAssignment
+// resource, or an empty string for other types.
+func resourceName(r *any.Any) string {
+	switch r.TypeUrl {
+	case v3.ClusterType:
+		c := &cluster.Cluster{}
+		if err := ptypes.UnmarshalAny(r, c); err == nil {
+			return c.Name
+		}
+	case v3.ListenerType:
+		l := &listener.Listener{}
+		if err := ptypes.UnmarshalAny(r, l); err == nil {
+			return l.Name
+		}
+	case v3.RouteType:
+		rc := &route.RouteConfiguration{}
+		if err := ptypes.UnmarshalAny(r, rc); err == nil {
+			return rc.Name
+		}
+	case v3.EndpointType:
+		cla := &endpoint.ClusterLoadAssignment{}
+		if err := ptypes.UnmarshalAny(r, cla); err == nil {
+			return cla.ClusterName
+		}
+	}
+	return ""
+}
+
+// sortResources sorts resources by name, so the same set of resources always produces the same response.
+func sortResources(resources []*any.Any) {
+	names := make(map[*any.Any]string, len(resources))
+	for _, r := range resources {
+		names[r] = resourceName(r)
+	}
+	sort.SliceStable(resources, func(i, j int) bool {
+		return names[resources[i]] < names[resources[j]]
+	})
+}
@@ -0,0 +1,55 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestSortResources(t *testing.T) {
+	resources := []*any.Any{
+		util.MessageToAny(&cluster.Cluster{Name: "c"}),
+		util.MessageToAny(&cluster.Cluster{Name: "a"}),
+		util.MessageToAny(&cluster.Cluster{Name: "b"}),
+	}
+	sortResources(resources)
+	if got, want := resourceNames(resources, len(resources)), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestSanitizeResourceNames(t *testing.T) {
+	con := &Connection{ConID: "con"}
+	valid := []string{"outbound|80||a.default.svc.cluster.local", "http.80"}
+	if got := sanitizeResourceNames(con, v3.ClusterType, valid); !reflect.DeepEqual(got, valid) {
+		t.Fatalf("expected valid names to be kept, got %v", got)
+	}
+
+	requested := []string{"http.80", "bad\nname", strings.Repeat("a", maxResourceNameLength+1), "", "http.443"}
+	if got, want := sanitizeResourceNames(con, v3.RouteType, requested), []string{"http.80", "http.443"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if requested[1] != "bad\nname" {
+		t.Fatalf("expected the request not to be modified in place")
+	}
+}
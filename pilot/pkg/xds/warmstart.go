@@ -0,0 +1,159 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/golang/protobuf/jsonpb"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// warmStartEntry is the persisted state of a connection, from which the config for its expected
+// reconnect is generated ahead of time.
+type warmStartEntry struct {
+	// Node is the node of the connection, as Envoy JSON.
+	Node json.RawMessage `json:"node"`
+	// Clusters are the EDS clusters the connection was watching.
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+// saveWarmStartState writes the state of the current connections to path, so the next Istiod
+// process can pre-generate their config.
+func (s *DiscoveryServer) saveWarmStartState(path string) error {
+	jsonm := &jsonpb.Marshaler{}
+	var entries []warmStartEntry
+	s.adsClientsMutex.RLock()
+	for _, con := range s.adsClients {
+		if con.node == nil {
+			continue
+		}
+		node, err := jsonm.MarshalToString(con.node)
+		if err != nil {
+			s.adsClientsMutex.RUnlock()
+			return err
+		}
+		entries = append(entries, warmStartEntry{Node: json.RawMessage(node), Clusters: con.Clusters()})
+	}
+	s.adsClientsMutex.RUnlock()
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// preGenerateWarmStart generates the config of the connections saved in path ahead of their reconnect, so
+// the proxies are served from the caches instead of generating config under load: their EDS config into the
+// endpoint cache, if PILOT_ENABLE_EDS_CACHE is set, and their CDS config into the proxy shape cache, if
+// PILOT_ENABLE_PROXY_SHAPE_CACHE is set. LDS and RDS are still generated on reconnect.
+//
+// The config is generated from a push context of its own, built like the ones of regular pushes. It is
+// published if no push context was built meanwhile, so the reconnecting proxies are served from the same
+// push context, and hit the caches.
+func (s *DiscoveryServer) preGenerateWarmStart(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []warmStartEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	push := model.NewPushContext()
+	push.PushVersion = versionInfo()
+	if err := push.InitContext(s.Env, nil, nil); err != nil {
+		return err
+	}
+	if err := s.UpdateServiceShards(push); err != nil {
+		return err
+	}
+	endpoints, shapes := 0, 0
+	for _, entry := range entries {
+		node := &core.Node{}
+		if err := jsonpb.UnmarshalString(string(entry.Node), node); err != nil {
+			adsLog.Warnf("Warm start: skipping invalid node: %v", err)
+			continue
+		}
+		proxy, err := s.initProxy(node)
+		if err == nil {
+			err = s.setProxyState(proxy, push)
+		}
+		if err != nil {
+			adsLog.Debugf("Warm start: skipping %s: %v", node.Id, err)
+			continue
+		}
+		if features.EnableEDSCaching {
+			for _, clusterName := range entry.Clusters {
+				builder := NewEndpointBuilder(clusterName, proxy, push)
+				if _, f := s.cache.Get(builder); f {
+					continue
+				}
+				l := s.generateEndpoints(builder)
+				if l == nil {
+					continue
+				}
+				s.cache.Add(builder, util.MessageToAny(l))
+				endpoints++
+			}
+		}
+		// Proxies with a custom generator are not served from the proxy shape cache.
+		if s.shapeCache != nil && proxy.Metadata.Generator == "" {
+			if s.warmShape(proxy, push) {
+				shapes++
+			}
+		}
+	}
+
+	s.updateMutex.Lock()
+	published := !s.Env.PushContext.IsInitialized()
+	if published {
+		s.Env.PushContext = push
+		s.lastGoodPushContext = push
+	}
+	s.updateMutex.Unlock()
+	adsLog.Infof("Warm start: pre-generated %d endpoint assignments and %d proxy shapes for %d proxies in %v (published: %v)",
+		endpoints, shapes, len(entries), time.Since(start), published)
+	return nil
+}
+
+// warmShape generates the clusters of the proxy into the proxy shape cache, unless a proxy of the same shape
+// was already generated. It returns true if clusters were generated.
+func (s *DiscoveryServer) warmShape(proxy *model.Proxy, push *model.PushContext) bool {
+	key := proxyShapeKey(v3.ClusterType, proxy)
+	if key == "" {
+		return false
+	}
+	if _, f := s.shapeCache.get(pushVersion(push), key); f {
+		return false
+	}
+	resources := cdsDiscoveryResponse(s.ConfigGenerator.BuildClusters(proxy, push), "", "").Resources
+	s.shapeCache.add(pushVersion(push), key, resources)
+	return true
+}
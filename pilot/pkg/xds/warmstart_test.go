@@ -0,0 +1,95 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/test/env"
+)
+
+func TestWarmStart(t *testing.T) {
+	config, err := ioutil.ReadFile(filepath.Join(env.IstioSrc, "tests/testdata/config/static-weighted-se.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	before := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: string(config)})
+	con := before.NewReplayConnection(nil)
+	con.Send(&discovery.DiscoveryRequest{
+		TypeUrl:       v3.EndpointType,
+		ResourceNames: []string{"outbound|80||weighted.static.svc.cluster.local"},
+	})
+	if err := before.Discovery.saveWarmStartState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: string(config)})
+	after.Discovery.cache.ClearAll()
+	if err := after.Discovery.preGenerateWarmStart(path); err != nil {
+		t.Fatal(err)
+	}
+	if keys := after.Discovery.cache.Keys(); len(keys) != 1 {
+		t.Fatalf("expected the endpoints of the saved connection to be cached, got %v", keys)
+	}
+
+	// The warm start push context is not published over one built meanwhile.
+	if after.Discovery.globalPushContext() != after.PushContext() {
+		t.Fatalf("expected the push context built meanwhile to be kept")
+	}
+
+	// A missing state file, for example on the first start, is not an error.
+	if err := after.Discovery.preGenerateWarmStart(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWarmStartShapes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	before := NewFakeDiscoveryServer(t, FakeOptions{})
+	before.NewReplayConnection(nil)
+	if err := before.Discovery.saveWarmStartState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewFakeDiscoveryServer(t, FakeOptions{})
+	after.Discovery.shapeCache = newProxyShapeCache()
+	// As on start, no push context was built yet.
+	live := model.NewPushContext()
+	after.Discovery.Env.PushContext = live
+	if err := after.Discovery.preGenerateWarmStart(path); err != nil {
+		t.Fatal(err)
+	}
+	push := after.Discovery.globalPushContext()
+	if push == live || !push.IsInitialized() {
+		t.Fatalf("expected the warm start push context to be published")
+	}
+	if live.IsInitialized() {
+		t.Fatalf("the live push context must not be initialized in place")
+	}
+
+	// The reconnecting proxy is served its clusters from the shape cache.
+	con := after.NewReplayConnection(nil)
+	if _, f := after.Discovery.shapeCache.get(pushVersion(push), proxyShapeKey(v3.ClusterType, con.con.proxy)); !f {
+		t.Fatalf("expected the clusters of the saved connection to be cached")
+	}
+}
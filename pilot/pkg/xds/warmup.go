@@ -0,0 +1,82 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// warmupLimiter bounds the rate at which new connections are accepted for a period after the server
+// becomes ready, while the process is still cold. The allowed rate increases linearly from initial to
+// final over the warmup duration, after which connections are no longer limited.
+type warmupLimiter struct {
+	duration time.Duration
+	initial  rate.Limit
+	final    rate.Limit
+	limiter  *rate.Limiter
+
+	// readySince is the time, in Unix nanoseconds, the server became ready, or 0 before that.
+	// Accessed atomically.
+	readySince int64
+}
+
+func newWarmupLimiter(duration time.Duration, initial, final float64) *warmupLimiter {
+	if final < initial {
+		final = initial
+	}
+	return &warmupLimiter{
+		duration: duration,
+		initial:  rate.Limit(initial),
+		final:    rate.Limit(final),
+		limiter:  rate.NewLimiter(rate.Limit(initial), 1),
+	}
+}
+
+// Start begins the warmup. Only the first call has an effect.
+func (w *warmupLimiter) Start(now time.Time) {
+	atomic.CompareAndSwapInt64(&w.readySince, 0, now.UnixNano())
+}
+
+// limitAt returns the rate connections are accepted at, the given time after the warmup started.
+func (w *warmupLimiter) limitAt(elapsed time.Duration) rate.Limit {
+	if elapsed >= w.duration {
+		return rate.Inf
+	}
+	progress := rate.Limit(float64(elapsed) / float64(w.duration))
+	return w.initial + (w.final-w.initial)*progress
+}
+
+// Wait blocks until a new connection may be accepted, or the context is done. It returns immediately
+// if the warmup did not start or is over.
+func (w *warmupLimiter) Wait(ctx context.Context) error {
+	since := atomic.LoadInt64(&w.readySince)
+	if since == 0 {
+		return nil
+	}
+	limit := w.limitAt(time.Since(time.Unix(0, since)))
+	if limit == rate.Inf {
+		return nil
+	}
+	w.limiter.SetLimit(limit)
+	if w.limiter.Allow() {
+		return nil
+	}
+	xdsWarmupThrottledConnections.Increment()
+	return w.limiter.Wait(ctx)
+}
@@ -0,0 +1,67 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestWarmupLimiterRamp(t *testing.T) {
+	w := newWarmupLimiter(10*time.Second, 10, 110)
+	cases := []struct {
+		elapsed time.Duration
+		limit   rate.Limit
+	}{
+		{0, 10},
+		{5 * time.Second, 60},
+		{10 * time.Second, rate.Inf},
+	}
+	for _, tt := range cases {
+		if got := w.limitAt(tt.elapsed); got != tt.limit {
+			t.Errorf("after %v: expected limit %v, got %v", tt.elapsed, tt.limit, got)
+		}
+	}
+}
+
+func TestWarmupLimiterWait(t *testing.T) {
+	w := newWarmupLimiter(time.Hour, 0.001, 0.001)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Before the server is ready, connections are not limited.
+	for i := 0; i < 3; i++ {
+		if err := w.Wait(ctx); err != nil {
+			t.Fatalf("expected no limit before the warmup started: %v", err)
+		}
+	}
+	w.Start(time.Now())
+	if err := w.Wait(ctx); err != nil {
+		t.Fatalf("expected the first connection to be accepted: %v", err)
+	}
+	if err := w.Wait(ctx); err == nil {
+		t.Fatalf("expected the next connection to be limited")
+	}
+
+	w = newWarmupLimiter(time.Second, 0.001, 0.001)
+	w.Start(time.Now().Add(-time.Minute))
+	for i := 0; i < 3; i++ {
+		if err := w.Wait(ctx); err != nil {
+			t.Fatalf("expected no limit after the warmup: %v", err)
+		}
+	}
+}
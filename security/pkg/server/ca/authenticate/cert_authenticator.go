@@ -52,21 +52,22 @@ func (cca *ClientCertAuthenticator) AuthenticatorType() string {
 // Authenticate extracts identities from presented client certificates. This
 // method assumes that certificate chain has been properly validated before
 // this method is called. In other words, this method does not do certificate
-// chain validation itself.
+// chain validation itself. A request without client certificate returns an
+// error matching ErrNotApplicable.
 func (cca *ClientCertAuthenticator) Authenticate(ctx context.Context) (*Caller, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok || peer.AuthInfo == nil {
-		return nil, fmt.Errorf("no client certificate is presented")
+		return nil, notApplicableError("no client certificate is presented")
 	}
 
 	if authType := peer.AuthInfo.AuthType(); authType != "tls" {
-		return nil, fmt.Errorf("unsupported auth type: %q", authType)
+		return nil, notApplicableError(fmt.Sprintf("unsupported auth type: %q", authType))
 	}
 
 	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
 	chains := tlsInfo.State.VerifiedChains
 	if len(chains) == 0 || len(chains[0]) == 0 {
-		return nil, fmt.Errorf("no verified chain is found")
+		return nil, notApplicableError("no verified chain is found")
 	}
 
 	ids, err := util.ExtractIDs(chains[0][0].Extensions)
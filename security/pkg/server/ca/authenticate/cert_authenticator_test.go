@@ -18,6 +18,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"reflect"
 	"testing"
 
@@ -51,23 +52,27 @@ func TestAuthenticate_clientCertAuthenticator(t *testing.T) {
 		certChain          [][]*x509.Certificate
 		caller             *Caller
 		authenticateErrMsg string
+		notApplicable      bool
 		fakeAuthInfo       *mockAuthInfo
 	}{
 		"No client certificate": {
 			certChain:          nil,
 			caller:             nil,
 			authenticateErrMsg: "no client certificate is presented",
+			notApplicable:      true,
 		},
 		"Unsupported auth type": {
 			certChain:          nil,
 			caller:             nil,
 			authenticateErrMsg: "unsupported auth type: \"not-tls\"",
+			notApplicable:      true,
 			fakeAuthInfo:       &mockAuthInfo{"not-tls"},
 		},
 		"Empty cert chain": {
 			certChain:          [][]*x509.Certificate{},
 			caller:             nil,
 			authenticateErrMsg: "no verified chain is found",
+			notApplicable:      true,
 		},
 		"Certificate has no SAN": {
 			certChain: [][]*x509.Certificate{
@@ -113,6 +118,8 @@ func TestAuthenticate_clientCertAuthenticator(t *testing.T) {
 			} else if err.Error() != tc.authenticateErrMsg {
 				t.Errorf("Case %s: Incorrect error message: want %s but got %s",
 					id, tc.authenticateErrMsg, err.Error())
+			} else if errors.Is(err, ErrNotApplicable) != tc.notApplicable {
+				t.Errorf("Case %s: want not applicable %v but got %v", id, tc.notApplicable, err)
 			}
 			continue
 		} else if err != nil {
@@ -178,6 +185,8 @@ func TestExtractBearerToken(t *testing.T) {
 			} else if err.Error() != tc.extractBearerTokenErrMsg {
 				t.Errorf("Case %s: Incorrect error message: %s VS %s",
 					id, err.Error(), tc.extractBearerTokenErrMsg)
+			} else if !errors.Is(err, ErrNotApplicable) {
+				t.Errorf("Case %s: a missing bearer token must not be applicable, got %v", id, err)
 			}
 			continue
 		} else if err != nil {
@@ -72,11 +72,12 @@ func (a *KubeJWTAuthenticator) AuthenticatorType() string {
 }
 
 // Authenticate authenticates the call using the K8s JWT from the context.
-// The returned Caller.Identities is in SPIFFE format.
+// The returned Caller.Identities is in SPIFFE format. A request without bearer
+// token returns an error matching ErrNotApplicable.
 func (a *KubeJWTAuthenticator) Authenticate(ctx context.Context) (*Caller, error) {
 	targetJWT, err := extractBearerToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("target JWT extraction error: %v", err)
+		return nil, fmt.Errorf("target JWT extraction error: %w", err)
 	}
 	clusterID := extractClusterID(ctx)
 	var id []string
@@ -138,12 +139,12 @@ func (a *KubeJWTAuthenticator) GetKubeClient(clusterID string) kubernetes.Interf
 func extractBearerToken(ctx context.Context) (string, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return "", fmt.Errorf("no metadata is attached")
+		return "", notApplicableError("no metadata is attached")
 	}
 
 	authHeader, exists := md[authorizationMeta]
 	if !exists {
-		return "", fmt.Errorf("no HTTP authorization header exists")
+		return "", notApplicableError("no HTTP authorization header exists")
 	}
 
 	for _, value := range authHeader {
@@ -152,7 +153,7 @@ func extractBearerToken(ctx context.Context) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("no bearer token exists in HTTP authorization header")
+	return "", notApplicableError("no bearer token exists in HTTP authorization header")
 }
 
 func extractClusterID(ctx context.Context) string {
@@ -15,6 +15,7 @@
 package authenticate
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -59,6 +60,7 @@ func TestAuthenticate(t *testing.T) {
 		jwtPolicy      string
 		expectedID     string
 		expectedErrMsg string
+		notApplicable  bool
 	}{
 		"No bearer token": {
 			metadata: metadata.MD{
@@ -68,6 +70,7 @@ func TestAuthenticate(t *testing.T) {
 				},
 			},
 			expectedErrMsg: "target JWT extraction error: no bearer token exists in HTTP authorization header",
+			notApplicable:  true,
 		},
 		"token not authenticated": {
 			token: invlidToken,
@@ -163,6 +166,8 @@ func TestAuthenticate(t *testing.T) {
 				} else if err.Error() != tc.expectedErrMsg {
 					t.Errorf("Case %s: Incorrect error message: \n%s\nVS\n%s",
 						id, err.Error(), tc.expectedErrMsg)
+				} else if errors.Is(err, ErrNotApplicable) != tc.notApplicable {
+					t.Errorf("Case %s: want not applicable %v but got %v", id, tc.notApplicable, err)
 				}
 				return
 			} else if err != nil {
@@ -14,7 +14,26 @@
 
 package authenticate
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotApplicable is returned, possibly wrapped, by an Authenticator when the request does not carry the
+// credential it checks, for example a request without client certificate or without bearer token. Callers
+// consulting several authenticators skip it, rather than treating it as a failed authentication.
+var ErrNotApplicable = errors.New("authenticator not applicable")
+
+// notApplicableError is an error with its own message, matching ErrNotApplicable.
+type notApplicableError string
+
+func (e notApplicableError) Error() string {
+	return string(e)
+}
+
+func (e notApplicableError) Is(target error) bool {
+	return target == ErrNotApplicable
+}
 
 // Caller carries the identity and authentication source of a caller.
 type Caller struct {
@@ -54,7 +54,7 @@ func NewJwtAuthenticator(iss string, trustDomain, audience string) (*JwtAuthenti
 func (j *JwtAuthenticator) Authenticate(ctx context.Context) (*Caller, error) {
 	bearerToken, err := extractBearerToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("ID token extraction error: %v", err)
+		return nil, fmt.Errorf("ID token extraction error: %w", err)
 	}
 
 	idToken, err := j.verifier.Verify(context.Background(), bearerToken)